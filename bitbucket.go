@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const bitbucketAPIURL = "https://api.bitbucket.org/2.0"
+
+type PullRequestCreatedPayload struct {
+	PullRequest struct {
+		ID     int    `json:"id"`
+		Title  string `json:"title"`
+		Source struct {
+			Branch struct {
+				Name string `json:"name"`
+			} `json:"branch"`
+			Commit struct {
+				Hash string `json:"hash"`
+			} `json:"commit"`
+		} `json:"source"`
+		Destination struct {
+			Branch struct {
+				Name string `json:"name"`
+			} `json:"branch"`
+			Commit struct {
+				Hash string `json:"hash"`
+			} `json:"commit"`
+		} `json:"destination"`
+		Author struct {
+			DisplayName string `json:"display_name"`
+		} `json:"author"`
+		Links struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+		Reviewers   []Reviewer `json:"reviewers"`
+		Description string     `json:"description"`
+	} `json:"pullrequest"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// BitbucketCloudProvider talks to bitbucket.org using an app password
+type BitbucketCloudProvider struct {
+	Username      string
+	AppPassword   string
+	APIURL        string
+	WebhookSecret string
+
+	mu   sync.Mutex
+	uuid string // The app password's user, looked up on first use
+}
+
+// newBitbucketCloudProvider builds a provider from BITBUCKET_USERNAME,
+// BITBUCKET_APP_PASSWORD, BITBUCKET_WEBHOOK_SECRET and BITBUCKET_API_URL.
+func newBitbucketCloudProvider() (*BitbucketCloudProvider, error) {
+	secret := os.Getenv("BITBUCKET_WEBHOOK_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("BITBUCKET_WEBHOOK_SECRET environment variable not set")
+	}
+	apiURL := os.Getenv("BITBUCKET_API_URL")
+	if apiURL == "" {
+		apiURL = bitbucketAPIURL
+	}
+	return &BitbucketCloudProvider{
+		Username:      os.Getenv("BITBUCKET_USERNAME"),
+		AppPassword:   os.Getenv("BITBUCKET_APP_PASSWORD"),
+		APIURL:        strings.TrimSuffix(apiURL, "/"),
+		WebhookSecret: secret,
+	}, nil
+}
+
+func (b *BitbucketCloudProvider) Name() string { return "bitbucket" }
+
+func (b *BitbucketCloudProvider) ParseWebhook(r *http.Request, body []byte) (*PullRequest, error) {
+	// Without a secret every delivery is rejected
+	if b.WebhookSecret == "" {
+		return nil, fmt.Errorf("no webhook secret configured")
+	}
+	mac := hmac.New(sha256.New, []byte(b.WebhookSecret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Hub-Signature"))) {
+		return nil, fmt.Errorf("invalid X-Hub-Signature")
+	}
+
+	eventKey := strings.TrimSpace(r.Header.Get("X-Event-Key"))
+	slog.DebugContext(r.Context(), "Received webhook", "header", "X-Event-Key", "event", eventKey)
+
+	if eventKey != "pullrequest:created" && eventKey != "pullrequest:updated" {
+		return nil, fmt.Errorf("%w: %s", ErrIgnoredEvent, eventKey)
+	}
+
+	var payload PullRequestCreatedPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	if len(payload.PullRequest.Reviewers) == 0 {
+		return nil, fmt.Errorf("%w: PR #%d '%s' has no reviewers", ErrIgnoredEvent,
+			payload.PullRequest.ID, payload.PullRequest.Title)
+	}
+
+	// Check if exoReviewer is one of the reviewers
+	if !isExoReviewerPresent(payload.PullRequest.Reviewers) {
+		return nil, fmt.Errorf("%w: PR #%d '%s' does not have ExoReview assigned", ErrIgnoredEvent,
+			payload.PullRequest.ID, payload.PullRequest.Title)
+	}
+
+	return payload.toPullRequest(), nil
+}
+
+func (payload PullRequestCreatedPayload) toPullRequest() *PullRequest {
+	return &PullRequest{
+		Provider:     "bitbucket",
+		ID:           payload.PullRequest.ID,
+		Title:        payload.PullRequest.Title,
+		Description:  payload.PullRequest.Description,
+		Author:       payload.PullRequest.Author.DisplayName,
+		Repository:   payload.Repository.FullName,
+		RepoURL:      "https://bitbucket.org/" + payload.Repository.FullName,
+		URL:          payload.PullRequest.Links.HTML.Href,
+		SourceBranch: payload.PullRequest.Source.Branch.Name,
+		DestBranch:   payload.PullRequest.Destination.Branch.Name,
+		SourceCommit: payload.PullRequest.Source.Commit.Hash,
+		DestCommit:   payload.PullRequest.Destination.Commit.Hash,
+		Reviewers:    payload.PullRequest.Reviewers,
+	}
+}
+
+func (b *BitbucketCloudProvider) CloneURL(ctx context.Context, pr *PullRequest) (string, error) {
+	if b.Username == "" || b.AppPassword == "" {
+		return "", fmt.Errorf("BITBUCKET_USERNAME and BITBUCKET_APP_PASSWORD must be set")
+	}
+	u := url.URL{
+		Scheme: "https",
+		User:   url.UserPassword(b.Username, b.AppPassword),
+		Host:   "bitbucket.org",
+		Path:   "/" + pr.Repository + ".git",
+	}
+	return u.String(), nil
+}
+
+func (b *BitbucketCloudProvider) headers() map[string]string {
+	return map[string]string{"Authorization": basicAuth(b.Username, b.AppPassword)}
+}
+
+func (b *BitbucketCloudProvider) PostComment(ctx context.Context, pr *PullRequest, comment CommentPayload) (string, error) {
+	url := fmt.Sprintf("%s/repositories/%s/pullrequests/%d/comments", b.APIURL, pr.Repository, pr.ID)
+	slog.DebugContext(ctx, "Posting comment", "url", url)
+
+	var created struct {
+		ID int `json:"id"`
+	}
+	if err := sendJSON(ctx, "Bitbucket", http.MethodPost, url, b.headers(), comment, &created); err != nil {
+		return "", err
+	}
+
+	slog.DebugContext(ctx, "Comment posted", "comment_id", created.ID)
+	return strconv.Itoa(created.ID), nil
+}
+
+// SubmitReview posts each comment individually; Bitbucket Cloud has no
+// batched review API.
+func (b *BitbucketCloudProvider) SubmitReview(ctx context.Context, pr *PullRequest, comments []CommentPayload) []PostResult {
+	return postEach(ctx, b, pr, comments)
+}
+
+func (b *BitbucketCloudProvider) SetStatus(ctx context.Context, pr *PullRequest, state StatusState, description string) error {
+	if pr.SourceCommit == "" {
+		return fmt.Errorf("no source commit to attach status to")
+	}
+
+	bbState := "INPROGRESS"
+	switch state {
+	case StatusSuccess:
+		bbState = "SUCCESSFUL"
+	case StatusFailure, StatusError:
+		bbState = "FAILED"
+	}
+
+	link := pr.URL
+	if link == "" {
+		link = pr.RepoURL
+	}
+
+	url := fmt.Sprintf("%s/repositories/%s/commit/%s/statuses/build", b.APIURL, pr.Repository, pr.SourceCommit)
+	status := map[string]string{
+		"key":         statusKey,
+		"name":        "exoReviewer",
+		"state":       bbState,
+		"description": truncate(description, 255),
+		"url":         link,
+	}
+	return sendJSON(ctx, "Bitbucket", http.MethodPost, url, b.headers(), status, nil)
+}
+
+// userUUID returns the UUID of the user the app password belongs to
+func (b *BitbucketCloudProvider) userUUID(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.uuid != "" {
+		return b.uuid, nil
+	}
+	var user struct {
+		UUID string `json:"uuid"`
+	}
+	if err := sendJSON(ctx, "Bitbucket", http.MethodGet, b.APIURL+"/user", b.headers(), nil, &user); err != nil {
+		return "", fmt.Errorf("failed to look up Bitbucket user: %w", err)
+	}
+	b.uuid = user.UUID
+	return b.uuid, nil
+}
+
+func (b *BitbucketCloudProvider) ListComments(ctx context.Context, pr *PullRequest) ([]PostedComment, error) {
+	uuid, err := b.userUUID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var comments []PostedComment
+	next := fmt.Sprintf("%s/repositories/%s/pullrequests/%d/comments?pagelen=100", b.APIURL, pr.Repository, pr.ID)
+	for next != "" {
+		var page struct {
+			Values []struct {
+				ID      int     `json:"id"`
+				Deleted bool    `json:"deleted"`
+				Content Content `json:"content"`
+				Inline  *Inline `json:"inline"`
+				User    struct {
+					UUID        string `json:"uuid"`
+					DisplayName string `json:"display_name"`
+				} `json:"user"`
+			} `json:"values"`
+			Next string `json:"next"`
+		}
+		if err := sendJSON(ctx, "Bitbucket", http.MethodGet, next, b.headers(), nil, &page); err != nil {
+			return nil, err
+		}
+		for _, c := range page.Values {
+			if !c.Deleted && c.Inline == nil {
+				comments = append(comments, PostedComment{ID: strconv.Itoa(c.ID), Text: c.Content.Raw, Author: c.User.DisplayName, Mine: c.User.UUID == uuid})
+			}
+		}
+		next = page.Next
+	}
+	return comments, nil
+}
+
+func (b *BitbucketCloudProvider) EditComment(ctx context.Context, pr *PullRequest, id, text string) error {
+	url := fmt.Sprintf("%s/repositories/%s/pullrequests/%d/comments/%s", b.APIURL, pr.Repository, pr.ID, id)
+	body := CommentPayload{Content: Content{Raw: text}}
+	return sendJSON(ctx, "Bitbucket", http.MethodPut, url, b.headers(), body, nil)
+}
+
+// RequestChanges uses the account's "request changes" vote; the reason is
+// left to a comment since the vote carries no text.
+func (b *BitbucketCloudProvider) RequestChanges(ctx context.Context, pr *PullRequest, requested bool, reason string) error {
+	url := fmt.Sprintf("%s/repositories/%s/pullrequests/%d/request-changes", b.APIURL, pr.Repository, pr.ID)
+	method := http.MethodPost
+	if !requested {
+		method = http.MethodDelete
+	}
+	return sendJSON(ctx, "Bitbucket", method, url, b.headers(), nil, nil)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type bitbucketServerRef struct {
+	DisplayID    string `json:"displayId"`
+	LatestCommit string `json:"latestCommit"`
+	Repository   struct {
+		Slug    string `json:"slug"`
+		Project struct {
+			Key string `json:"key"`
+		} `json:"project"`
+	} `json:"repository"`
+}
+
+type bitbucketServerUser struct {
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	DisplayName string `json:"displayName"`
+}
+
+type BitbucketServerPayload struct {
+	EventKey    string `json:"eventKey"`
+	PullRequest struct {
+		ID          int                `json:"id"`
+		Title       string             `json:"title"`
+		Description string             `json:"description"`
+		FromRef     bitbucketServerRef `json:"fromRef"`
+		ToRef       bitbucketServerRef `json:"toRef"`
+		Author      struct {
+			User bitbucketServerUser `json:"user"`
+		} `json:"author"`
+		Reviewers []struct {
+			User bitbucketServerUser `json:"user"`
+		} `json:"reviewers"`
+		Links struct {
+			Self []struct {
+				Href string `json:"href"`
+			} `json:"self"`
+		} `json:"links"`
+	} `json:"pullRequest"`
+}
+
+// BitbucketServerProvider talks to a self-hosted Bitbucket Server or Data
+// Center instance using an HTTP access token.
+type BitbucketServerProvider struct {
+	BaseURL       string
+	Username      string // Used only for git over HTTPS
+	Token         string
+	WebhookSecret string
+
+	mu       sync.Mutex
+	userName string // The token's user, looked up on first use
+}
+
+// newBitbucketServerProvider builds a provider from BITBUCKET_SERVER_URL,
+// BITBUCKET_SERVER_TOKEN, BITBUCKET_SERVER_USERNAME and
+// BITBUCKET_SERVER_WEBHOOK_SECRET.
+func newBitbucketServerProvider() (*BitbucketServerProvider, error) {
+	baseURL := os.Getenv("BITBUCKET_SERVER_URL")
+	if baseURL == "" {
+		return nil, fmt.Errorf("BITBUCKET_SERVER_URL environment variable not set")
+	}
+	token := os.Getenv("BITBUCKET_SERVER_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("BITBUCKET_SERVER_TOKEN environment variable not set")
+	}
+	secret := os.Getenv("BITBUCKET_SERVER_WEBHOOK_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("BITBUCKET_SERVER_WEBHOOK_SECRET environment variable not set")
+	}
+	username := os.Getenv("BITBUCKET_SERVER_USERNAME")
+	if username == "" {
+		username = "x-token-auth"
+	}
+	return &BitbucketServerProvider{
+		BaseURL:       strings.TrimSuffix(baseURL, "/"),
+		Username:      username,
+		Token:         token,
+		WebhookSecret: secret,
+	}, nil
+}
+
+func (b *BitbucketServerProvider) Name() string { return "bitbucket-server" }
+
+func (b *BitbucketServerProvider) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + b.Token}
+}
+
+// repoAPIURL returns the REST URL of pr's repository. pr.Repository is
+// "PROJECT/slug".
+func (b *BitbucketServerProvider) repoAPIURL(pr *PullRequest) (string, error) {
+	parts := strings.SplitN(pr.Repository, "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid Bitbucket Server repository %q", pr.Repository)
+	}
+	return fmt.Sprintf("%s/rest/api/1.0/projects/%s/repos/%s", b.BaseURL, parts[0], parts[1]), nil
+}
+
+func (b *BitbucketServerProvider) ParseWebhook(r *http.Request, body []byte) (*PullRequest, error) {
+	// Without a secret every delivery is rejected
+	if b.WebhookSecret == "" {
+		return nil, fmt.Errorf("no webhook secret configured")
+	}
+	mac := hmac.New(sha256.New, []byte(b.WebhookSecret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Hub-Signature"))) {
+		return nil, fmt.Errorf("invalid X-Hub-Signature")
+	}
+
+	eventKey := strings.TrimSpace(r.Header.Get("X-Event-Key"))
+	slog.DebugContext(r.Context(), "Received webhook", "header", "X-Event-Key", "event", eventKey)
+
+	if eventKey != "pr:opened" && eventKey != "pr:from_ref_updated" {
+		return nil, fmt.Errorf("%w: %s", ErrIgnoredEvent, eventKey)
+	}
+
+	var payload BitbucketServerPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	pr := payload.toPullRequest(b.BaseURL)
+
+	if len(pr.Reviewers) == 0 {
+		return nil, fmt.Errorf("%w: PR #%d '%s' has no reviewers", ErrIgnoredEvent, pr.ID, pr.Title)
+	}
+
+	// Check if exoReviewer is one of the reviewers
+	if !isExoReviewerPresent(pr.Reviewers) {
+		return nil, fmt.Errorf("%w: PR #%d '%s' does not have ExoReview assigned", ErrIgnoredEvent, pr.ID, pr.Title)
+	}
+
+	return pr, nil
+}
+
+func (payload BitbucketServerPayload) toPullRequest(baseURL string) *PullRequest {
+	p := payload.PullRequest
+	projectKey := p.ToRef.Repository.Project.Key
+	slug := p.ToRef.Repository.Slug
+
+	pr := &PullRequest{
+		Provider:     "bitbucket-server",
+		ID:           p.ID,
+		Title:        p.Title,
+		Description:  p.Description,
+		Author:       p.Author.User.DisplayName,
+		Repository:   projectKey + "/" + slug,
+		RepoURL:      fmt.Sprintf("%s/projects/%s/repos/%s", baseURL, projectKey, slug),
+		SourceBranch: p.FromRef.DisplayID,
+		DestBranch:   p.ToRef.DisplayID,
+		SourceCommit: p.FromRef.LatestCommit,
+		DestCommit:   p.ToRef.LatestCommit,
+	}
+	if len(p.Links.Self) > 0 {
+		pr.URL = p.Links.Self[0].Href
+	}
+	for _, reviewer := range p.Reviewers {
+		pr.Reviewers = append(pr.Reviewers, Reviewer{DisplayName: reviewer.User.DisplayName, UUID: reviewer.User.Name})
+	}
+	return pr
+}
+
+func (b *BitbucketServerProvider) CloneURL(ctx context.Context, pr *PullRequest) (string, error) {
+	base, err := url.Parse(b.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid BITBUCKET_SERVER_URL: %v", err)
+	}
+	u := url.URL{
+		Scheme: base.Scheme,
+		User:   url.UserPassword(b.Username, b.Token),
+		Host:   base.Host,
+		Path:   strings.TrimSuffix(base.Path, "/") + "/scm/" + strings.ToLower(pr.Repository) + ".git",
+	}
+	return u.String(), nil
+}
+
+func (b *BitbucketServerProvider) PostComment(ctx context.Context, pr *PullRequest, comment CommentPayload) (string, error) {
+	repoURL, err := b.repoAPIURL(pr)
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("%s/pull-requests/%d/comments", repoURL, pr.ID)
+	slog.DebugContext(ctx, "Posting comment", "url", url)
+
+	body := map[string]interface{}{"text": comment.Content.Raw}
+	if comment.Inline != nil {
+		anchor := map[string]interface{}{
+			"path":     comment.Inline.Path,
+			"diffType": "EFFECTIVE",
+		}
+		if comment.Inline.To > 0 {
+			anchor["line"] = comment.Inline.To
+			anchor["lineType"] = "ADDED"
+			anchor["fileType"] = "TO"
+		} else {
+			anchor["line"] = comment.Inline.From
+			anchor["lineType"] = "REMOVED"
+			anchor["fileType"] = "FROM"
+		}
+		body["anchor"] = anchor
+	}
+
+	var created struct {
+		ID int `json:"id"`
+	}
+	err = sendJSON(ctx, "Bitbucket Server", http.MethodPost, url, b.headers(), body, &created)
+
+	// The model can't tell added lines from unchanged context lines, so retry
+	// an ADDED anchor the server rejected as not in the diff as CONTEXT.
+	// Other failures (auth, permissions, missing PR) would only fail again.
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusConflict) &&
+		comment.Inline != nil && comment.Inline.To > 0 {
+		body["anchor"].(map[string]interface{})["lineType"] = "CONTEXT"
+		err = sendJSON(ctx, "Bitbucket Server", http.MethodPost, url, b.headers(), body, &created)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	slog.DebugContext(ctx, "Comment posted", "comment_id", created.ID)
+	return strconv.Itoa(created.ID), nil
+}
+
+// SubmitReview posts each comment individually; pull request comments are
+// the only review primitive Bitbucket Server offers.
+func (b *BitbucketServerProvider) SubmitReview(ctx context.Context, pr *PullRequest, comments []CommentPayload) []PostResult {
+	return postEach(ctx, b, pr, comments)
+}
+
+func (b *BitbucketServerProvider) SetStatus(ctx context.Context, pr *PullRequest, state StatusState, description string) error {
+	if pr.SourceCommit == "" {
+		return fmt.Errorf("no source commit to attach status to")
+	}
+
+	bbState := "INPROGRESS"
+	switch state {
+	case StatusSuccess:
+		bbState = "SUCCESSFUL"
+	case StatusFailure, StatusError:
+		bbState = "FAILED"
+	}
+
+	link := pr.URL
+	if link == "" {
+		link = pr.RepoURL
+	}
+
+	url := fmt.Sprintf("%s/rest/build-status/1.0/commits/%s", b.BaseURL, pr.SourceCommit)
+	status := map[string]string{
+		"key":         statusKey,
+		"name":        "exoReviewer",
+		"state":       bbState,
+		"description": truncate(description, 255),
+		"url":         link,
+	}
+	return sendJSON(ctx, "Bitbucket Server", http.MethodPost, url, b.headers(), status, nil)
+}
+
+// ListComments reads comments from the PR's activity stream, which is the
+// only place Bitbucket Server lists general comments.
+func (b *BitbucketServerProvider) ListComments(ctx context.Context, pr *PullRequest) ([]PostedComment, error) {
+	repoURL, err := b.repoAPIURL(pr)
+	if err != nil {
+		return nil, err
+	}
+	userName, err := b.tokenUserName(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var comments []PostedComment
+	seen := make(map[int]bool)
+	start := 0
+	for {
+		var page struct {
+			Values []struct {
+				Action  string `json:"action"`
+				Comment *struct {
+					ID     int    `json:"id"`
+					Text   string `json:"text"`
+					Author struct {
+						Name string `json:"name"`
+					} `json:"author"`
+				} `json:"comment"`
+				CommentAnchor *json.RawMessage `json:"commentAnchor"`
+			} `json:"values"`
+			IsLastPage    bool `json:"isLastPage"`
+			NextPageStart int  `json:"nextPageStart"`
+		}
+		url := fmt.Sprintf("%s/pull-requests/%d/activities?start=%d&limit=100", repoURL, pr.ID, start)
+		if err := sendJSON(ctx, "Bitbucket Server", http.MethodGet, url, b.headers(), nil, &page); err != nil {
+			return nil, err
+		}
+		// Activities are newest first and an edited comment appears once per
+		// edit, so the first occurrence has the current text
+		for _, activity := range page.Values {
+			if activity.Action != "COMMENTED" || activity.Comment == nil || activity.CommentAnchor != nil || seen[activity.Comment.ID] {
+				continue
+			}
+			seen[activity.Comment.ID] = true
+			author := activity.Comment.Author.Name
+			comments = append(comments, PostedComment{ID: strconv.Itoa(activity.Comment.ID), Text: activity.Comment.Text, Author: author, Mine: author == userName})
+		}
+		if page.IsLastPage {
+			return comments, nil
+		}
+		start = page.NextPageStart
+	}
+}
+
+// EditComment needs the comment's current version, which Bitbucket Server
+// uses to reject conflicting edits.
+func (b *BitbucketServerProvider) EditComment(ctx context.Context, pr *PullRequest, id, text string) error {
+	repoURL, err := b.repoAPIURL(pr)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/pull-requests/%d/comments/%s", repoURL, pr.ID, id)
+	var current struct {
+		Version int `json:"version"`
+	}
+	if err := sendJSON(ctx, "Bitbucket Server", http.MethodGet, url, b.headers(), nil, &current); err != nil {
+		return err
+	}
+	body := map[string]interface{}{"text": text, "version": current.Version}
+	return sendJSON(ctx, "Bitbucket Server", http.MethodPut, url, b.headers(), body, nil)
+}
+
+// tokenUserName returns the name of the user BITBUCKET_SERVER_TOKEN belongs
+// to: BITBUCKET_SERVER_USERNAME when set, otherwise what the whoami servlet
+// answers, which is the only place Bitbucket Server tells
+func (b *BitbucketServerProvider) tokenUserName(ctx context.Context) (string, error) {
+	if b.Username != "" && b.Username != "x-token-auth" {
+		return b.Username, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.userName != "" {
+		return b.userName, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.BaseURL+"/plugins/servlet/applinks/whoami", nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range b.headers() {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up Bitbucket Server user: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to look up Bitbucket Server user: %w", err)
+	}
+	name := strings.TrimSpace(string(body))
+	if resp.StatusCode != http.StatusOK || name == "" {
+		return "", fmt.Errorf("failed to look up Bitbucket Server user: status %d", resp.StatusCode)
+	}
+	b.userName = name
+	return b.userName, nil
+}
+
+// RequestChanges sets the reviewer status of BITBUCKET_SERVER_USERNAME to
+// "needs work". Repository and project access tokens can't review, so this
+// needs a user's token.
+func (b *BitbucketServerProvider) RequestChanges(ctx context.Context, pr *PullRequest, requested bool, reason string) error {
+	if b.Username == "" || b.Username == "x-token-auth" {
+		return fmt.Errorf("requesting changes needs BITBUCKET_SERVER_USERNAME set to the token's user")
+	}
+	repoURL, err := b.repoAPIURL(pr)
+	if err != nil {
+		return err
+	}
+	status := "NEEDS_WORK"
+	if !requested {
+		status = "UNAPPROVED"
+	}
+	url := fmt.Sprintf("%s/pull-requests/%d/participants/%s", repoURL, pr.ID, url.PathEscape(b.Username))
+	body := map[string]interface{}{
+		"user":   map[string]string{"name": b.Username},
+		"status": status,
+	}
+	return sendJSON(ctx, "Bitbucket Server", http.MethodPut, url, b.headers(), body, nil)
+}
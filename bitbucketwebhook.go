@@ -2,58 +2,44 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"maps"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 	"go/ast"
 	"go/parser"
 	"go/token"
-	"context"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/sheets/v4"
-	"google.golang.org/api/option"
-)
 
-type PullRequestCreatedPayload struct {
-	PullRequest struct {
-		ID     int    `json:"id"`
-		Title  string `json:"title"`
-		Source struct {
-			Branch struct {
-				Name string `json:"name"`
-			} `json:"branch"`
-		} `json:"source"`
-		Destination struct {
-			Branch struct {
-				Name string `json:"name"`
-			} `json:"branch"`
-		} `json:"destination"`
-		Reviewers []struct {
-			DisplayName string `json:"display_name"`
-			UUID        string `json:"uuid"`
-		} `json:"reviewers"`
-		Description string `json:"description"`
-	} `json:"pullrequest"`
-	Repository struct {
-		FullName string `json:"full_name"`
-	} `json:"repository"`
-}
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
 
 type FileContext struct {
 	Path            string
 	Content         string          // Complete file content
 	PreviousContent string          // Content before changes
 	Dependencies    map[string]bool // Map of imported packages
+	TestPath        string          // Path of associated test file
 	TestContent     string          // Content of associated test file
 	Language        string          // File language/type
 }
@@ -89,17 +75,18 @@ type ArchitecturalContext struct {
 }
 
 type TestCase struct {
-	ID          string
-	Description string
-	Steps       []string
-	Expected    string
-	Actual      string
-	Status      string
+	ID          string   `json:"id"`
+	Description string   `json:"description"`
+	Steps       []string `json:"steps"`
+	Expected    string   `json:"expected"`
+	Actual      string   `json:"actual"`
+	Status      string   `json:"status"`
 }
 
 type TestCaseContext struct {
 	SheetURL     string
 	SheetID      string
+	Source       string // Where the test cases came from, e.g. a sheet URL or file path
 	TestCases    []TestCase
 	TotalTests   int
 	PassedTests  int
@@ -124,11 +111,18 @@ type CommentPayload struct {
 
 const chunkSeparator = "\n<<<<<<<<<<<< CHUNK SEPARATOR >>>>>>>>>>>\n"
 
+// shutdownTimeout bounds how long the server waits for in-flight requests,
+// and then for the last traces, when it is stopped
+const shutdownTimeout = 10 * time.Second
+
 const (
 	endpoint   = "https://gpt3-5-sc.openai.azure.com"
 	apiKey     = "your_api_token"
 	apiVersion = "2024-12-01-preview"
 	deployment = "gpt4Hackathon"
+
+	temperature = 0.7
+	maxTokens   = 1000
 )
 
 // GPTResponse represents the structure of the GPT-4 API response
@@ -139,6 +133,7 @@ type GPTResponse struct {
 			Content string `json:"content"`
 		} `json:"message"`
 	} `json:"choices"`
+	Usage TokenUsage `json:"usage"`
 }
 
 // LanguageStats tracks the number of files per language
@@ -147,42 +142,17 @@ type LanguageStats struct {
 	Count    int
 }
 
-func runGitCommand(dir string, name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
+func runGitCommand(ctx context.Context, dir string, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Dir = dir
 	output, err := cmd.CombinedOutput()
 	return string(output), err
 }
 
-func sanitizeFilename(name string) string {
-	// Replace characters that could cause issues in filenames
-	replacer := strings.NewReplacer(
-		"/", "_",
-		"\\", "_",
-		":", "_",
-		"*", "_",
-		"?", "_",
-		"\"", "_",
-		"<", "_",
-		">", "_",
-		"|", "_",
-		" ", "_",
-	)
-	return replacer.Replace(name)
-}
-
-func getFileContent(repoPath, filePath string) (string, error) {
-	content, err := os.ReadFile(filepath.Join(repoPath, filePath))
-	if err != nil {
-		return "", err
-	}
-	return string(content), nil
-}
-
-func getExactGitDiff(repoPath, sourceBranch, destBranch string) (string, error) {
+func getExactGitDiff(repoPath, sourceRef, destRef string) (string, error) {
 	// Use git diff with full context and exact output
 	cmd := exec.Command("git", "diff", "--full-index", "--no-color", 
-		fmt.Sprintf("origin/%s...origin/%s", destBranch, sourceBranch))
+		fmt.Sprintf("%s...%s", destRef, sourceRef))
 	cmd.Dir = repoPath
 	output, err := cmd.Output()
 	if err != nil {
@@ -191,7 +161,10 @@ func getExactGitDiff(repoPath, sourceBranch, destBranch string) (string, error)
 	return string(output), nil
 }
 
-func getFileContext(repoPath, filePath string) (FileContext, error) {
+// getFileContext reads filePath as of sourceRef, its previous version as of
+// baseRef and its test file as of sourceRef. The working tree is never read:
+// it needn't be at sourceRef.
+func getFileContext(ctx context.Context, repoPath, sourceRef, baseRef, filePath string) (FileContext, error) {
 	context := FileContext{
 		Path:         filePath,
 		Dependencies: make(map[string]bool),
@@ -199,49 +172,52 @@ func getFileContext(repoPath, filePath string) (FileContext, error) {
 	}
 
 	// Get current file content
-	content, err := getFileContent(repoPath, filePath)
+	content, err := fileAt(ctx, repoPath, sourceRef, filePath)
 	if err == nil {
 		context.Content = content
 	}
 
 	// Get previous version of the file
-	cmd := exec.Command("git", "show", fmt.Sprintf("HEAD:%s", filePath))
-	cmd.Dir = repoPath
-	prevContent, err := cmd.Output()
+	prevContent, err := fileAt(ctx, repoPath, baseRef, filePath)
 	if err == nil {
-		context.PreviousContent = string(prevContent)
+		context.PreviousContent = prevContent
 	}
 
 	// Get associated test file content if it exists
-	if strings.HasSuffix(filePath, ".go") {
-		baseFile := strings.TrimSuffix(filepath.Base(filePath), ".go")
-		testFile := filepath.Join(filepath.Dir(filePath), baseFile+"_test.go")
-		testContent, err := getFileContent(repoPath, testFile)
-		if err == nil {
-			context.TestContent = testContent
+	if rule := testRuleFor(filePath); rule != nil && !rule.isTest(filePath) {
+		for _, testFile := range rule.testFiles(filePath) {
+			if testContent, err := fileAt(ctx, repoPath, sourceRef, testFile); err == nil {
+				context.TestPath, context.TestContent = testFile, testContent
+				break
+			}
 		}
 	}
 
 	return context, nil
 }
 
-func gatherAllContext(repoPath string, changedFiles []string) (map[string]FileContext, error) {
+func gatherAllContext(ctx context.Context, repoPath, sourceRef, destRef string, changedFiles []string) (map[string]FileContext, error) {
 	contexts := make(map[string]FileContext)
-	
+
+	// Previous versions are as of where the branches diverged, like the diff
+	baseRef := destRef
+	if base, err := runGitCommand(ctx, repoPath, "git", "merge-base", destRef, sourceRef); err == nil {
+		baseRef = strings.TrimSpace(base)
+	}
 	for _, file := range changedFiles {
-		context, err := getFileContext(repoPath, file)
+		fileContext, err := getFileContext(ctx, repoPath, sourceRef, baseRef, file)
 		if err != nil {
-			log.Printf("Warning: Error getting context for %s: %v", file, err)
+			slog.WarnContext(ctx, "Error getting file context", "file", file, "error", err)
 			continue
 		}
-		contexts[file] = context
+		contexts[file] = fileContext
 	}
 
 	return contexts, nil
 }
 
-func getChangedFiles(repoPath, sourceBranch, destBranch string) ([]string, error) {
-	cmd := exec.Command("git", "diff", "--name-only", fmt.Sprintf("origin/%s...origin/%s", destBranch, sourceBranch))
+func getChangedFiles(repoPath, sourceRef, destRef string) ([]string, error) {
+	cmd := exec.Command("git", "diff", "--name-only", fmt.Sprintf("%s...%s", destRef, sourceRef))
 	cmd.Dir = repoPath
 	output, err := cmd.Output()
 	if err != nil {
@@ -304,7 +280,7 @@ func generatePRDescription(repoPath string, changedFiles []string, diffOutput st
 
 	for _, file := range changedFiles {
 		switch {
-		case strings.Contains(file, "_test."):
+		case isTestFile(file):
 			hasTests = true
 		case strings.Contains(file, "config"):
 			hasConfig = true
@@ -352,14 +328,8 @@ func formatPRDescription(desc PRDescription) string {
 	return builder.String()
 }
 
-func findDefinitionInFile(filePath string, identifier string) (CodeDefinition, error) {
-	content, err := os.ReadFile(filePath)
-	if err != nil {
-		return CodeDefinition{}, err
-	}
-
-	fileContent := string(content)
-	lines := strings.Split(fileContent, "\n")
+func findDefinitionInFile(filePath, content string, identifier string) (CodeDefinition, error) {
+	lines := strings.Split(content, "\n")
 
 	for i, line := range lines {
 		if strings.Contains(line, identifier) {
@@ -406,7 +376,9 @@ func findDefinitionInFile(filePath string, identifier string) (CodeDefinition, e
 	return CodeDefinition{}, fmt.Errorf("definition not found")
 }
 
-func findReferencedDefinitions(repoPath string, diffOutput string) ([]CodeDefinition, error) {
+// findReferencedDefinitions looks the identifiers of diffOutput up in the Go
+// files of sourceRef
+func findReferencedDefinitions(ctx context.Context, repoPath, sourceRef string, diffOutput string) ([]CodeDefinition, error) {
 	var definitions []CodeDefinition
 	seenDefinitions := make(map[string]bool)
 
@@ -416,20 +388,18 @@ func findReferencedDefinitions(repoPath string, diffOutput string) ([]CodeDefini
 	methodRegex := regexp.MustCompile(`func\s+\(\w+\s+\*?(\w+)\)\s+\w+\(`)
 	varRegex := regexp.MustCompile(`var\s+(\w+)\s+\w+`)
 	
-	// Find all .go files in the repository
-	var goFiles []string
-	err := filepath.Walk(repoPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && strings.HasSuffix(path, ".go") {
-			goFiles = append(goFiles, path)
-		}
-		return nil
-	})
+	// Find all .go files in the revision
+	files, err := filesAt(ctx, repoPath, sourceRef)
 	if err != nil {
 		return nil, err
 	}
+	var goFiles []string
+	for _, file := range slices.Sorted(maps.Keys(files)) {
+		if strings.HasSuffix(file, ".go") {
+			goFiles = append(goFiles, file)
+		}
+	}
+	contents := make(map[string]string)
 
 	// Extract identifiers from diff
 	matches := map[string]bool{}
@@ -461,7 +431,14 @@ func findReferencedDefinitions(repoPath string, diffOutput string) ([]CodeDefini
 		}
 
 		for _, file := range goFiles {
-			if def, err := findDefinitionInFile(file, identifier); err == nil {
+			content, ok := contents[file]
+			if !ok {
+				if content, err = fileAt(ctx, repoPath, sourceRef, file); err != nil {
+					continue
+				}
+				contents[file] = content
+			}
+			if def, err := findDefinitionInFile(file, content, identifier); err == nil {
 				definitions = append(definitions, def)
 				seenDefinitions[identifier] = true
 				break
@@ -532,21 +509,20 @@ func formatDefinitions(definitions []CodeDefinition) string {
 	return builder.String()
 }
 
-// detectRepoLanguages analyzes the repository to determine primary languages
-func detectRepoLanguages(repoPath string) ([]LanguageStats, error) {
+// detectRepoLanguages analyzes the files of sourceRef to determine primary languages
+func detectRepoLanguages(ctx context.Context, repoPath, sourceRef string) ([]LanguageStats, error) {
 	languageCounts := make(map[string]int)
 
-	err := filepath.Walk(repoPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			// Skip common non-code directories
-			base := filepath.Base(path)
-			if base == "node_modules" || base == "vendor" || base == ".git" {
-				return filepath.SkipDir
-			}
-			return nil
+	files, err := filesAt(ctx, repoPath, sourceRef)
+	if err != nil {
+		return nil, err
+	}
+	for path := range files {
+		// Skip common non-code directories
+		if slices.ContainsFunc(strings.Split(path, "/"), func(dir string) bool {
+			return dir == "node_modules" || dir == "vendor"
+		}) {
+			continue
 		}
 
 		ext := strings.ToLower(filepath.Ext(path))
@@ -578,11 +554,6 @@ func detectRepoLanguages(repoPath string) ([]LanguageStats, error) {
 		case ".scala":
 			languageCounts["Scala"]++
 		}
-		return nil
-	})
-
-	if err != nil {
-		return nil, err
 	}
 
 	// Convert map to slice and sort by count
@@ -599,13 +570,9 @@ func detectRepoLanguages(repoPath string) ([]LanguageStats, error) {
 	return stats, nil
 }
 
-func generateMetadataChunk(payload PullRequestCreatedPayload, fullRepo, sourceBranch, destBranch string, changedFiles []string, repoPath string) string {
-	// Construct the repository path
-	repoName := strings.ReplaceAll(strings.ReplaceAll(fullRepo, "/", "_"), ".", "_")
-	repoPath = filepath.Join("/Users/abhyuday.tomar/exotel/hackathon/repos", repoName)
-
+func generateMetadataChunk(ctx context.Context, pr *PullRequest, changedFiles []string, repoPath, sourceRef string) string {
 	// Detect repository languages
-	languages, err := detectRepoLanguages(repoPath)
+	languages, err := detectRepoLanguages(ctx, repoPath, sourceRef)
 	languageInfo := "Unable to detect repository languages"
 	if err == nil && len(languages) > 0 {
 		var langStrings []string
@@ -620,10 +587,10 @@ func generateMetadataChunk(payload PullRequestCreatedPayload, fullRepo, sourceBr
 - PR ID: %d
 - Title: %s
 - Repository: %s
-- Repository URL: https://bitbucket.org/%s
+- Repository URL: %s
 - Source Branch: %s
 - Target Branch: %s
-- Created/Updated At: %s
+- Source Commit: %s
 - Repository Languages: %s
 
 ## Reviewers
@@ -632,15 +599,15 @@ func generateMetadataChunk(payload PullRequestCreatedPayload, fullRepo, sourceBr
 ## Files Changed
 Total files changed: %d
 `,
-		payload.PullRequest.ID,
-		payload.PullRequest.Title,
-		fullRepo,
-		fullRepo,
-		sourceBranch,
-		destBranch,
-		time.Now().Format("2006-01-02 15:04:05"),
+		pr.ID,
+		pr.Title,
+		pr.Repository,
+		pr.RepoURL,
+		pr.SourceBranch,
+		pr.DestBranch,
+		pr.SourceCommit,
 		languageInfo,
-		formatReviewers(payload.PullRequest.Reviewers),
+		formatReviewers(pr.Reviewers),
 		len(changedFiles))
 }
 
@@ -671,8 +638,14 @@ func generateFileContentsChunk(contexts map[string]FileContext) string {
 }
 
 func generateReviewInstructionsChunk() string {
-	return `### CHUNK: REVIEW INSTRUCTIONS
-# Code Review Guidelines
+	return "### CHUNK: REVIEW INSTRUCTIONS\n" + reviewInstructions
+}
+
+// reviewInstructions is the body of the REVIEW INSTRUCTIONS chunk. The
+// evaluation harness swaps it out to compare prompt variants.
+var reviewInstructions = defaultReviewInstructions
+
+const defaultReviewInstructions = `# Code Review Guidelines
 
 You are a highly experienced software engineer and professional code reviewer. Your role is to carefully analyze submitted code changes as if you are reviewing them for a critical production system. You take your responsibility seriously — providing detailed, thoughtful, and actionable feedback to ensure the code is correct, maintainable, secure, and high quality. You strive to communicate clearly and constructively, helping the author improve their work effectively.
 
@@ -713,12 +686,16 @@ You are a highly experienced software engineer and professional code reviewer. Y
    - Database schema changes
    - Configuration changes
 
+3. Ticket Alignment
+   - Acceptance criteria from the JIRA CONTEXT chunk that the diff does not meet
+   - Behaviour the ticket asks for that is missing or different
+   - Changes unrelated to the referenced tickets
+
 Please provide specific, actionable feedback for each issue found, including:
 - Issue description
 - Impact assessment
 - Suggested improvements
 - Code examples where applicable`
-}
 
 func generateReviewOutputFormatChunk() string {
 	return `### CHUNK: REVIEW OUTPUT FORMAT
@@ -746,17 +723,21 @@ The code review comments must be provided in the following JSON format:
 3. For general comments:
    - Omit the "inline" object
    - Only include the "content" object
-4. The "raw" field contains the actual review comment text`
+4. The "raw" field contains the actual review comment text
+5. Start the "raw" text with the comment's severity in brackets:
+   - [BLOCKER] must be fixed before merging
+   - [MAJOR] should be fixed in this PR
+   - [MINOR] worth fixing but not essential
+   - [NIT] style or preference`
 }
 
-func getRecentCommits(repoPath, filePath string, numCommits int) ([]CommitInfo, error) {
+// getRecentCommits returns the last numCommits commits of sourceRef touching filePath
+func getRecentCommits(ctx context.Context, repoPath, sourceRef, filePath string, numCommits int) ([]CommitInfo, error) {
 	var commits []CommitInfo
 	
-	cmd := exec.Command("git", "log", "-n", fmt.Sprintf("%d", numCommits), "--pretty=format:%H|%an|%ad|%s", "--date=short", "--", filePath)
-	cmd.Dir = repoPath
-	output, err := cmd.Output()
+	output, err := runGitCommand(ctx, repoPath, "git", "log", "-n", fmt.Sprintf("%d", numCommits), "--pretty=format:%H|%an|%ad|%s", "--date=short", sourceRef, "--", filePath)
 	if err != nil {
-		return commits, err
+		return commits, fmt.Errorf("git log failed: %v\n%s", err, output)
 	}
 
 	lines := strings.Split(string(output), "\n")
@@ -774,7 +755,7 @@ func getRecentCommits(repoPath, filePath string, numCommits int) ([]CommitInfo,
 			}
 			
 			// Get files changed in this commit
-			filesCmd := exec.Command("git", "show", "--name-only", "--pretty=format:", commit.Hash)
+			filesCmd := exec.CommandContext(ctx, "git", "show", "--name-only", "--pretty=format:", commit.Hash)
 			filesCmd.Dir = repoPath
 			if filesOutput, err := filesCmd.Output(); err == nil {
 				commit.FilesChanged = strings.Split(strings.TrimSpace(string(filesOutput)), "\n")
@@ -786,36 +767,32 @@ func getRecentCommits(repoPath, filePath string, numCommits int) ([]CommitInfo,
 	return commits, nil
 }
 
-func getArchitecturalContext(repoPath string) (ArchitecturalContext, error) {
+// getArchitecturalContext analyzes the files of sourceRef
+func getArchitecturalContext(ctx context.Context, repoPath, sourceRef string) (ArchitecturalContext, error) {
 	context := ArchitecturalContext{
 		ImportGraph: make(map[string][]string),
 	}
 	
 	// Find all Go files
-	var goFiles []string
-	err := filepath.Walk(repoPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			switch {
-			case strings.HasSuffix(path, ".go"):
-				goFiles = append(goFiles, path)
-			case strings.HasSuffix(path, ".sql"):
-				context.DatabaseSchemas = append(context.DatabaseSchemas, path)
-			case strings.Contains(path, "config") || strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".json"):
-				context.ConfigFiles = append(context.ConfigFiles, path)
-			}
-		}
-		return nil
-	})
+	files, err := filesAt(ctx, repoPath, sourceRef)
 	if err != nil {
 		return context, err
 	}
+	var goFiles []string
+	for _, path := range slices.Sorted(maps.Keys(files)) {
+		switch {
+		case strings.HasSuffix(path, ".go"):
+			goFiles = append(goFiles, path)
+		case strings.HasSuffix(path, ".sql"):
+			context.DatabaseSchemas = append(context.DatabaseSchemas, path)
+		case strings.Contains(path, "config") || strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".json"):
+			context.ConfigFiles = append(context.ConfigFiles, path)
+		}
+	}
 
 	// Analyze imports and API endpoints
 	for _, file := range goFiles {
-		content, err := os.ReadFile(file)
+		content, err := fileAt(ctx, repoPath, sourceRef, file)
 		if err != nil {
 			continue
 		}
@@ -855,13 +832,13 @@ func getArchitecturalContext(repoPath string) (ArchitecturalContext, error) {
 	return context, nil
 }
 
-func generateCommitHistoryChunk(repoPath string, changedFiles []string) string {
+func generateCommitHistoryChunk(ctx context.Context, repoPath, sourceRef string, changedFiles []string) string {
 	var builder strings.Builder
 	builder.WriteString("### CHUNK: COMMIT HISTORY\n")
 	builder.WriteString("# Recent Changes History\n\n")
 
 	for _, file := range changedFiles {
-		commits, err := getRecentCommits(repoPath, file, 5)
+		commits, err := getRecentCommits(ctx, repoPath, sourceRef, file, 5)
 		if err != nil {
 			continue
 		}
@@ -885,8 +862,8 @@ func generateCommitHistoryChunk(repoPath string, changedFiles []string) string {
 	return builder.String()
 }
 
-func generateArchitecturalChunk(repoPath string) string {
-	context, err := getArchitecturalContext(repoPath)
+func generateArchitecturalChunk(ctx context.Context, repoPath, sourceRef string) string {
+	context, err := getArchitecturalContext(ctx, repoPath, sourceRef)
 	if err != nil {
 		return "Error gathering architectural context"
 	}
@@ -955,76 +932,6 @@ func getSheetIDFromURL(url string) string {
 	return ""
 }
 
-func getTestCasesFromSheet(sheetURL string) (TestCaseContext, error) {
-	ctx := context.Background()
-	testContext := TestCaseContext{
-		SheetURL: sheetURL,
-		SheetID:  getSheetIDFromURL(sheetURL),
-	}
-
-	if testContext.SheetID == "" {
-		return testContext, fmt.Errorf("invalid sheet URL")
-	}
-
-	// Load Google Sheets credentials from environment
-	credentials := os.Getenv("GOOGLE_SHEETS_CREDENTIALS")
-	if credentials == "" {
-		return testContext, fmt.Errorf("GOOGLE_SHEETS_CREDENTIALS environment variable not set")
-	}
-
-	config, err := google.JWTConfigFromJSON([]byte(credentials), sheets.SpreadsheetsReadonlyScope)
-	if err != nil {
-		return testContext, fmt.Errorf("unable to parse credentials: %v", err)
-	}
-
-	client := config.Client(ctx)
-	srv, err := sheets.NewService(ctx, option.WithHTTPClient(client))
-	if err != nil {
-		return testContext, fmt.Errorf("unable to create sheets service: %v", err)
-	}
-
-	// Assuming test cases are in the first sheet
-	resp, err := srv.Spreadsheets.Values.Get(testContext.SheetID, "A2:F").Do()
-	if err != nil {
-		return testContext, fmt.Errorf("unable to retrieve data from sheet: %v", err)
-	}
-
-	if len(resp.Values) == 0 {
-		return testContext, fmt.Errorf("no data found in sheet")
-	}
-
-	// Process test cases
-	for _, row := range resp.Values {
-		if len(row) < 6 {
-			continue
-		}
-
-		testCase := TestCase{
-			ID:          fmt.Sprintf("%v", row[0]),
-			Description: fmt.Sprintf("%v", row[1]),
-			Steps:       strings.Split(fmt.Sprintf("%v", row[2]), "\n"),
-			Expected:    fmt.Sprintf("%v", row[3]),
-			Actual:      fmt.Sprintf("%v", row[4]),
-			Status:      fmt.Sprintf("%v", row[5]),
-		}
-
-		testContext.TestCases = append(testContext.TestCases, testCase)
-
-		// Update statistics
-		testContext.TotalTests++
-		switch strings.ToLower(testCase.Status) {
-		case "pass", "passed":
-			testContext.PassedTests++
-		case "fail", "failed":
-			testContext.FailedTests++
-		default:
-			testContext.PendingTests++
-		}
-	}
-
-	return testContext, nil
-}
-
 func generateTestCaseChunk(testContext TestCaseContext) string {
 	if testContext.TotalTests == 0 {
 		return "### CHUNK: TEST CASES\n# No test cases found\n"
@@ -1062,81 +969,85 @@ func generateTestCaseChunk(testContext TestCaseContext) string {
 		builder.WriteString(fmt.Sprintf("**Status:** %s\n", test.Status))
 	}
 
-	builder.WriteString(fmt.Sprintf("\nTest Cases Sheet: %s\n", testContext.SheetURL))
+	if testContext.SheetURL != "" {
+		builder.WriteString(fmt.Sprintf("\nTest Cases Sheet: %s\n", testContext.SheetURL))
+	} else {
+		builder.WriteString(fmt.Sprintf("\nTest Cases Source: %s\n", testContext.Source))
+	}
 	return builder.String()
 }
 
-func writeDiffToFile(diffOutput, fullRepo, sourceBranch, destBranch string, payload PullRequestCreatedPayload, repoPath string) error {
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
-	outputDir := "./diffs"
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %v", err)
+// buildReviewPrompt assembles the chunked review prompt for the changes
+// between destRef and sourceRef in repoPath. diffOutput is used when the
+// exact merge-base diff cannot be computed. checks, if not nil, are
+// summarised in the TEST CASES and STATIC ANALYSIS chunks.
+func buildReviewPrompt(ctx context.Context, diffOutput string, pr *PullRequest, repoPath, sourceRef, destRef string, checks *Checks) string {
+	ctx, span := tracer.Start(ctx, "build prompt", trace.WithAttributes(prAttributes(pr)...))
+	defer span.End()
+	if checks == nil {
+		checks = &Checks{}
 	}
 
 	// Get exact git diff
-	exactDiff, err := getExactGitDiff(repoPath, sourceBranch, destBranch)
+	_, diffSpan := tracer.Start(ctx, "git diff")
+	exactDiff, err := getExactGitDiff(repoPath, sourceRef, destRef)
+	endSpan(diffSpan, err)
 	if err != nil {
-		log.Printf("Warning: Error getting exact diff: %v", err)
+		slog.WarnContext(ctx, "Error getting exact diff", "error", err)
 		exactDiff = diffOutput
 	}
+	redaction := appConfig.ForRepo(pr).Redaction
+	exactDiff = withholdDenied(exactDiff, redaction.denied)
 
 	// Find related code definitions
-	definitions, err := findReferencedDefinitions(repoPath, exactDiff)
+	_, defSpan := tracer.Start(ctx, "find definitions")
+	definitions, err := findReferencedDefinitions(ctx, repoPath, sourceRef, exactDiff)
+	endSpan(defSpan, err)
 	if err != nil {
-		log.Printf("Warning: Error finding related definitions: %v", err)
+		slog.WarnContext(ctx, "Error finding related definitions", "error", err)
 	}
 
 	// Get changed files
-	changedFiles, err := getChangedFiles(repoPath, sourceBranch, destBranch)
+	changedFiles, err := getChangedFiles(repoPath, sourceRef, destRef)
 	if err != nil {
-		log.Printf("Warning: Error getting changed files: %v", err)
+		slog.WarnContext(ctx, "Error getting changed files", "error", err)
 		changedFiles = []string{}
 	}
 
 	// Generate PR description
 	prDesc := generatePRDescription(repoPath, changedFiles, exactDiff)
 
-	fileContexts, err := gatherAllContext(repoPath, changedFiles)
+	_, contextSpan := tracer.Start(ctx, "gather file contexts")
+	fileContexts, err := gatherAllContext(ctx, repoPath, sourceRef, destRef, slices.DeleteFunc(slices.Clone(changedFiles), redaction.denied))
+	endSpan(contextSpan, err)
 	if err != nil {
-		log.Printf("Warning: Error gathering context: %v", err)
+		slog.WarnContext(ctx, "Error gathering context", "error", err)
 	}
 
-	// Sanitize filename components
-	safeRepo := sanitizeFilename(fullRepo)
-	safeSrcBranch := sanitizeFilename(sourceBranch)
-	safeDestBranch := sanitizeFilename(destBranch)
-
-	filename := filepath.Join(outputDir, fmt.Sprintf("%s_%s_to_%s_%s.txt",
-		safeRepo,
-		safeSrcBranch,
-		safeDestBranch,
-		timestamp))
-
 	// Extract and fetch test cases if available
-	var testCaseChunk string
-	if sheetURL := extractGoogleSheetURL(payload.PullRequest.Title + "\n" + payload.PullRequest.Description); sheetURL != "" {
-		if testContext, err := getTestCasesFromSheet(sheetURL); err == nil {
-			testCaseChunk = generateTestCaseChunk(testContext)
-		} else {
-			log.Printf("Warning: Error fetching test cases: %v", err)
-			testCaseChunk = "### CHUNK: TEST CASES\n# Error fetching test cases\n" + err.Error()
-		}
-	} else {
-		testCaseChunk = "### CHUNK: TEST CASES\n# No test cases sheet found in PR description\n"
-	}
+	testCaseChunk := traceChunk(ctx, "TEST CASES", func() string {
+		return generateTestCasesChunk(ctx, pr, repoPath) + formatTestRun(checks.TestRun)
+	})
 
 	// Generate chunks
 	chunks := []string{
-		generateMetadataChunk(payload, fullRepo, sourceBranch, destBranch, changedFiles, repoPath),
-		generateDescriptionChunk(prDesc),
-		generateArchitecturalChunk(repoPath),
-		generateCommitHistoryChunk(repoPath, changedFiles),
+		traceChunk(ctx, "PR METADATA", func() string { return generateMetadataChunk(ctx, pr, changedFiles, repoPath, sourceRef) }),
+		traceChunk(ctx, "PR DESCRIPTION", func() string { return generateDescriptionChunk(prDesc) }),
+		traceChunk(ctx, "JIRA CONTEXT", func() string { return generateJiraChunk(ctx, pr) }),
+		traceChunk(ctx, "ARCHITECTURAL CONTEXT", func() string { return generateArchitecturalChunk(ctx, repoPath, sourceRef) }),
+		traceChunk(ctx, "COMMIT HISTORY", func() string { return generateCommitHistoryChunk(ctx, repoPath, sourceRef, changedFiles) }),
 		testCaseChunk,
-		generateContextChunk(definitions),
-		generateDiffChunk(exactDiff),
-		generateFileContentsChunk(fileContexts),
-		generateReviewInstructionsChunk(),
-		generateReviewOutputFormatChunk(),
+		traceChunk(ctx, "STATIC ANALYSIS", func() string { return generateStaticAnalysisChunk(checks.Lint) }),
+		traceChunk(ctx, "CODE CONTEXT", func() string { return generateContextChunk(definitions) }),
+		traceChunk(ctx, "GIT DIFF", func() string { return generateDiffChunk(exactDiff) }),
+		traceChunk(ctx, "COMPLETE FILES", func() string { return generateFileContentsChunk(fileContexts) }),
+		traceChunk(ctx, "REVIEW INSTRUCTIONS", generateReviewInstructionsChunk),
+		traceChunk(ctx, "REVIEW OUTPUT FORMAT", generateReviewOutputFormatChunk),
+	}
+
+	for i, chunk := range chunks {
+		chunks[i] = fenceUntrusted(chunk)
+		promptChunkTokens.WithLabelValues(chunkTitle(chunk)).Observe(float64(estimateTokens(chunks[i])))
 	}
 
 	// Update the guide
@@ -1145,32 +1056,24 @@ This file is organized into separate chunks for staged review:
 
 1. PR METADATA - Basic information about the pull request and repository languages
 2. PR DESCRIPTION - Detailed description of changes
-3. ARCHITECTURAL CONTEXT - System architecture and dependencies
-4. COMMIT HISTORY - Recent changes to affected files
-5. TEST CASES - Test cases and execution status
-6. CODE CONTEXT - Related code definitions and dependencies
-7. GIT DIFF - Actual changes made
-8. COMPLETE FILES - Full content of changed files
-9. REVIEW INSTRUCTIONS - Guidelines for code review
-10. REVIEW OUTPUT FORMAT - Expected format for review comments
+3. JIRA CONTEXT - Jira tickets the PR references, with acceptance criteria
+4. ARCHITECTURAL CONTEXT - System architecture and dependencies
+5. COMMIT HISTORY - Recent changes to affected files
+6. TEST CASES - Test cases and execution status
+7. STATIC ANALYSIS - Linter diagnostics on changed lines
+8. CODE CONTEXT - Related code definitions and dependencies
+9. GIT DIFF - Actual changes made
+10. COMPLETE FILES - Full content of changed files
+11. REVIEW INSTRUCTIONS - Guidelines for code review
+12. REVIEW OUTPUT FORMAT - Expected format for review comments
+` + untrustedGuide + `
 
 Each chunk is separated by: ` + chunkSeparator + "\n\n"
 
-	content := guide + strings.Join(chunks, chunkSeparator)
-
-	err = os.WriteFile(filename, []byte(content), 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write diff file: %v", err)
-	}
-
-	log.Printf("AI-ready code review diff written to file: %s", filename)
-	return nil
+	return guide + strings.Join(chunks, chunkSeparator)
 }
 
-func formatReviewers(reviewers []struct {
-	DisplayName string `json:"display_name"`
-	UUID        string `json:"uuid"`
-}) string {
+func formatReviewers(reviewers []Reviewer) string {
 	if len(reviewers) == 0 {
 		return "No reviewers assigned"
 	}
@@ -1206,7 +1109,7 @@ func formatCompleteFileContents(contexts map[string]FileContext) string {
 
 		// Show test file if it exists
 		if ctx.TestContent != "" {
-			builder.WriteString(fmt.Sprintf("\n### Test File: %s\n", path+"_test."+ctx.Language))
+			builder.WriteString(fmt.Sprintf("\n### Test File: %s\n", ctx.TestPath))
 			builder.WriteString("```")
 			if ctx.Language != "" {
 				builder.WriteString(ctx.Language)
@@ -1223,100 +1126,133 @@ func formatCompleteFileContents(contexts map[string]FileContext) string {
 	return builder.String()
 }
 
-func fetchAndDiff(fullRepo, sourceBranch, destBranch string, payload PullRequestCreatedPayload) {
-	username := "codecoolexotel-admin"
-	appPassword := "ATBB4hcbBaG6Y5VypBVYfgm9X7rPCFAD2D09"
+// defaultRepoDir is where repositories are cloned for review unless
+// REPOS_DIR is set
+const defaultRepoDir = "/Users/abhyuday.tomar/exotel/hackathon/repos"
 
-	cloneURL := fmt.Sprintf("https://%s:%s@bitbucket.org/%s.git", username, appPassword, fullRepo)
-
-	baseRepoDir := "/Users/abhyuday.tomar/exotel/hackathon/repos"
-	repoName := strings.ReplaceAll(strings.ReplaceAll(fullRepo, "/", "_"), ".", "_")
-	cloneDir := filepath.Join(baseRepoDir, repoName)
+// repoCloneDir returns the local clone directory for pr's repository
+func repoCloneDir(pr *PullRequest) string {
+	baseRepoDir := os.Getenv("REPOS_DIR")
+	if baseRepoDir == "" {
+		baseRepoDir = defaultRepoDir
+	}
+	repoName := strings.ReplaceAll(strings.ReplaceAll(pr.Repository, "/", "_"), ".", "_")
+	if pr.Provider != "bitbucket" {
+		repoName = pr.Provider + "_" + repoName
+	}
+	return filepath.Join(baseRepoDir, repoName)
+}
 
+// syncClone clones cloneURL into cloneDir, or updates an existing clone, and
+// fetches the given branches. The clone's remote is the URL without its
+// credentials; they are passed to each git command instead.
+func syncClone(ctx context.Context, cloneURL, cloneDir string, branches ...string) error {
+	remote, auth := splitCredentials(cloneURL)
 	// Clone or pull repo
 	if _, err := os.Stat(cloneDir); os.IsNotExist(err) {
-		log.Printf("Cloning repo to: %s", cloneDir)
-		if output, err := runGitCommand("", "git", "clone", cloneURL, cloneDir); err != nil {
-			log.Printf("Clone failed: %v\n%s", err, output)
-			return
+		slog.InfoContext(ctx, "Cloning repository", "dir", cloneDir)
+		if output, err := runAuthenticatedGit(ctx, "", auth, "clone", remote, cloneDir); err != nil {
+			return fmt.Errorf("clone failed: %v\n%s", err, output)
 		}
 	} else {
-		log.Printf("Repo already exists at %s. Pulling latest changes...", cloneDir)
-		if output, err := runGitCommand(cloneDir, "git", "pull"); err != nil {
-			log.Printf("Git pull failed: %v\n%s", err, output)
-			return
+		slog.InfoContext(ctx, "Pulling latest changes", "dir", cloneDir)
+		// Clones made before credentials were kept out of the remote URL
+		// still have them in .git/config
+		if output, err := runGitCommand(ctx, cloneDir, "git", "remote", "set-url", "origin", remote); err != nil {
+			return fmt.Errorf("git remote set-url failed: %v\n%s", err, output)
 		}
-	}
-
-	// Fetch both branches
-	for _, branch := range []string{sourceBranch, destBranch} {
-		if output, err := runGitCommand(cloneDir, "git", "fetch", "origin", branch); err != nil {
-			log.Printf("Failed to fetch branch %s: %v\n%s", branch, err, output)
-			return
+		if output, err := runAuthenticatedGit(ctx, cloneDir, auth, "pull"); err != nil {
+			return fmt.Errorf("git pull failed: %v\n%s", err, output)
 		}
 	}
 
-	// Diff
-	log.Printf("Getting diff between '%s' and '%s'...", destBranch, sourceBranch)
-	diffOutput, err := runGitCommand(cloneDir, "git", "diff", fmt.Sprintf("origin/%s", destBranch), fmt.Sprintf("origin/%s", sourceBranch))
-	if err != nil {
-		log.Printf("Diff command failed: %v\n%s", err, diffOutput)
-		return
-	}
-
-	if strings.TrimSpace(diffOutput) == "" {
-		log.Println("No differences found between branches.")
-	} else {
-		// Write diff to file with full PR context
-		if err := writeDiffToFile(diffOutput, fullRepo, sourceBranch, destBranch, payload, cloneDir); err != nil {
-			log.Printf("Error writing diff to file: %v", err)
+	// Fetch both branches
+	for _, branch := range branches {
+		if output, err := runAuthenticatedGit(ctx, cloneDir, auth, "fetch", "origin", branch); err != nil {
+			return fmt.Errorf("failed to fetch branch %s: %v\n%s", branch, err, output)
 		}
 	}
+	return nil
 }
 
-func basicAuth(username, password string) string {
-	auth := username + ":" + password
-	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+// splitCredentials separates the user info from an authenticated clone URL.
+// It returns the bare URL and the environment that makes git send the
+// credentials as an Authorization header, which git never writes to disk.
+func splitCredentials(cloneURL string) (remote string, auth []string) {
+	u, err := url.Parse(cloneURL)
+	if err != nil || u.User == nil {
+		return cloneURL, nil
+	}
+	password, _ := u.User.Password()
+	header := "Authorization: " + basicAuth(u.User.Username(), password)
+	u.User = nil
+	return u.String(), []string{"GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0=" + header}
 }
 
-func postComment(comment CommentPayload, payload PullRequestCreatedPayload) error {
-	username := "codecoolexotel-admin"
-	appPassword := "ATBB4hcbBaG6Y5VypBVYfgm9X7rPCFAD2D09"
-
-	url := fmt.Sprintf("https://api.bitbucket.org/2.0/repositories/%s/pullrequests/%d/comments", payload.Repository.FullName, payload.PullRequest.ID)
+// runAuthenticatedGit runs git in dir with auth added to its environment.
+// The environment, unlike the command line, isn't visible to other users.
+func runAuthenticatedGit(ctx context.Context, dir string, auth []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), auth...)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
 
-	log.Printf("url to post comment: %v", url)
+// fetchAndDiff brings the local clone of pr's repository up to date, runs
+// the checks the repository enables, and builds the review prompt for its
+// changes. It returns the unredacted prompt, or "" when the branches do not
+// differ, and the checks' results.
+func fetchAndDiff(ctx context.Context, p Provider, pr *PullRequest) (string, *Checks, error) {
+	sourceBranch, destBranch := pr.SourceBranch, pr.DestBranch
 
-	body, err := json.Marshal(comment)
+	cloneURL, err := p.CloneURL(ctx, pr)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return "", nil, fmt.Errorf("unable to build clone URL: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	cloneDir := repoCloneDir(pr)
+	fetchStart := time.Now()
+	_, fetchSpan := tracer.Start(ctx, "git fetch", trace.WithAttributes(attribute.String("git.dir", cloneDir)))
+	err = syncClone(ctx, cloneURL, cloneDir, sourceBranch, destBranch)
+	endSpan(fetchSpan, err)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return "", nil, err
 	}
+	gitFetchDuration.WithLabelValues(p.Name()).Observe(time.Since(fetchStart).Seconds())
 
-	req.Header.Set("Authorization", basicAuth(username, appPassword))
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
+	// Diff
+	slog.InfoContext(ctx, "Getting diff", "dest_branch", destBranch, "source_branch", sourceBranch)
+	_, diffSpan := tracer.Start(ctx, "git diff")
+	diffOutput, err := runGitCommand(ctx, cloneDir, "git", "diff", fmt.Sprintf("origin/%s", destBranch), fmt.Sprintf("origin/%s", sourceBranch))
+	endSpan(diffSpan, err)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return "", nil, fmt.Errorf("diff command failed: %v\n%s", err, diffOutput)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("Bitbucket API returned status %d", resp.StatusCode)
+	if strings.TrimSpace(diffOutput) == "" {
+		slog.InfoContext(ctx, "No differences found between branches")
+		return "", nil, nil
 	}
 
-	log.Println("Comment posted successfully")
-	return nil
+	recorderFrom(ctx).recordRepo(cloneDir, sourceBranch, destBranch)
+
+	checks := runChecks(ctx, cloneDir, "origin/"+sourceBranch, "origin/"+destBranch, appConfig.ForRepo(pr))
+
+	// The prompt is kept in memory until it is redacted: it can hold
+	// secrets, and only the redacted prompt is written anywhere
+	prompt := buildReviewPrompt(ctx, diffOutput, pr, cloneDir, "origin/"+sourceBranch, "origin/"+destBranch, checks)
+	slog.InfoContext(ctx, "Review prompt built", "bytes", len(prompt))
+	return prompt, checks, nil
+}
+
+func basicAuth(username, password string) string {
+	auth := username + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
 }
 
 // analyzeWithGPT4 sends the PR content to GPT-4 for analysis and returns the response
-func analyzeWithGPT4(prompt string) (string, error) {
+func analyzeWithGPT4(ctx context.Context, prompt string) (Completion, error) {
 	url := fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", endpoint, deployment, apiVersion)
 
 	requestBody := map[string]interface{}{
@@ -1326,52 +1262,52 @@ func analyzeWithGPT4(prompt string) (string, error) {
 				"content": prompt,
 			},
 		},
-		"temperature": 0.7,
-		"max_tokens":  1000,
+		"temperature": temperature,
+		"max_tokens":  maxTokens,
 	}
 
 	jsonBody, err := json.Marshal(requestBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request body: %w", err)
+		return Completion{}, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBody))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return Completion{}, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("api-key", apiKey)
 
-	client := &http.Client{}
+	client := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+		return Completion{}, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
+		return Completion{}, fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	// Log raw response for debugging
-	log.Printf("Raw GPT-4 Response:\n%s\n", string(bodyBytes))
+	// The raw response is only kept at debug level, as an artifact
+	debugPayload(ctx, "model_http_response.json", bodyBytes)
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API error: %s - %s", resp.Status, string(bodyBytes))
+		return Completion{}, fmt.Errorf("API error: %s - %s", resp.Status, truncatePayload(string(bodyBytes)))
 	}
 
 	var response GPTResponse
 	if err := json.Unmarshal(bodyBytes, &response); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+		return Completion{}, fmt.Errorf("failed to decode response: %w", err)
 	}
 
 	if len(response.Choices) == 0 {
-		return "", fmt.Errorf("no response choices returned")
+		return Completion{}, fmt.Errorf("no response choices returned")
 	}
 
-	return response.Choices[0].Message.Content, nil
+	return Completion{Text: response.Choices[0].Message.Content, Usage: response.Usage}, nil
 }
 
 // parseGPT4Response converts GPT-4's response into CommentPayload structs
@@ -1408,10 +1344,7 @@ func parseGPT4Response(response string) ([]CommentPayload, error) {
 	}, nil
 }
 
-func isExoReviewerPresent(reviewers []struct {
-	DisplayName string `json:"display_name"`
-	UUID        string `json:"uuid"`
-}) bool {
+func isExoReviewerPresent(reviewers []Reviewer) bool {
 	for _, reviewer := range reviewers {
 		// Check both display name and UUID since either might be used
 		if reviewer.DisplayName == "ExoReview" || reviewer.UUID == "ExoReview" {
@@ -1421,168 +1354,406 @@ func isExoReviewerPresent(reviewers []struct {
 	return false
 }
 
-// hasJiraLink checks if the PR description contains a Jira ticket link
-func hasJiraLink(description string) bool {
-	// Common Jira ticket patterns
-	patterns := []string{
-		`[A-Z]+-\d+`,            // Basic Jira format like "PROJ-123"
-		`jira\.exotel\.in/browse/[A-Z]+-\d+`, // Full Jira URL
-	}
+// webhookHandler accepts webhook deliveries for a single provider and runs a
+// review for every pull request event the provider does not ignore.
+func webhookHandler(p Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
 
-	for _, pattern := range patterns {
-		re := regexp.MustCompile(pattern)
-		if re.MatchString(description) {
-			return true
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to read webhook body", "provider", p.Name(), "error", err)
+			webhooksReceived.WithLabelValues(p.Name(), "unknown", "error").Inc()
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		// Record the delivery and everything the review does in response
+		var rec *recorder
+		ctx := r.Context()
+		if recordDir := os.Getenv("EXOREVIEWER_RECORD_DIR"); recordDir != "" {
+			rec = newRecorder(p, r, body)
+			ctx = withRecorder(ctx, rec)
+			r = r.WithContext(ctx)
+		}
+
+		event := webhookEvent(r)
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(attribute.String("webhook.provider", p.Name()), attribute.String("webhook.event", event))
+		pr, err := p.ParseWebhook(r, body)
+		if errors.Is(err, ErrIgnoredEvent) {
+			slog.InfoContext(ctx, "Ignored webhook", "provider", p.Name(), "event", event, "reason", err)
+			webhooksReceived.WithLabelValues(p.Name(), webhookEventLabel(event), "ignored").Inc()
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Rejected webhook", "provider", p.Name(), "event", event, "error", err)
+			// The event is only known once the delivery is verified
+			webhooksReceived.WithLabelValues(p.Name(), "unknown", "rejected").Inc()
+			http.Error(w, "Invalid webhook", http.StatusBadRequest)
+			return
 		}
+		webhooksReceived.WithLabelValues(p.Name(), webhookEventLabel(event), "accepted").Inc()
+		span.SetAttributes(prAttributes(pr)...)
+
+		dryRun := appConfig.ForRepo(pr).DryRun || r.URL.Query().Get("dry_run") == "true"
+		job := newJob(pr, dryRun)
+		ctx = withJobLogging(ctx, job)
+		debugPayload(ctx, "webhook.json", body)
+
+		slog.InfoContext(ctx, "Accepted webhook", "event", event, "title", pr.Title, "dry_run", dryRun)
+		w.Header().Set("X-Exoreviewer-Job-Id", job.ID)
+
+		// Reviews take longer than providers wait for a webhook response
+		reviewQueue.enqueue(ctx, p, job, rec)
+		w.WriteHeader(http.StatusAccepted)
 	}
-	return false
 }
 
-// postJiraReminderComment posts a comment reminding to link a Jira ticket
-func postJiraReminderComment(payload PullRequestCreatedPayload) error {
-	// Get the first changed file from the PR
-		comment := CommentPayload{
-			Content: Content{
-				Raw: "⚠️ This PR is not linked to any Jira ticket. Please update the PR description to include a Jira ticket reference for better tracking and documentation.",
-			},
-		}
-		return postComment(comment, payload)
+// reviewPullRequest runs the full review pipeline for the job's PR and posts
+// the resulting comments through p, unless the job is a dry run. The job's
+// progress is recorded in its artifact directory.
+func reviewPullRequest(ctx context.Context, p Provider, job *Job) error {
+	pr := job.PR
+	job.Status = jobRunning
+	if err := saveJob(job); err != nil {
+		slog.WarnContext(ctx, "Error saving job", "error", err)
+	}
+	if err := reviewHistory.saveReview(job); err != nil {
+		slog.WarnContext(ctx, "Error saving review history", "error", err)
 	}
 
-func webhookHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
+	if !job.DryRun {
+		if err := p.SetStatus(ctx, pr, StatusPending, "Review in progress"); err != nil {
+			slog.WarnContext(ctx, "Error setting pending status", "error", err)
+			reportError(ctx, withStage("provider", err), pr)
+		}
 	}
 
-	eventKey := strings.TrimSpace(r.Header.Get("X-Event-Key"))
-	log.Printf("Received X-Event-Key: '%s'", eventKey)
+	err := runReview(ctx, p, job)
+	if err != nil && ctx.Err() != nil {
+		job.Status = "cancelled"
+		job.Error = err.Error()
+		if !job.DryRun {
+			// ctx is done, but the pending status still needs clearing
+			if statusErr := p.SetStatus(context.WithoutCancel(ctx), pr, StatusError, "Review cancelled"); statusErr != nil {
+				slog.WarnContext(ctx, "Error setting error status", "error", statusErr)
+			}
+		}
+	} else if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+		reportError(ctx, err, pr)
+		if !job.DryRun {
+			if statusErr := p.SetStatus(ctx, pr, StatusError, "Review failed"); statusErr != nil {
+				slog.WarnContext(ctx, "Error setting error status", "error", statusErr)
+				reportError(ctx, withStage("provider", statusErr), pr)
+			}
+		}
+	} else {
+		job.Status = "completed"
+	}
+	finished := time.Now()
+	job.FinishedAt = &finished
 
-	if eventKey != "pullrequest:created" && eventKey != "pullrequest:updated" {
-		log.Printf("Ignored event: %s", eventKey)
-		w.WriteHeader(http.StatusOK)
-		return
+	if saveErr := saveJob(job); saveErr != nil {
+		slog.WarnContext(ctx, "Error saving job", "error", saveErr)
 	}
+	if saveErr := reviewHistory.saveReview(job); saveErr != nil {
+		slog.WarnContext(ctx, "Error saving review history", "error", saveErr)
+	}
+	return err
+}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Failed to read body: %v", err)
-		http.Error(w, "Failed to read body", http.StatusBadRequest)
-		return
+func runReview(ctx context.Context, p Provider, job *Job) error {
+	pr := job.PR
+	if policy := appConfig.ForRepo(pr).Jira; policy.Enforce {
+		if err := enforceJiraPolicy(ctx, p, pr, policy, job.DryRun); err != nil {
+			slog.WarnContext(ctx, "Error enforcing Jira policy", "error", err)
+			reportError(ctx, withStage("jira", err), pr)
+		}
 	}
-	defer r.Body.Close()
 
-	var payload PullRequestCreatedPayload
-	err = json.Unmarshal(body, &payload)
+	prompt, checks, err := fetchAndDiff(ctx, p, pr)
 	if err != nil {
-		log.Printf("Invalid JSON: %v", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+		return withStage("git", err)
 	}
-
-	if len(payload.PullRequest.Reviewers) == 0 {
-		log.Printf("PR #%d '%s' has no reviewers. Discarding.", payload.PullRequest.ID, payload.PullRequest.Title)
-		w.WriteHeader(http.StatusOK)
-		return
+	if prompt == "" {
+		if job.DryRun {
+			return nil
+		}
+		return withStage("provider", p.SetStatus(ctx, pr, StatusSuccess, "No changes to review"))
 	}
 
-	// Check if exoReviewer is one of the reviewers
-	if !isExoReviewerPresent(payload.PullRequest.Reviewers) {
-		log.Printf("PR #%d '%s' does not have ExoReview assigned. Skipping review.", 
-			payload.PullRequest.ID, payload.PullRequest.Title)
-		w.WriteHeader(http.StatusOK)
-		return
+	// Only the redacted prompt leaves the service, and only it is kept as
+	// an artifact
+	redactor := newRedactor(appConfig.ForRepo(pr).Redaction, checks.Secrets, promptNames(pr)...)
+	diffContent := []byte(redactor.Redact(ctx, prompt))
+	if err := writeArtifact(job.ID, artifactPrompt, diffContent); err != nil {
+		slog.WarnContext(ctx, "Error writing prompt artifact", "error", err)
 	}
 
-	
-
-
-	log.Printf("Accepted event for PR #%d '%s' with ExoReview assigned", 
-		payload.PullRequest.ID, payload.PullRequest.Title)
+	job.Model = reviewModel.Name()
+	job.PromptHash = fmt.Sprintf("%x", sha256.Sum256(diffContent))
 
-	fetchAndDiff(
-		payload.Repository.FullName,
-		payload.PullRequest.Source.Branch.Name,
-		payload.PullRequest.Destination.Branch.Name,
-		payload,
+	// Analyze the diff content with GPT-4
+	llmCtx, llmSpan := tracer.Start(ctx, "llm completion", trace.WithAttributes(
+		attribute.String("llm.model", job.Model),
+		attribute.Int("llm.prompt_bytes", len(diffContent)),
+	))
+	if job.RerunOf != "" {
+		llmCtx = withoutResponseCache(llmCtx)
+	}
+	start := time.Now()
+	completion, err := reviewModel.Complete(llmCtx, string(diffContent))
+	job.LatencyMS = time.Since(start).Milliseconds()
+	job.Cached = completion.Cached
+	if !completion.Cached {
+		llmLatency.WithLabelValues(job.Model).Observe(time.Since(start).Seconds())
+	}
+	llmSpan.SetAttributes(
+		attribute.Bool("llm.cached", completion.Cached),
+		attribute.Int("llm.prompt_tokens", completion.Usage.PromptTokens),
+		attribute.Int("llm.completion_tokens", completion.Usage.CompletionTokens),
 	)
-
-	// Read the generated diff file
-	repoName := strings.ReplaceAll(strings.ReplaceAll(payload.Repository.FullName, "/", "_"), ".", "_")
-	diffDir := "./diffs"
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
-	diffFile := filepath.Join(diffDir, fmt.Sprintf("%s_%s_to_%s_%s.txt",
-		repoName,
-		strings.ReplaceAll(payload.PullRequest.Source.Branch.Name, "/", "_"),
-		strings.ReplaceAll(payload.PullRequest.Destination.Branch.Name, "/", "_"),
-		timestamp))
-
-	diffContent, err := os.ReadFile(diffFile)
+	endSpan(llmSpan, err)
 	if err != nil {
-		log.Printf("Error reading diff file: %v", err)
-		http.Error(w, "Failed to analyze PR", http.StatusInternalServerError)
-		return
+		llmErrors.WithLabelValues(job.Model).Inc()
+		return withStage("llm", fmt.Errorf("error analyzing PR with %s: %w", reviewModel.Name(), err))
 	}
-
-	// Analyze the diff content with GPT-4
-	analysis, err := analyzeWithGPT4(string(diffContent))
-	if err != nil {
-		log.Printf("Error analyzing PR with GPT-4: %v", err)
-		http.Error(w, "Failed to analyze PR", http.StatusInternalServerError)
-		return
+	// A cached response consumed no tokens this time
+	if !completion.Cached {
+		job.Usage = completion.Usage
+		llmTokens.WithLabelValues(job.Model, "prompt").Add(float64(completion.Usage.PromptTokens))
+		llmTokens.WithLabelValues(job.Model, "completion").Add(float64(completion.Usage.CompletionTokens))
 	}
+	analysis := completion.Text
+	recorderFrom(ctx).recordModelResponse(analysis)
 
-	// Log the complete GPT-4 response
-	log.Printf("GPT-4 Analysis Response:\n%s\n", analysis)
+	slog.InfoContext(ctx, "Model response received",
+		"model", job.Model,
+		"latency_ms", job.LatencyMS,
+		"cached", completion.Cached,
+		"prompt_tokens", completion.Usage.PromptTokens,
+		"completion_tokens", completion.Usage.CompletionTokens,
+		"response", truncatePayload(analysis))
+	if err := writeArtifact(job.ID, artifactResponse, []byte(analysis)); err != nil {
+		slog.WarnContext(ctx, "Error writing response artifact", "error", err)
+	}
 
 	// Parse GPT-4 response into comments
+	_, parseSpan := tracer.Start(ctx, "parse response")
 	comments, err := parseGPT4Response(analysis)
+	parseSpan.SetAttributes(attribute.Int("review.comments", len(comments)))
+	endSpan(parseSpan, err)
 	if err != nil {
-		log.Printf("Error parsing GPT-4 analysis into comments: %v", err)
-		log.Printf("Raw GPT-4 response that failed to parse:\n%s\n", analysis)
-		http.Error(w, "Failed to process GPT-4 analysis", http.StatusInternalServerError)
-		return
+		return withStage("parse", fmt.Errorf("error parsing GPT-4 analysis into comments: %v", err))
 	}
 
-	log.Printf("Successfully parsed %d comments from GPT-4", len(comments))
+	slog.InfoContext(ctx, "Parsed model response", "comments", len(comments))
+	comments = redactor.RestoreComments(comments)
+	changedFiles, _ := getChangedFiles(repoCloneDir(pr), "origin/"+pr.SourceBranch, "origin/"+pr.DestBranch)
+	injection := appConfig.ForRepo(pr).Injection
+	comments = enforceOutputPolicy(ctx, comments, changedFiles, allowedURLHosts(pr, injection))
+	comments = append(comments, injectionComments(findInjections(ctx, pr, string(diffContent), injection.extraPatterns()))...)
+	missingTests, err := checkMissingTests(ctx, repoCloneDir(pr), "origin/"+pr.SourceBranch, "origin/"+pr.DestBranch)
+	if err != nil {
+		slog.WarnContext(ctx, "Error checking for missing tests", "error", err)
+	} else if missingTests != nil {
+		comments = append(comments, *missingTests)
+	}
+	comments = checks.Comments(ctx, comments, changedFiles)
+	for _, comment := range comments {
+		job.Findings = append(job.Findings, newFinding(comment))
+	}
+	if err := writeJSONArtifact(job.ID, artifactComments, comments); err != nil {
+		slog.WarnContext(ctx, "Error writing comments artifact", "error", err)
+	}
+
+	if job.DryRun {
+		slog.InfoContext(ctx, "Dry run: not posting comments", "comments", len(comments))
+		return nil
+	}
 
 	// Track successful and failed comments
 	successCount := 0
 	failedCount := 0
 
-	// Post each comment from GPT-4 analysis
-	for i, comment := range comments {
-		log.Printf("Posting comment %d/%d", i+1, len(comments))
-		log.Printf("Comment content: %s", comment.Content.Raw)
-		if comment.Inline != nil {
-			log.Printf("File: %s, Line: %d", comment.Inline.Path, comment.Inline.To)
+	// Post the comments from GPT-4 analysis
+	submitCtx, submitSpan := tracer.Start(ctx, "submit review", trace.WithAttributes(attribute.Int("review.comments", len(comments))))
+	results := p.SubmitReview(submitCtx, pr, comments)
+	submitSpan.End()
+	job.Findings = job.Findings[:0]
+	for i, result := range results {
+		finding := newFinding(result.Comment)
+		finding.Posted = result.Err == nil
+		finding.CommentID = result.ID
+		if result.Err != nil {
+			finding.Error = result.Err.Error()
 		}
+		job.Findings = append(job.Findings, finding)
 
-		if err := postComment(comment, payload); err != nil {
-			log.Printf("Error posting comment %d: %v", i+1, err)
+		attrs := []any{"comment", i + 1, "path", finding.Path, "line", finding.Line}
+		if result.Err != nil {
+			slog.WarnContext(ctx, "Error posting comment", append(attrs, "error", result.Err)...)
+			reportError(ctx, withStage("provider", result.Err), pr)
 			failedCount++
 			continue
 		}
-		log.Printf("Successfully posted comment %d/%d to PR", i+1, len(comments))
+		slog.DebugContext(ctx, "Posted comment", append(attrs, "body", truncatePayload(finding.Body))...)
 		successCount++
 	}
 
-	// Log final statistics
-	log.Printf("Comment posting complete. Success: %d, Failed: %d, Total: %d", 
-		successCount, failedCount, len(comments))
-
+	level := slog.LevelInfo
 	if failedCount > 0 {
-		log.Printf("Warning: %d comments failed to post", failedCount)
+		level = slog.LevelWarn
+	}
+	slog.Log(ctx, level, "Comment posting complete", "posted", successCount, "failed", failedCount, "total", len(comments))
+	commentsPosted.WithLabelValues(p.Name(), "posted").Add(float64(successCount))
+	commentsPosted.WithLabelValues(p.Name(), "failed").Add(float64(failedCount))
+	job.Posted = successCount
+	job.Failed = failedCount
+
+	if appConfig.ForRepo(pr).Jira.PostResults {
+		if err := postJiraResults(ctx, pr, job); err != nil {
+			slog.WarnContext(ctx, "Error posting review results to Jira", "error", err)
+			reportError(ctx, withStage("jira", err), pr)
+		}
+	}
+
+	state, description := StatusSuccess, fmt.Sprintf("Posted %d of %d review comments", successCount, len(comments))
+	if coverage := checks.TestRun; coverage != nil && coverage.Coverage.BelowMinimum() {
+		state = StatusFailure
+		description = fmt.Sprintf("Diff coverage %.1f%% is below the required %.0f%%", coverage.Coverage.Percent(), coverage.Coverage.Minimum)
 	}
+	return withStage("provider", p.SetStatus(ctx, pr, state, description))
+}
 
-	w.WriteHeader(http.StatusOK)
+// serveProvider routes p's webhooks at path and registers p for re-runs
+func serveProvider(path string, p Provider) {
+	providers[p.Name()] = p
+	http.Handle(path, otelhttp.NewHandler(webhookHandler(p), "webhook "+p.Name()))
 }
 
 func main() {
-	http.HandleFunc("/webhook", webhookHandler)
-	log.Println("Listening on :8080 for Bitbucket PR webhooks...")
-	err := http.ListenAndServe(":8080", nil)
+	// Subcommands are run by people, the server by log collectors
+	logFormat := "json"
+	if len(os.Args) > 1 {
+		logFormat = "text"
+	}
+	if err := setupLogging(logFormat); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "review" {
+		if err := runReviewCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Review failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplayCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		if err := runEvalCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Eval failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		if err := runHistoryCommand(os.Args[2:]); err != nil {
+			log.Fatalf("History failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "artifacts" {
+		if err := runArtifactsCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Artifacts failed: %v", err)
+		}
+		return
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
 	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	if err := setupErrorReporting(); err != nil {
+		log.Fatalf("Failed to set up error reporting: %v", err)
+	}
+
+	if appConfig, err = loadConfig(configPath()); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	if err := setupResponseCache(); err != nil {
+		log.Fatalf("Failed to set up the model response cache: %v", err)
+	}
+
+	if reviewHistory, err = openHistory(historyPath()); err != nil {
+		log.Printf("Review history disabled: %v", err)
+	}
+
+	reviewQueue.start()
+
+	if bb, err := newBitbucketCloudProvider(); err == nil {
+		serveProvider("/webhook", bb)
+	} else {
+		log.Printf("Bitbucket Cloud provider disabled: %v", err)
+	}
+http.HandleFunc("GET /jobs/{id}/artifacts", requireAdmin(artifactsHandler))
+	http.HandleFunc("GET /jobs/{id}/artifacts/{name}", requireAdmin(artifactsHandler))
+	http.HandleFunc("GET /reviews", requireAdmin(reviewsHandler))
+	http.HandleFunc("GET /reviews/{id}", requireAdmin(reviewsHandler))
+	registerDashboard()
+	http.Handle("GET /metrics", promhttp.Handler())
+
+	if gh, err := newGitHubProvider(); err == nil {
+		serveProvider("/webhook/github", gh)
+	} else {
+		log.Printf("GitHub provider disabled: %v", err)
+	}
+
+	if gl, err := newGitLabProvider(); err == nil {
+		serveProvider("/webhook/gitlab", gl)
+	} else {
+		log.Printf("GitLab provider disabled: %v", err)
+	}
+
+	if bbs, err := newBitbucketServerProvider(); err == nil {
+		serveProvider("/webhook/bitbucket-server", bbs)
+	} else {
+		log.Printf("Bitbucket Server provider disabled: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Addr: ":8080", Handler: recoverHandler(http.DefaultServeMux)}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ListenAndServe() }()
+	log.Println("Listening on :8080 for pull request webhooks...")
+
+	select {
+	case err := <-serveErr:
 		log.Fatalf("Server failed: %v", err)
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down the server: %v", err)
+	}
+	// Spans are exported in batches, so the last ones only leave now
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("Error flushing traces: %v", err)
 	}
 }
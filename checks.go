@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Checks holds the results of the deterministic checks run on a PR before
+// the model reviews it. A result is nil when that check didn't run.
+type Checks struct {
+	TestRun *TestRunResult
+	Lint    *LintResult
+	// Secrets are redacted from the prompt and masked in comments
+	Secrets []SecretFinding
+}
+
+// runChecks runs the checks cfg enables on the changes between destRef and
+// sourceRef in repoPath
+func runChecks(ctx context.Context, repoPath, sourceRef, destRef string, cfg RepoConfig) *Checks {
+	checks := &Checks{}
+	secrets, err := scanSecrets(ctx, repoPath, sourceRef, destRef, cfg.Secrets)
+	if err != nil {
+		slog.WarnContext(ctx, "Error scanning for secrets", "error", err)
+	}
+	checks.Secrets = secrets
+	if cfg.TestRun.Enabled {
+		checks.TestRun = runAffectedTests(ctx, repoPath, sourceRef, destRef, cfg.TestRun)
+	}
+	if cfg.StaticAnalysis.Enabled {
+		// Linters share the test runs' sandbox, and so their limits
+		checks.Lint = runStaticAnalysis(ctx, repoPath, sourceRef, destRef, cfg.StaticAnalysis, cfg.TestRun.limits())
+	}
+	return checks
+}
+
+// Comments merges the checks' findings into the model's comments. Model
+// comments on lines a linter flagged are dropped: the prompt lists the
+// diagnostics, so they almost always repeat one. Secrets that made it into
+// any comment, say in a test failure message, are masked.
+func (c *Checks) Comments(ctx context.Context, comments []CommentPayload, changedFiles []string) []CommentPayload {
+	if c == nil {
+		return comments
+	}
+	merged := secretComments(c.Secrets)
+	for _, comment := range comments {
+		if c.Lint.flags(comment.Inline) {
+			slog.DebugContext(ctx, "Dropping model comment on a linted line", "path", comment.Inline.Path, "line", commentLine(comment.Inline))
+			continue
+		}
+		merged = append(merged, comment)
+	}
+	merged = append(merged, c.Lint.Comments()...)
+	merged = append(merged, c.TestRun.Comments(changedFiles)...)
+	for i := range merged {
+		merged[i].Content.Raw = maskSecrets(merged[i].Content.Raw, c.Secrets)
+	}
+	return merged
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// runReviewCommand implements `exoreviewer review`: it reviews the changes
+// between two revisions of a local repository and prints the findings
+// instead of posting them anywhere.
+func runReviewCommand(args []string) error {
+	fs := flag.NewFlagSet("review", flag.ExitOnError)
+	repo := fs.String("repo", ".", "path to the git repository to review")
+	base := fs.String("base", "main", "revision the changes are compared against")
+	head := fs.String("head", "HEAD", "revision containing the changes")
+	format := fs.String("format", "text", "output format: text, json or sarif")
+	output := fs.String("output", "", "write findings to this file instead of stdout")
+	runTests := fs.Bool("tests", false, "run the tests of changed Go packages in a sandbox")
+	coverage := fs.Bool("coverage", false, "with --tests, report the diff coverage of the changes")
+	lint := fs.Bool("lint", false, "run go vet, staticcheck and golangci-lint on changed Go packages")
+	noCache := fs.Bool("no-cache", false, "always call the model instead of reusing a cached response")
+	config := fs.String("config", configPath(), "config file whose settings for the repository apply, as in the service")
+	fs.Parse(args)
+
+	if *format != "text" && *format != "json" && *format != "sarif" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	var err error
+	if appConfig, err = loadConfig(*config); err != nil {
+		return err
+	}
+	if !*noCache {
+		if err := setupResponseCache(); err != nil {
+			return err
+		}
+	}
+
+	repoPath, err := filepath.Abs(*repo)
+	if err != nil {
+		return err
+	}
+	for _, rev := range []string{*base, *head} {
+		if out, err := runGitCommand(context.Background(), repoPath, "git", "rev-parse", "--verify", rev+"^{commit}"); err != nil {
+			return fmt.Errorf("unknown revision %q: %s", rev, strings.TrimSpace(out))
+		}
+	}
+
+	diffOutput, err := getExactGitDiff(repoPath, *head, *base)
+	if err != nil {
+		return fmt.Errorf("diff failed: %v", err)
+	}
+	if strings.TrimSpace(diffOutput) == "" {
+		log.Printf("No differences found between %s and %s.", *base, *head)
+		return nil
+	}
+
+	pr := localPullRequest(context.Background(), repoPath, *base, *head)
+	cfg := appConfig.ForRepo(pr)
+	// The flags override the config's test and lint settings only when given
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "tests":
+			cfg.TestRun.Enabled = *runTests
+		case "coverage":
+			cfg.TestRun.DiffCoverage = *coverage
+		case "lint":
+			cfg.StaticAnalysis.Enabled = *lint
+		}
+	})
+	checks := runChecks(context.Background(), repoPath, *head, *base, cfg)
+	prompt := buildReviewPrompt(context.Background(), diffOutput, pr, repoPath, *head, *base, checks)
+
+	redactor := newRedactor(cfg.Redaction, checks.Secrets, promptNames(pr)...)
+	prompt = redactor.Redact(context.Background(), prompt)
+	completion, err := reviewModel.Complete(context.Background(), prompt)
+	if err != nil {
+		return fmt.Errorf("error analyzing changes with %s: %v", reviewModel.Name(), err)
+	}
+
+	comments, err := parseGPT4Response(completion.Text)
+	if err != nil {
+		return fmt.Errorf("error parsing GPT-4 analysis into comments: %v", err)
+	}
+	comments = redactor.RestoreComments(comments)
+	changedFiles, _ := getChangedFiles(repoPath, *head, *base)
+	comments = enforceOutputPolicy(context.Background(), comments, changedFiles, allowedURLHosts(pr, cfg.Injection))
+	comments = append(comments, injectionComments(findInjections(context.Background(), pr, prompt, cfg.Injection.extraPatterns()))...)
+	missingTests, err := checkMissingTests(context.Background(), repoPath, *head, *base)
+	if err != nil {
+		log.Printf("Error checking for missing tests: %v", err)
+	} else if missingTests != nil {
+		comments = append(comments, *missingTests)
+	}
+	comments = checks.Comments(context.Background(), comments, changedFiles)
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+		color.NoColor = true
+	}
+
+	switch *format {
+	case "json":
+		return writeFindingsJSON(out, comments)
+	case "sarif":
+		return writeFindingsSARIF(out, comments)
+	}
+	writeFindingsText(out, comments)
+	return nil
+}
+
+// runArtifactsCommand implements `exoreviewer artifacts <job-id> [name]`: it
+// lists a job's artifacts, or prints one of them.
+func runArtifactsCommand(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: exoreviewer artifacts <job-id> [name]")
+	}
+
+	if len(args) == 1 {
+		names, err := listArtifacts(args[0])
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	data, err := readArtifact(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// localPullRequest describes the base..head range of a local repository as a
+// pull request so the prompt generators can be reused unchanged.
+func localPullRequest(ctx context.Context, repoPath, base, head string) *PullRequest {
+	gitOutput := func(args ...string) string {
+		out, err := runGitCommand(ctx, repoPath, "git", args...)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(out)
+	}
+
+	return &PullRequest{
+		Provider:     "local",
+		Title:        gitOutput("log", "-1", "--format=%s", head),
+		Description:  gitOutput("log", "--format=%B", base+".."+head),
+		Author:       gitOutput("log", "-1", "--format=%an", head),
+		Repository:   filepath.Base(repoPath),
+		RepoURL:      repoPath,
+		SourceBranch: head,
+		DestBranch:   base,
+		SourceCommit: gitOutput("rev-parse", head),
+		DestCommit:   gitOutput("rev-parse", base),
+	}
+}
+
+// sortComments orders general comments first, then inline comments by file
+// and line.
+func sortComments(comments []CommentPayload) []CommentPayload {
+	sorted := append([]CommentPayload(nil), comments...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Inline, sorted[j].Inline
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return commentLine(a) < commentLine(b)
+	})
+	return sorted
+}
+
+func commentLine(inline *Inline) int {
+	if inline.To > 0 {
+		return inline.To
+	}
+	return inline.From
+}
+
+func writeFindingsText(w io.Writer, comments []CommentPayload) {
+	location := color.New(color.FgCyan, color.Bold)
+	general := color.New(color.FgMagenta, color.Bold)
+	summary := color.New(color.FgYellow)
+
+	if len(comments) == 0 {
+		color.New(color.FgGreen).Fprintln(w, "No findings.")
+		return
+	}
+
+	for _, comment := range sortComments(comments) {
+		if comment.Inline == nil {
+			general.Fprintln(w, "General")
+		} else {
+			location.Fprintf(w, "%s:%d\n", comment.Inline.Path, commentLine(comment.Inline))
+		}
+		for _, line := range strings.Split(strings.TrimSpace(comment.Content.Raw), "\n") {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+		fmt.Fprintln(w)
+	}
+	summary.Fprintf(w, "%d finding(s)\n", len(comments))
+}
+
+func writeFindingsJSON(w io.Writer, comments []CommentPayload) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sortComments(comments))
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool struct {
+		Driver struct {
+			Name           string `json:"name"`
+			InformationURI string `json:"informationUri,omitempty"`
+		} `json:"driver"`
+	} `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region *struct {
+			StartLine int `json:"startLine"`
+		} `json:"region,omitempty"`
+	} `json:"physicalLocation"`
+}
+
+// sarifLevels maps a finding's severity to a SARIF result level. Findings
+// without a severity are warnings.
+var sarifLevels = map[string]string{
+	"blocker": "error",
+	"major":   "error",
+	"minor":   "warning",
+	"nit":     "note",
+}
+
+func writeFindingsSARIF(w io.Writer, comments []CommentPayload) error {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "exoReviewer"
+
+	for _, comment := range sortComments(comments) {
+		level, ok := sarifLevels[Finding{Body: comment.Content.Raw}.Severity()]
+		if !ok {
+			level = "warning"
+		}
+		result := sarifResult{
+			RuleID:  "exoreviewer",
+			Level:   level,
+			Message: sarifMessage{Text: comment.Content.Raw},
+		}
+		if comment.Inline != nil {
+			var loc sarifLocation
+			loc.PhysicalLocation.ArtifactLocation.URI = filepath.ToSlash(comment.Inline.Path)
+			if line := commentLine(comment.Inline); line > 0 {
+				loc.PhysicalLocation.Region = &struct {
+					StartLine int `json:"startLine"`
+				}{StartLine: line}
+			}
+			result.Locations = []sarifLocation{loc}
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	})
+}
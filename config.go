@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// RepoConfig holds the settings that can be tuned per repository
+type RepoConfig struct {
+	// DryRun runs the whole pipeline and records artifacts but posts nothing
+	DryRun bool `json:"dry_run"`
+	// Jira is the Jira linkage policy and results posting
+	Jira JiraPolicy `json:"jira"`
+	// TestCases says where the PR's test cases are read from
+	TestCases TestCaseConfig `json:"test_cases"`
+	// TestRun runs the tests affected by the PR in a sandbox
+	TestRun TestRunConfig `json:"test_run"`
+	// StaticAnalysis lints the lines the PR changes
+	StaticAnalysis StaticAnalysisConfig `json:"static_analysis"`
+	// Secrets tunes the secret scanner, which always runs
+	Secrets SecretsConfig `json:"secrets"`
+	// Redaction keeps sensitive content out of the prompt
+	Redaction RedactionConfig `json:"redaction"`
+	// Injection tunes the prompt-injection defences, which always run
+	Injection InjectionConfig `json:"injection"`
+}
+
+// JiraPolicy decides whether a PR is linked to a Jira ticket well enough
+type JiraPolicy struct {
+	// Enforce checks every reviewed PR against the policy
+	Enforce bool `json:"enforce"`
+	// Projects are the project keys tickets may belong to; empty allows any
+	Projects []string `json:"projects,omitempty"`
+	// RequireIn lists where a ticket key counts: "title", "branch" and/or
+	// "description". Empty accepts any of them.
+	RequireIn []string `json:"require_in,omitempty"`
+	// MustExist requires a referenced ticket to exist in Jira
+	MustExist bool `json:"must_exist"`
+	// RequireOpen requires a referenced ticket not to be done
+	RequireOpen bool `json:"require_open"`
+	// Action is "comment" (the default) to post a reminder comment, or
+	// "request_changes" to also request changes on the PR
+	Action string `json:"action,omitempty"`
+
+	// PostResults comments each referenced ticket with the review's verdict
+	// and links the ticket to the PR. It applies whether or not the policy is
+	// enforced.
+	PostResults bool `json:"post_results"`
+}
+
+// TestCaseConfig selects and configures a TestCaseSource
+type TestCaseConfig struct {
+	// Source is "sheets" (the default), "file", "json", "xray" or "zephyr"
+	Source string `json:"source,omitempty"`
+	// SheetURL is the sheet to read when the PR doesn't link one
+	SheetURL string `json:"sheet_url,omitempty"`
+	// Range is the Sheets range, or the XLSX sheet name, to read
+	Range string `json:"range,omitempty"`
+	// Path is a CSV, XLSX or JSON file in the repository for "file", or a
+	// JSON file on the reviewer's host for "json"
+	Path string `json:"path,omitempty"`
+	// Columns maps test case fields (id, description, steps, expected,
+	// actual, status) to header names; unmapped fields use common headers
+	Columns map[string]string `json:"columns,omitempty"`
+}
+
+func (c TestCaseConfig) validate() error {
+	switch c.Source {
+	case "", "sheets", "file", "json", "xray", "zephyr":
+	default:
+		return fmt.Errorf("test_cases.source: unknown source %q (want sheets, file, json, xray or zephyr)", c.Source)
+	}
+	if (c.Source == "file" || c.Source == "json") && c.Path == "" {
+		return fmt.Errorf("test_cases.path is required for the %s source", c.Source)
+	}
+	for field := range c.Columns {
+		if !slices.ContainsFunc(testCaseFields, func(f testCaseField) bool { return f.name == field }) {
+			return fmt.Errorf("test_cases.columns: unknown field %q", field)
+		}
+	}
+	return nil
+}
+
+// TestRunConfig enables sandboxed test runs and sets their limits, which
+// linters run under too. Zero limits take the defaults.
+type TestRunConfig struct {
+	Enabled        bool `json:"enabled"`
+	TimeoutSeconds int  `json:"timeout_seconds,omitempty"`
+	CPUSeconds     int  `json:"cpu_seconds,omitempty"`
+	MemoryMB       int  `json:"memory_mb,omitempty"`
+	// DiffCoverage measures how much of the added code the tests cover
+	DiffCoverage bool `json:"diff_coverage"`
+	// MinDiffCoverage fails the commit status below this percentage
+	MinDiffCoverage float64 `json:"min_diff_coverage,omitempty"`
+}
+
+func (c TestRunConfig) validate() error {
+	if c.DiffCoverage && !c.Enabled {
+		return fmt.Errorf("test_run.diff_coverage needs test_run.enabled")
+	}
+	if c.MinDiffCoverage < 0 || c.MinDiffCoverage > 100 {
+		return fmt.Errorf("test_run.min_diff_coverage: %v is not a percentage", c.MinDiffCoverage)
+	}
+	return nil
+}
+
+// defaultSandboxLimits bound sandboxed processes unless configured otherwise
+var defaultSandboxLimits = sandboxLimits{Timeout: 5 * time.Minute, CPUSeconds: 600, MemoryMB: 4096}
+
+func (c TestRunConfig) limits() sandboxLimits {
+	limits := defaultSandboxLimits
+	if c.TimeoutSeconds > 0 {
+		limits.Timeout = time.Duration(c.TimeoutSeconds) * time.Second
+	}
+	if c.CPUSeconds > 0 {
+		limits.CPUSeconds = c.CPUSeconds
+	}
+	if c.MemoryMB > 0 {
+		limits.MemoryMB = c.MemoryMB
+	}
+	return limits
+}
+
+// SecretsConfig allowlists values and files the secret scanner would
+// otherwise flag
+type SecretsConfig struct {
+	// Allow holds regular expressions matching values that aren't secrets,
+	// such as test fixtures
+	Allow []string `json:"allow,omitempty"`
+	// AllowPaths holds path.Match patterns of files not to scan; dir/**
+	// matches everything under dir
+	AllowPaths []string `json:"allow_paths,omitempty"`
+}
+
+func (c SecretsConfig) validate() error {
+	for _, pattern := range c.Allow {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("secrets.allow: %v", err)
+		}
+	}
+	for _, pattern := range c.AllowPaths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("secrets.allow_paths: %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// allowPatterns compiles Allow, which validate has checked
+func (c SecretsConfig) allowPatterns() []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, pattern := range c.Allow {
+		patterns = append(patterns, regexp.MustCompile(pattern))
+	}
+	return patterns
+}
+
+// RedactionConfig chooses what is replaced with placeholders in the prompt
+// before it is sent to the model. Secrets are always replaced, and the
+// contents of .env files, keys and keystores always withheld.
+type RedactionConfig struct {
+	// PII names built-in patterns to replace: email and phone
+	PII []string `json:"pii,omitempty"`
+	// Patterns maps placeholder names to regular expressions to replace
+	Patterns map[string]string `json:"patterns,omitempty"`
+	// Deny holds path patterns of more files whose contents are withheld
+	Deny []string `json:"deny,omitempty"`
+	// Authors replaces the names of the PR author, reviewers and commit
+	// authors
+	Authors bool `json:"authors"`
+}
+
+var placeholderName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+func (c RedactionConfig) validate() error {
+	for _, name := range c.PII {
+		if piiPatterns[name] == nil {
+			return fmt.Errorf("redaction.pii: unknown pattern %q (want email or phone)", name)
+		}
+	}
+	for name, pattern := range c.Patterns {
+		if !placeholderName.MatchString(name) || name == "secret" || name == "person" || piiPatterns[name] != nil {
+			return fmt.Errorf("redaction.patterns: %q is not a usable name (lowercase letters, digits and _, not a built-in)", name)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("redaction.patterns.%s: %v", name, err)
+		}
+	}
+	for _, pattern := range c.Deny {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("redaction.deny: %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// InjectionConfig extends the prompt-injection defences
+type InjectionConfig struct {
+	// Patterns are more regular expressions for injection attempts
+	Patterns []string `json:"patterns,omitempty"`
+	// AllowedURLHosts are more hosts review comments may link to
+	AllowedURLHosts []string `json:"allowed_url_hosts,omitempty"`
+}
+
+func (c InjectionConfig) validate() error {
+	for _, pattern := range c.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("injection.patterns: %v", err)
+		}
+	}
+	return nil
+}
+
+// extraPatterns compiles Patterns, which validate has checked
+func (c InjectionConfig) extraPatterns() []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, pattern := range c.Patterns {
+		patterns = append(patterns, regexp.MustCompile(pattern))
+	}
+	return patterns
+}
+
+// StaticAnalysisConfig enables linting the lines a PR changes. Changed Go
+// packages get go vet, plus staticcheck and golangci-lint when installed;
+// Linters adds commands for other languages.
+type StaticAnalysisConfig struct {
+	Enabled bool           `json:"enabled"`
+	Linters []LinterConfig `json:"linters,omitempty"`
+}
+
+// LinterConfig is a command run on the changed files with one of Extensions,
+// which are appended to it as arguments. It must report problems as
+// file:line[:column]: message lines.
+type LinterConfig struct {
+	Name       string   `json:"name"`
+	Command    []string `json:"command"`
+	Extensions []string `json:"extensions"`
+	// Severity of its findings: BLOCKER, MAJOR, MINOR (the default) or NIT
+	Severity string `json:"severity,omitempty"`
+}
+
+func (c StaticAnalysisConfig) validate() error {
+	for i, linter := range c.Linters {
+		switch {
+		case linter.Name == "":
+			return fmt.Errorf("static_analysis.linters[%d]: name is required", i)
+		case len(linter.Command) == 0:
+			return fmt.Errorf("static_analysis.linters[%d] (%s): command is required", i, linter.Name)
+		case len(linter.Extensions) == 0:
+			return fmt.Errorf("static_analysis.linters[%d] (%s): extensions are required", i, linter.Name)
+		}
+		if linter.Severity != "" && !slices.Contains([]string{"BLOCKER", "MAJOR", "MINOR", "NIT"}, linter.Severity) {
+			return fmt.Errorf("static_analysis.linters[%d] (%s): unknown severity %q", i, linter.Name, linter.Severity)
+		}
+	}
+	return nil
+}
+
+// clone copies rc so that decoding overrides into it leaves rc untouched;
+// json.Unmarshal reuses the backing arrays of slices it decodes into.
+func (rc RepoConfig) clone() RepoConfig {
+	rc.Jira.Projects = slices.Clone(rc.Jira.Projects)
+	rc.Jira.RequireIn = slices.Clone(rc.Jira.RequireIn)
+	rc.TestCases.Columns = maps.Clone(rc.TestCases.Columns)
+	rc.Injection.Patterns = slices.Clone(rc.Injection.Patterns)
+	rc.Injection.AllowedURLHosts = slices.Clone(rc.Injection.AllowedURLHosts)
+	rc.Redaction.PII = slices.Clone(rc.Redaction.PII)
+	rc.Redaction.Patterns = maps.Clone(rc.Redaction.Patterns)
+	rc.Redaction.Deny = slices.Clone(rc.Redaction.Deny)
+	rc.Secrets.Allow = slices.Clone(rc.Secrets.Allow)
+	rc.Secrets.AllowPaths = slices.Clone(rc.Secrets.AllowPaths)
+	rc.StaticAnalysis.Linters = slices.Clone(rc.StaticAnalysis.Linters)
+	for i, linter := range rc.StaticAnalysis.Linters {
+		rc.StaticAnalysis.Linters[i].Command = slices.Clone(linter.Command)
+		rc.StaticAnalysis.Linters[i].Extensions = slices.Clone(linter.Extensions)
+	}
+	return rc
+}
+
+func (rc RepoConfig) validate() error {
+	if err := rc.Jira.validate(); err != nil {
+		return err
+	}
+	if err := rc.TestCases.validate(); err != nil {
+		return err
+	}
+	if err := rc.TestRun.validate(); err != nil {
+		return err
+	}
+	if err := rc.StaticAnalysis.validate(); err != nil {
+		return err
+	}
+	if err := rc.Secrets.validate(); err != nil {
+		return err
+	}
+	if err := rc.Redaction.validate(); err != nil {
+		return err
+	}
+	return rc.Injection.validate()
+}
+
+func (p JiraPolicy) validate() error {
+	for _, where := range p.RequireIn {
+		if where != "title" && where != "branch" && where != "description" {
+			return fmt.Errorf("jira.require_in: unknown location %q (want title, branch or description)", where)
+		}
+	}
+	if p.Action != "" && p.Action != "comment" && p.Action != "request_changes" {
+		return fmt.Errorf("jira.action: unknown action %q (want comment or request_changes)", p.Action)
+	}
+	return nil
+}
+
+// Config is the service configuration file. Each repository entry is
+// applied on top of Defaults, so it only needs the fields it overrides.
+type Config struct {
+	Defaults     RepoConfig                 `json:"defaults"`
+	Repositories map[string]json.RawMessage `json:"repositories"`
+}
+
+// appConfig is loaded once at startup by main
+var appConfig Config
+
+// loadConfig reads the JSON config file at path. A missing file yields the
+// zero configuration.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	if err := cfg.Defaults.validate(); err != nil {
+		return cfg, fmt.Errorf("invalid defaults in %s: %v", path, err)
+	}
+	for name, raw := range cfg.Repositories {
+		rc := cfg.Defaults.clone()
+		if err := json.Unmarshal(raw, &rc); err != nil {
+			return cfg, fmt.Errorf("invalid config for repository %s: %v", name, err)
+		}
+		if err := rc.validate(); err != nil {
+			return cfg, fmt.Errorf("invalid config for repository %s: %v", name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// configPath returns the config file location from EXOREVIEWER_CONFIG
+func configPath() string {
+	if path := os.Getenv("EXOREVIEWER_CONFIG"); path != "" {
+		return path
+	}
+	return "exoreviewer.json"
+}
+
+// ForRepo returns the effective settings for pr's repository. Entries may be
+// keyed "provider:repository" or just "repository"; the former wins.
+func (c Config) ForRepo(pr *PullRequest) RepoConfig {
+	rc := c.Defaults.clone()
+	for _, key := range []string{pr.Repository, pr.Provider + ":" + pr.Repository} {
+		if raw, ok := c.Repositories[key]; ok {
+			// Errors were reported by loadConfig
+			json.Unmarshal(raw, &rc)
+		}
+	}
+	return rc
+}
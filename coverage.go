@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxUncoveredFindings caps how many uncovered blocks become findings
+const maxUncoveredFindings = 20
+
+// DiffCoverage is how much of the code a PR adds is covered by tests. Only
+// added lines holding statements count.
+type DiffCoverage struct {
+	Files     []FileCoverage
+	Covered   int
+	Total     int
+	Uncovered []UncoveredBlock
+	// Minimum is the required percentage; zero means none
+	Minimum float64
+}
+
+// FileCoverage is the diff coverage of one file
+type FileCoverage struct {
+	Path    string
+	Covered int
+	Total   int
+}
+
+// UncoveredBlock is a run of added lines no test executes
+type UncoveredBlock struct {
+	Path  string
+	Start int
+	End   int
+}
+
+func percent(covered, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(covered) / float64(total) * 100
+}
+
+// Percent is the overall diff coverage
+func (c *DiffCoverage) Percent() float64 { return percent(c.Covered, c.Total) }
+
+// BelowMinimum reports whether the diff coverage misses the required
+// percentage
+func (c *DiffCoverage) BelowMinimum() bool {
+	return c != nil && c.Minimum > 0 && c.Total > 0 && c.Percent() < c.Minimum
+}
+
+// addedLines maps each file changed between destRef and sourceRef to the
+// line numbers of its added lines in the new version
+func addedLines(ctx context.Context, repoPath, sourceRef, destRef string) (map[string][]int, error) {
+	added, err := addedLineContents(ctx, repoPath, sourceRef, destRef)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[string][]int, len(added))
+	for file, fileLines := range added {
+		for _, line := range fileLines {
+			lines[file] = append(lines[file], line.Number)
+		}
+	}
+	return lines, nil
+}
+
+// addedLineContents maps each file changed between destRef and sourceRef to
+// its added lines
+func addedLineContents(ctx context.Context, repoPath, sourceRef, destRef string) (map[string][]diffLine, error) {
+	hunks, err := diffHunks(ctx, repoPath, sourceRef, destRef)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[string][]diffLine)
+	for _, hunk := range hunks {
+		if hunk.File != "" {
+			lines[hunk.File] = append(lines[hunk.File], hunk.Added...)
+		}
+	}
+	return lines, nil
+}
+
+// parseCoverProfile reads a `go test -coverprofile` profile of module into
+// a map from repository path to line to whether any test executed it. Lines
+// outside every block hold no statements and are absent.
+func parseCoverProfile(profile, module string) map[string]map[int]bool {
+	lines := make(map[string]map[int]bool)
+	for _, line := range strings.Split(profile, "\n") {
+		// example.com/mod/pkg/file.go:12.34,15.2 3 1
+		colon := strings.LastIndex(line, ":")
+		if colon < 0 || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		fields := strings.Fields(line[colon+1:])
+		if len(fields) != 3 {
+			continue
+		}
+		file := strings.TrimPrefix(strings.TrimPrefix(line[:colon], module), "/")
+		var startLine, startCol, endLine, endCol int
+		if _, err := fmt.Sscanf(fields[0], "%d.%d,%d.%d", &startLine, &startCol, &endLine, &endCol); err != nil {
+			continue
+		}
+		count, _ := strconv.Atoi(fields[2])
+		if endLine > startLine && endCol <= 1 {
+			// The block ends before the closing brace of its line
+			endLine--
+		}
+		if lines[file] == nil {
+			lines[file] = make(map[int]bool)
+		}
+		for l := startLine; l <= endLine; l++ {
+			lines[file][l] = lines[file][l] || count > 0
+		}
+	}
+	return lines
+}
+
+// computeDiffCoverage intersects a parsed profile with the added lines
+func computeDiffCoverage(profile map[string]map[int]bool, added map[string][]int, minimum float64) *DiffCoverage {
+	coverage := &DiffCoverage{Minimum: minimum}
+	paths := make([]string, 0, len(added))
+	for p := range added {
+		if strings.HasSuffix(p, ".go") && !strings.HasSuffix(p, "_test.go") && profile[p] != nil {
+			paths = append(paths, p)
+		}
+	}
+	slices.Sort(paths)
+
+	for _, p := range paths {
+		file := FileCoverage{Path: p}
+		var block *UncoveredBlock
+		for _, line := range added[p] {
+			covered, ok := profile[p][line]
+			if !ok {
+				continue
+			}
+			file.Total++
+			if covered {
+				file.Covered++
+				continue
+			}
+			// Extend the block over lines without statements
+			if block != nil && !slices.ContainsFunc(lineRange(block.End+1, line-1), func(l int) bool {
+				_, ok := profile[p][l]
+				return ok
+			}) {
+				block.End = line
+				continue
+			}
+			coverage.Uncovered = append(coverage.Uncovered, UncoveredBlock{Path: p, Start: line, End: line})
+			block = &coverage.Uncovered[len(coverage.Uncovered)-1]
+		}
+		if file.Total > 0 {
+			coverage.Files = append(coverage.Files, file)
+			coverage.Covered += file.Covered
+			coverage.Total += file.Total
+		}
+	}
+	return coverage
+}
+
+func lineRange(from, to int) []int {
+	var lines []int
+	for l := from; l <= to; l++ {
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// Comments returns the diff coverage report and a finding per uncovered
+// block
+func (c *DiffCoverage) Comments() []CommentPayload {
+	if c == nil || c.Total == 0 {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("📊 **Diff coverage: %.1f%%** (%d of %d added statement lines)", c.Percent(), c.Covered, c.Total))
+	if c.BelowMinimum() {
+		b.WriteString(fmt.Sprintf(", below the required %.0f%%", c.Minimum))
+	}
+	b.WriteString("\n\n| File | Covered | Added | Coverage |\n|------|---------|-------|----------|\n")
+	for _, file := range c.Files {
+		b.WriteString(fmt.Sprintf("| `%s` | %d | %d | %.1f%% |\n", file.Path, file.Covered, file.Total, percent(file.Covered, file.Total)))
+	}
+	comments := []CommentPayload{{Content: Content{Raw: b.String()}}}
+
+	for i, block := range c.Uncovered {
+		if i == maxUncoveredFindings {
+			break
+		}
+		text := fmt.Sprintf("[NIT] Line %d is not covered by tests.", block.Start)
+		if block.End > block.Start {
+			text = fmt.Sprintf("[NIT] Lines %d-%d are not covered by tests.", block.Start, block.End)
+		}
+		comments = append(comments, CommentPayload{
+			Content: Content{Raw: text},
+			Inline:  &Inline{Path: block.Path, To: block.Start},
+		})
+	}
+	return comments
+}
+
+// format summarises c for the TEST CASES chunk
+func (c *DiffCoverage) format() string {
+	if c == nil {
+		return ""
+	}
+	if c.Total == 0 {
+		return "\n### Diff Coverage\nThe PR adds no Go statements that the tests could cover.\n"
+	}
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("\n### Diff Coverage\nOverall: %.1f%% (%d of %d added statement lines)\n", c.Percent(), c.Covered, c.Total))
+	for _, file := range c.Files {
+		b.WriteString(fmt.Sprintf("- %s: %.1f%% (%d of %d)\n", file.Path, percent(file.Covered, file.Total), file.Covered, file.Total))
+	}
+	for _, block := range c.Uncovered {
+		b.WriteString(fmt.Sprintf("- Not covered: %s lines %d-%d\n", block.Path, block.Start, block.End))
+	}
+	return b.String()
+}
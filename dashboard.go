@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"html/template"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardPages are parsed once at startup, each together with the layout
+var dashboardPages = parseDashboardPages("jobs", "job", "config", "login")
+
+func parseDashboardPages(names ...string) map[string]*template.Template {
+	funcs := template.FuncMap{
+		"since": func(t time.Time) string { return time.Since(t).Round(time.Second).String() + " ago" },
+		"short": shortCommit,
+	}
+	pages := make(map[string]*template.Template)
+	for _, name := range names {
+		pages[name] = template.Must(template.New("layout.html").Funcs(funcs).
+			ParseFS(dashboardFiles, "dashboard/layout.html", "dashboard/"+name+".html"))
+	}
+	return pages
+}
+
+// registerDashboard routes the admin dashboard under /dashboard/
+func registerDashboard() {
+	static, _ := fs.Sub(dashboardFiles, "dashboard/static")
+	http.Handle("GET /dashboard/static/", http.StripPrefix("/dashboard/static/", http.FileServerFS(static)))
+	http.HandleFunc("GET /dashboard/login", dashboardLogin)
+	http.HandleFunc("POST /dashboard/login", dashboardLogin)
+	http.HandleFunc("POST /dashboard/logout", dashboardLogout)
+	http.HandleFunc("GET /dashboard/{$}", requireDashboardAdmin(dashboardJobs))
+	http.HandleFunc("GET /dashboard/jobs/{id}", requireDashboardAdmin(dashboardJob))
+	http.HandleFunc("POST /dashboard/jobs/{id}/rerun", requireDashboardAdmin(dashboardRerun))
+	http.HandleFunc("POST /dashboard/jobs/{id}/cancel", requireDashboardAdmin(dashboardCancel))
+	http.HandleFunc("GET /dashboard/config", requireDashboardAdmin(dashboardConfig))
+}
+
+// requireDashboardAdmin is requireAdmin for browsers: unauthenticated
+// visitors are sent to the login page instead of getting a 401.
+func requireDashboardAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if os.Getenv("EXOREVIEWER_ADMIN_TOKEN") == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !adminAuthorized(r) {
+			http.Redirect(w, r, "/dashboard/login", http.StatusSeeOther)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func renderDashboard(w http.ResponseWriter, page string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardPages[page].Execute(w, data); err != nil {
+		log.Printf("Error rendering dashboard page %s: %v", page, err)
+	}
+}
+
+func dashboardLogin(w http.ResponseWriter, r *http.Request) {
+	token := os.Getenv("EXOREVIEWER_ADMIN_TOKEN")
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		renderDashboard(w, "login", nil)
+		return
+	}
+
+	given := r.PostFormValue("token")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		renderDashboard(w, "login", map[string]string{"Error": "Invalid admin token"})
+		return
+	}
+	session, err := newAdminSession()
+	if err != nil {
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(adminSessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/dashboard/", http.StatusSeeOther)
+}
+
+func dashboardLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(adminCookie); err == nil {
+		endAdminSession(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: adminCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/dashboard/login", http.StatusSeeOther)
+}
+
+// dashboardJobView is a job as shown on the dashboard. Status reflects the
+// live queue: jobs recorded as queued or running that the queue no longer
+// knows about were interrupted by a restart.
+type dashboardJobView struct {
+	*Job
+	Status    string
+	Queued    bool
+	Running   bool
+	CanRerun  bool
+	Artifacts []string
+}
+
+func newDashboardJobView(job *Job) dashboardJobView {
+	view := dashboardJobView{Job: job, Status: job.Status}
+	switch reviewQueue.state(job.ID) {
+	case jobQueued:
+		view.Status, view.Queued = jobQueued, true
+	case jobRunning:
+		view.Status, view.Running = jobRunning, true
+	default:
+		if job.Status == jobQueued || job.Status == jobRunning {
+			view.Status = "interrupted"
+		}
+	}
+	_, view.CanRerun = providers[job.PR.Provider]
+	return view
+}
+
+// loadJob returns job id from the review history, or from its job.json
+// artifact when history is unavailable.
+func loadJob(id string) (*Job, error) {
+	if reviewHistory != nil {
+		return reviewHistory.review(id)
+	}
+	data, err := readArtifact(id, artifactJob)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// recentJobs returns up to limit jobs, newest first
+func recentJobs(limit int) ([]*Job, error) {
+	if reviewHistory != nil {
+		return reviewHistory.reviews(historyQuery{Limit: limit})
+	}
+
+	entries, err := os.ReadDir(artifactsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Job IDs start with their creation time, so names sort chronologically
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() > entries[j].Name() })
+
+	var jobs []*Job
+	for _, entry := range entries {
+		if len(jobs) == limit {
+			break
+		}
+		if job, err := loadJob(entry.Name()); err == nil && job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func dashboardJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := recentJobs(100)
+	if err != nil {
+		log.Printf("Error listing jobs: %v", err)
+		http.Error(w, "Failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+	views := make([]dashboardJobView, 0, len(jobs))
+	for _, job := range jobs {
+		views = append(views, newDashboardJobView(job))
+	}
+	renderDashboard(w, "jobs", map[string]interface{}{"Jobs": views})
+}
+
+// promptChunk is one "### CHUNK:" section of a review prompt
+type promptChunk struct {
+	Title   string
+	Content string
+}
+
+func splitPromptChunks(prompt string) []promptChunk {
+	var chunks []promptChunk
+	for i, part := range strings.Split(prompt, chunkSeparator) {
+		title := "GUIDE"
+		if i > 0 {
+			title = chunkTitle(part)
+		}
+		chunks = append(chunks, promptChunk{Title: title, Content: part})
+	}
+	return chunks
+}
+
+// chunkTitle returns the name from a chunk's "### CHUNK: NAME" header line
+func chunkTitle(chunk string) string {
+	firstLine := strings.SplitN(strings.TrimSpace(chunk), "\n", 2)[0]
+	return strings.TrimPrefix(firstLine, "### CHUNK: ")
+}
+
+func dashboardJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, err := loadJob(id)
+	if err != nil {
+		log.Printf("Error loading job %s: %v", id, err)
+		http.Error(w, "Failed to load job", http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	view := newDashboardJobView(job)
+	view.Artifacts, _ = listArtifacts(id)
+
+	data := map[string]interface{}{"Job": view, "Findings": job.Findings}
+	if prompt, err := readArtifact(id, artifactPrompt); err == nil {
+		data["Chunks"] = splitPromptChunks(string(prompt))
+	}
+	if response, err := readArtifact(id, artifactResponse); err == nil {
+		data["Response"] = string(response)
+	}
+	// Jobs that failed before recording findings may still have parsed comments
+	if len(job.Findings) == 0 {
+		if raw, err := readArtifact(id, artifactComments); err == nil {
+			var comments []CommentPayload
+			if json.Unmarshal(raw, &comments) == nil {
+				var findings []Finding
+				for _, comment := range comments {
+					findings = append(findings, newFinding(comment))
+				}
+				data["Findings"] = findings
+			}
+		}
+	}
+	renderDashboard(w, "job", data)
+}
+
+// dashboardRerun queues a fresh job for the same pull request through the
+// provider that accepted the original one. The re-run asks the model again
+// rather than reusing a cached response.
+func dashboardRerun(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, err := loadJob(id)
+	if err != nil || job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	p, ok := providers[job.PR.Provider]
+	if !ok {
+		http.Error(w, "Provider "+job.PR.Provider+" is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	pr := *job.PR
+	rerun := newJob(&pr, job.DryRun)
+	rerun.RerunOf = id
+	ctx := withJobLogging(r.Context(), rerun)
+	slog.InfoContext(ctx, "Re-running job", "original_job_id", id)
+	reviewQueue.enqueue(ctx, p, rerun, nil)
+	http.Redirect(w, r, "/dashboard/jobs/"+rerun.ID, http.StatusSeeOther)
+}
+
+func dashboardCancel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := reviewQueue.cancel(id); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Redirect(w, r, "/dashboard/jobs/"+id, http.StatusSeeOther)
+}
+
+// dashboardRepoConfig is one repository entry of the config file with the
+// settings it resolves to
+type dashboardRepoConfig struct {
+	Key       string
+	Override  string
+	Effective RepoConfig
+}
+
+func dashboardConfig(w http.ResponseWriter, r *http.Request) {
+	var repos []dashboardRepoConfig
+	for key, raw := range appConfig.Repositories {
+		pr := &PullRequest{Repository: key}
+		if provider, repo, ok := strings.Cut(key, ":"); ok {
+			pr.Provider, pr.Repository = provider, repo
+		}
+		repos = append(repos, dashboardRepoConfig{
+			Key:       key,
+			Override:  string(raw),
+			Effective: appConfig.ForRepo(pr),
+		})
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Key < repos[j].Key })
+
+	var enabled []string
+	for name := range providers {
+		enabled = append(enabled, name)
+	}
+	sort.Strings(enabled)
+
+	renderDashboard(w, "config", map[string]interface{}{
+		"Path":         configPath(),
+		"Defaults":     appConfig.Defaults,
+		"Repositories": repos,
+		"Providers":    enabled,
+	})
+}
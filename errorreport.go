@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go"
+	bugsnagerrors "github.com/bugsnag/bugsnag-go/errors"
+)
+
+// ErrorReport is an unexpected error or recovered panic. Stage names the part
+// of the pipeline that failed (git, llm, parse, provider or panic) and is what
+// reports are grouped by.
+type ErrorReport struct {
+	Stage    string            `json:"stage"`
+	Error    string            `json:"error"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Stack    string            `json:"stack,omitempty"`
+	err      error
+}
+
+// ErrorReporter sends error reports to an error tracker
+type ErrorReporter interface {
+	Report(ctx context.Context, report ErrorReport)
+}
+
+// errorReporter receives every report. It discards them until
+// setupErrorReporting installs a real reporter.
+var errorReporter ErrorReporter = noopReporter{}
+
+// setupErrorReporting reports to Bugsnag when BUGSNAG_API_KEY is set, or
+// appends reports as JSON lines to EXOREVIEWER_ERROR_FILE when that is set.
+func setupErrorReporting() error {
+	if apiKey := os.Getenv("BUGSNAG_API_KEY"); apiKey != "" {
+		stage := os.Getenv("BUGSNAG_RELEASE_STAGE")
+		if stage == "" {
+			stage = "production"
+		}
+		errorReporter = bugsnagReporter{bugsnag.New(bugsnag.Configuration{
+			APIKey:          apiKey,
+			ReleaseStage:    stage,
+			ProjectPackages: []string{"main"},
+		})}
+		slog.Info("Reporting errors to Bugsnag", "release_stage", stage)
+		return nil
+	}
+	if path := os.Getenv("EXOREVIEWER_ERROR_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open error file: %v", err)
+		}
+		errorReporter = &fileReporter{f: f}
+		slog.Info("Writing error reports", "file", path)
+	}
+	return nil
+}
+
+type noopReporter struct{}
+
+func (noopReporter) Report(context.Context, ErrorReport) {}
+
+// fileReporter appends reports to a file as JSON lines
+type fileReporter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (r *fileReporter) Report(ctx context.Context, report ErrorReport) {
+	line, err := json.Marshal(struct {
+		Time time.Time `json:"time"`
+		ErrorReport
+	}{time.Now(), report})
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.f.Write(append(line, '\n')); err != nil {
+		slog.WarnContext(ctx, "Error writing error report", "error", err)
+	}
+}
+
+type bugsnagReporter struct {
+	notifier *bugsnag.Notifier
+}
+
+func (r bugsnagReporter) Report(ctx context.Context, report ErrorReport) {
+	metadata := bugsnag.MetaData{}
+	for key, value := range report.Metadata {
+		metadata.Add("review", key, value)
+	}
+	err := r.notifier.Notify(report.err,
+		bugsnag.Context{String: report.Stage},
+		bugsnag.ErrorClass{Name: report.Stage},
+		metadata,
+		func(event *bugsnag.Event) { event.GroupingHash = report.Stage },
+	)
+	if err != nil {
+		slog.WarnContext(ctx, "Error notifying Bugsnag", "error", err)
+	}
+}
+
+// stageError tags an error with the pipeline stage it came from
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+func (e *stageError) Unwrap() error { return e.err }
+
+// withStage tags err with stage for error reporting; nil stays nil
+func withStage(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stageError{stage: stage, err: err}
+}
+
+// errorStage returns the stage err was tagged with, or "review"
+func errorStage(err error) string {
+	var se *stageError
+	if errors.As(err, &se) {
+		return se.stage
+	}
+	return "review"
+}
+
+// reportError reports err from the review of pr, if any
+func reportError(ctx context.Context, err error, pr *PullRequest) {
+	report := ErrorReport{
+		Stage:    errorStage(err),
+		Error:    err.Error(),
+		Metadata: errorMetadata(ctx, pr),
+		err:      err,
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		report.Metadata["api.service"] = apiErr.Service
+		report.Metadata["api.method"] = apiErr.Method
+		report.Metadata["api.url"] = apiErr.URL
+		report.Metadata["api.status_code"] = strconv.Itoa(apiErr.StatusCode)
+	}
+	errorReporter.Report(ctx, report)
+}
+
+// reportPanic reports a value recovered from a panic, with the stack of the
+// goroutine that panicked. It must be called from the deferred function.
+func reportPanic(ctx context.Context, recovered interface{}, pr *PullRequest) error {
+	// Skip reportPanic, the deferred function and runtime.gopanic so the
+	// stack starts at the panicking frame
+	stacked := bugsnagerrors.New(recovered, 3)
+	err := fmt.Errorf("panic: %w", stacked)
+	slog.ErrorContext(ctx, "Recovered from panic", "error", err)
+	errorReporter.Report(ctx, ErrorReport{
+		Stage:    "panic",
+		Error:    err.Error(),
+		Metadata: errorMetadata(ctx, pr),
+		Stack:    string(stacked.Stack()),
+		err:      stacked,
+	})
+	return err
+}
+
+func errorMetadata(ctx context.Context, pr *PullRequest) map[string]string {
+	metadata := make(map[string]string)
+	if jobID, ok := ctx.Value(logJobKey{}).(string); ok {
+		metadata["job_id"] = jobID
+	}
+	if pr != nil {
+		metadata["provider"] = pr.Provider
+		metadata["repository"] = pr.Repository
+		metadata["pr_id"] = strconv.Itoa(pr.ID)
+		metadata["source_branch"] = pr.SourceBranch
+		metadata["dest_branch"] = pr.DestBranch
+		metadata["source_commit"] = pr.SourceCommit
+	}
+	return metadata
+}
+
+// recoverHandler turns a panic in next into a reported error and a 500
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				reportPanic(r.Context(), v, nil)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files making up a benchmark case directory
+const (
+	evalCaseFile = "case.json"
+	evalRepo     = "repo.bundle"
+	evalStub     = "stub_response.txt"
+)
+
+// evalCase is a pull request with known, labelled defects. Its repository is
+// a git bundle holding the base and head branches.
+type evalCase struct {
+	Name        string       `json:"-"`
+	Dir         string       `json:"-"`
+	Title       string       `json:"title"`
+	Description string       `json:"description"`
+	Base        string       `json:"base"`
+	Head        string       `json:"head"`
+	Defects     []evalDefect `json:"defects"`
+}
+
+// evalDefect labels the lines of a seeded bug. A finding on Path within
+// StartLine..EndLine (plus the line tolerance) counts as catching it.
+type evalDefect struct {
+	Path        string `json:"path"`
+	StartLine   int    `json:"start_line"`
+	EndLine     int    `json:"end_line"`
+	Description string `json:"description"`
+}
+
+// evalVariant is one prompt/model combination to benchmark. Instructions is
+// a file replacing the body of the REVIEW INSTRUCTIONS chunk; empty keeps the
+// default instructions.
+type evalVariant struct {
+	Name         string `json:"name"`
+	Model        string `json:"model"`
+	Instructions string `json:"instructions,omitempty"`
+}
+
+type evalCaseResult struct {
+	Case           string   `json:"case"`
+	Defects        int      `json:"defects"`
+	Findings       int      `json:"findings"`
+	General        int      `json:"general"`
+	TruePositives  int      `json:"true_positives"`
+	FalsePositives int      `json:"false_positives"`
+	Missed         []string `json:"missed,omitempty"`
+	LatencyMS      int64    `json:"latency_ms"`
+	Error          string   `json:"error,omitempty"`
+}
+
+type evalVariantResult struct {
+	Variant        string           `json:"variant"`
+	Model          string           `json:"model"`
+	Defects        int              `json:"defects"`
+	TruePositives  int              `json:"true_positives"`
+	FalsePositives int              `json:"false_positives"`
+	Precision      float64          `json:"precision"`
+	Recall         float64          `json:"recall"`
+	F1             float64          `json:"f1"`
+	Cases          []evalCaseResult `json:"cases"`
+}
+
+// runEvalCommand implements `exoreviewer eval`: it reviews every benchmark
+// case with each variant and reports precision and recall of the findings
+// against the labelled defects.
+func runEvalCommand(args []string) error {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	variantsFile := fs.String("variants", "", "JSON file listing the variants to compare")
+	model := fs.String("model", "stub", "model to use when no variants file is given: stub or azure-openai")
+	tolerance := fs.Int("tolerance", 3, "lines a finding may be off from a labelled defect and still match")
+	format := fs.String("format", "text", "report format: text or json")
+	output := fs.String("output", "", "write the report to this file instead of stdout")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: exoreviewer eval [flags] <benchmark-dir>...")
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	variants := []evalVariant{{Name: "default", Model: *model}}
+	if *variantsFile != "" {
+		data, err := os.ReadFile(*variantsFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &variants); err != nil {
+			return fmt.Errorf("invalid variants file: %v", err)
+		}
+		// Instruction files are relative to the variants file
+		for i := range variants {
+			if variants[i].Instructions != "" && !filepath.IsAbs(variants[i].Instructions) {
+				variants[i].Instructions = filepath.Join(filepath.Dir(*variantsFile), variants[i].Instructions)
+			}
+		}
+	}
+
+	var cases []*evalCase
+	for _, dir := range fs.Args() {
+		found, err := loadEvalCases(dir)
+		if err != nil {
+			return err
+		}
+		cases = append(cases, found...)
+	}
+	if len(cases) == 0 {
+		return fmt.Errorf("no benchmark cases found")
+	}
+
+	workDir, err := os.MkdirTemp("", "exoreviewer-eval")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	repos := make(map[string]string)
+	for _, c := range cases {
+		repoPath := filepath.Join(workDir, c.Name)
+		if output, err := runGitCommand(context.Background(), "", "git", "clone", "-q", filepath.Join(c.Dir, evalRepo), repoPath); err != nil {
+			return fmt.Errorf("%s: git clone failed: %v\n%s", c.Name, err, output)
+		}
+		repos[c.Name] = repoPath
+	}
+
+	var results []evalVariantResult
+	for _, variant := range variants {
+		result, err := evalRunVariant(variant, cases, repos, *tolerance)
+		if err != nil {
+			return fmt.Errorf("variant %s: %v", variant.Name, err)
+		}
+		results = append(results, result)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	writeEvalReport(out, results)
+	return nil
+}
+
+// loadEvalCases loads dir as a single case if it contains case.json, or
+// otherwise every immediate subdirectory that does.
+func loadEvalCases(dir string) ([]*evalCase, error) {
+	if _, err := os.Stat(filepath.Join(dir, evalCaseFile)); err == nil {
+		c, err := loadEvalCase(dir)
+		if err != nil {
+			return nil, err
+		}
+		return []*evalCase{c}, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var cases []*evalCase
+	for _, entry := range entries {
+		sub := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sub, evalCaseFile)); err != nil {
+			continue
+		}
+		c, err := loadEvalCase(sub)
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+func loadEvalCase(dir string) (*evalCase, error) {
+	data, err := os.ReadFile(filepath.Join(dir, evalCaseFile))
+	if err != nil {
+		return nil, err
+	}
+	c := &evalCase{Name: filepath.Base(dir), Dir: dir}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: invalid %s: %v", dir, evalCaseFile, err)
+	}
+	if c.Base == "" || c.Head == "" {
+		return nil, fmt.Errorf("%s: base and head branches are required", dir)
+	}
+	return c, nil
+}
+
+func evalRunVariant(variant evalVariant, cases []*evalCase, repos map[string]string, tolerance int) (evalVariantResult, error) {
+	result := evalVariantResult{Variant: variant.Name, Model: variant.Model}
+
+	previousInstructions := reviewInstructions
+	defer func() { reviewInstructions = previousInstructions }()
+	if variant.Instructions != "" {
+		data, err := os.ReadFile(variant.Instructions)
+		if err != nil {
+			return result, err
+		}
+		reviewInstructions = string(data)
+	}
+
+	model, err := modelByName(variant.Model)
+	if err != nil {
+		return result, err
+	}
+
+	for _, c := range cases {
+		caseModel := model
+		if _, ok := model.(stubModel); ok {
+			// The stub answers with the case's canned response, if it has one
+			if data, err := os.ReadFile(filepath.Join(c.Dir, evalStub)); err == nil {
+				caseModel = stubModel{response: string(data)}
+			}
+		}
+
+		caseResult := evalRunCase(caseModel, c, repos[c.Name], tolerance)
+		log.Printf("eval %s/%s: %d/%d defects found, %d false positive(s)",
+			variant.Name, c.Name, caseResult.TruePositives, caseResult.Defects, caseResult.FalsePositives)
+
+		result.Cases = append(result.Cases, caseResult)
+		result.Defects += caseResult.Defects
+		result.TruePositives += caseResult.TruePositives
+		result.FalsePositives += caseResult.FalsePositives
+	}
+
+	result.Precision = ratio(result.TruePositives, result.TruePositives+result.FalsePositives)
+	result.Recall = ratio(result.TruePositives, result.Defects)
+	if result.Precision+result.Recall > 0 {
+		result.F1 = 2 * result.Precision * result.Recall / (result.Precision + result.Recall)
+	}
+	return result, nil
+}
+
+func evalRunCase(model Model, c *evalCase, repoPath string, tolerance int) evalCaseResult {
+	result := evalCaseResult{Case: c.Name, Defects: len(c.Defects)}
+	fail := func(err error) evalCaseResult {
+		result.Error = err.Error()
+		for _, defect := range c.Defects {
+			result.Missed = append(result.Missed, defect.String())
+		}
+		return result
+	}
+
+	head, base := "origin/"+c.Head, "origin/"+c.Base
+	diffOutput, err := getExactGitDiff(repoPath, head, base)
+	if err != nil {
+		return fail(fmt.Errorf("diff failed: %v", err))
+	}
+
+	pr := localPullRequest(context.Background(), repoPath, base, head)
+	pr.Repository = c.Name
+	if c.Title != "" {
+		pr.Title = c.Title
+	}
+	if c.Description != "" {
+		pr.Description = c.Description
+	}
+	prompt := buildReviewPrompt(context.Background(), diffOutput, pr, repoPath, head, base, nil)
+
+	start := time.Now()
+	completion, err := model.Complete(context.Background(), newRedactor(RedactionConfig{}, nil).Redact(context.Background(), prompt))
+	result.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		return fail(fmt.Errorf("%s: %v", model.Name(), err))
+	}
+
+	comments, err := parseGPT4Response(completion.Text)
+	if err != nil {
+		return fail(err)
+	}
+	result.Findings = len(comments)
+
+	matched := matchFindings(comments, c.Defects, tolerance)
+	for i, defect := range c.Defects {
+		if matched[i] {
+			result.TruePositives++
+		} else {
+			result.Missed = append(result.Missed, defect.String())
+		}
+	}
+	for _, comment := range comments {
+		if comment.Inline == nil {
+			result.General++
+		}
+	}
+	// General comments can't be located, so they neither catch a defect nor
+	// count against precision
+	result.FalsePositives = result.Findings - result.General - result.TruePositives
+	return result
+}
+
+// matchFindings pairs inline findings with defects one-to-one, in order, and
+// reports which defects were caught. A finding matches a defect on the same
+// path whose line range, widened by tolerance, contains the finding's line.
+func matchFindings(comments []CommentPayload, defects []evalDefect, tolerance int) []bool {
+	matched := make([]bool, len(defects))
+	for _, comment := range comments {
+		if comment.Inline == nil {
+			continue
+		}
+		line := commentLine(comment.Inline)
+		for i, defect := range defects {
+			if matched[i] || path.Clean(filepath.ToSlash(comment.Inline.Path)) != path.Clean(defect.Path) {
+				continue
+			}
+			end := defect.EndLine
+			if end < defect.StartLine {
+				end = defect.StartLine
+			}
+			if line >= defect.StartLine-tolerance && line <= end+tolerance {
+				matched[i] = true
+				break
+			}
+		}
+	}
+	return matched
+}
+
+func (d evalDefect) String() string {
+	if d.EndLine > d.StartLine {
+		return fmt.Sprintf("%s:%d-%d %s", d.Path, d.StartLine, d.EndLine, d.Description)
+	}
+	return fmt.Sprintf("%s:%d %s", d.Path, d.StartLine, d.Description)
+}
+
+func ratio(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
+
+// writeEvalReport prints a comparison table of the variants followed by a
+// per-case breakdown.
+func writeEvalReport(w io.Writer, results []evalVariantResult) {
+	sorted := append([]evalVariantResult(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].F1 > sorted[j].F1 })
+
+	fmt.Fprintf(w, "%-20s %-24s %8s %8s %8s %9s %8s %6s\n", "VARIANT", "MODEL", "DEFECTS", "TP", "FP", "PRECISION", "RECALL", "F1")
+	for _, r := range sorted {
+		fmt.Fprintf(w, "%-20s %-24s %8d %8d %8d %9.2f %8.2f %6.2f\n",
+			r.Variant, r.Model, r.Defects, r.TruePositives, r.FalsePositives, r.Precision, r.Recall, r.F1)
+	}
+
+	for _, r := range results {
+		fmt.Fprintf(w, "\n## %s\n", r.Variant)
+		for _, c := range r.Cases {
+			fmt.Fprintf(w, "%-30s %d/%d found, %d false positive(s), %d general, %dms\n",
+				c.Case, c.TruePositives, c.Defects, c.FalsePositives, c.General, c.LatencyMS)
+			if c.Error != "" {
+				fmt.Fprintf(w, "  error: %s\n", strings.TrimSpace(c.Error))
+			}
+			for _, missed := range c.Missed {
+				fmt.Fprintf(w, "  missed: %s\n", missed)
+			}
+		}
+	}
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const githubAPIURL = "https://api.github.com"
+
+// githubReviewCommand triggers a review when posted as a PR comment
+const githubReviewCommand = "/exoreview"
+
+// githubTrustedAssociations are the commenters allowed to trigger a review:
+// a review costs a model call, so not everyone who can comment may ask
+var githubTrustedAssociations = []string{"OWNER", "MEMBER", "COLLABORATOR"}
+
+type githubPullRequest struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	Draft   bool   `json:"draft"`
+	HTMLURL string `json:"html_url"`
+	User    struct {
+		Login string `json:"login"`
+	} `json:"user"`
+	Head struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	} `json:"base"`
+	RequestedReviewers []struct {
+		Login string `json:"login"`
+	} `json:"requested_reviewers"`
+}
+
+type githubRepository struct {
+	FullName string `json:"full_name"`
+	HTMLURL  string `json:"html_url"`
+}
+
+type githubInstallation struct {
+	ID int64 `json:"id"`
+}
+
+type GitHubPullRequestPayload struct {
+	Action       string             `json:"action"`
+	PullRequest  githubPullRequest  `json:"pull_request"`
+	Repository   githubRepository   `json:"repository"`
+	Installation githubInstallation `json:"installation"`
+}
+
+type GitHubIssueCommentPayload struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number      int `json:"number"`
+		PullRequest *struct {
+			URL string `json:"url"`
+		} `json:"pull_request"`
+	} `json:"issue"`
+	Comment struct {
+		Body              string `json:"body"`
+		AuthorAssociation string `json:"author_association"`
+		User              struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"comment"`
+	Repository   githubRepository   `json:"repository"`
+	Installation githubInstallation `json:"installation"`
+}
+
+// GitHubProvider authenticates as a GitHub App and acts through installation
+// access tokens.
+type GitHubProvider struct {
+	AppID         string
+	PrivateKey    *rsa.PrivateKey
+	WebhookSecret string
+	APIURL        string
+
+	mu     sync.Mutex
+	tokens map[int64]githubToken
+	login  string // The App's bot user, looked up on first use
+}
+
+type githubToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// newGitHubProvider builds a provider from GITHUB_APP_ID,
+// GITHUB_APP_PRIVATE_KEY (or GITHUB_APP_PRIVATE_KEY_PATH) and
+// GITHUB_WEBHOOK_SECRET.
+func newGitHubProvider() (*GitHubProvider, error) {
+	appID := os.Getenv("GITHUB_APP_ID")
+	if appID == "" {
+		return nil, fmt.Errorf("GITHUB_APP_ID environment variable not set")
+	}
+
+	keyPEM := os.Getenv("GITHUB_APP_PRIVATE_KEY")
+	if keyPEM == "" {
+		if path := os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read GitHub App private key: %v", err)
+			}
+			keyPEM = string(data)
+		}
+	}
+	if keyPEM == "" {
+		return nil, fmt.Errorf("GITHUB_APP_PRIVATE_KEY or GITHUB_APP_PRIVATE_KEY_PATH must be set")
+	}
+	key, err := parseRSAPrivateKey([]byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+
+	secret := os.Getenv("GITHUB_WEBHOOK_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("GITHUB_WEBHOOK_SECRET environment variable not set")
+	}
+
+	apiURL := os.Getenv("GITHUB_API_URL")
+	if apiURL == "" {
+		apiURL = githubAPIURL
+	}
+
+	return &GitHubProvider{
+		AppID:         appID,
+		PrivateKey:    key,
+		WebhookSecret: secret,
+		APIURL:        strings.TrimSuffix(apiURL, "/"),
+		tokens:        make(map[int64]githubToken),
+	}, nil
+}
+
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("GitHub App private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse GitHub App private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("GitHub App private key is not an RSA key")
+	}
+	return key, nil
+}
+
+func (g *GitHubProvider) Name() string { return "github" }
+
+func (g *GitHubProvider) ParseWebhook(r *http.Request, body []byte) (*PullRequest, error) {
+	if err := g.verifySignature(r.Header.Get("X-Hub-Signature-256"), body); err != nil {
+		return nil, err
+	}
+
+	event := strings.TrimSpace(r.Header.Get("X-GitHub-Event"))
+	slog.DebugContext(r.Context(), "Received webhook", "header", "X-GitHub-Event", "event", event)
+
+	switch event {
+	case "pull_request":
+		var payload GitHubPullRequestPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		switch payload.Action {
+		case "opened", "reopened", "synchronize", "ready_for_review":
+		default:
+			return nil, fmt.Errorf("%w: pull_request %s", ErrIgnoredEvent, payload.Action)
+		}
+		if payload.PullRequest.Draft {
+			return nil, fmt.Errorf("%w: PR #%d is a draft", ErrIgnoredEvent, payload.PullRequest.Number)
+		}
+		return githubToPullRequest(payload.PullRequest, payload.Repository, payload.Installation.ID), nil
+
+	case "issue_comment":
+		var payload GitHubIssueCommentPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		if payload.Action != "created" || payload.Issue.PullRequest == nil {
+			return nil, fmt.Errorf("%w: issue_comment %s", ErrIgnoredEvent, payload.Action)
+		}
+		if fields := strings.Fields(payload.Comment.Body); len(fields) == 0 || fields[0] != githubReviewCommand {
+			return nil, fmt.Errorf("%w: comment on #%d is not a review command", ErrIgnoredEvent, payload.Issue.Number)
+		}
+		if !slices.Contains(githubTrustedAssociations, payload.Comment.AuthorAssociation) {
+			return nil, fmt.Errorf("%w: %s (%s) may not request reviews on #%d", ErrIgnoredEvent,
+				payload.Comment.User.Login, payload.Comment.AuthorAssociation, payload.Issue.Number)
+		}
+
+		// Comment events carry no branch information, so load the PR itself
+		var ghPR githubPullRequest
+		url := fmt.Sprintf("%s/repos/%s/pulls/%d", g.APIURL, payload.Repository.FullName, payload.Issue.Number)
+		headers, err := g.headers(r.Context(), payload.Installation.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := sendJSON(r.Context(), "GitHub", http.MethodGet, url, headers, nil, &ghPR); err != nil {
+			return nil, fmt.Errorf("failed to load PR #%d: %w", payload.Issue.Number, err)
+		}
+		return githubToPullRequest(ghPR, payload.Repository, payload.Installation.ID), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrIgnoredEvent, event)
+}
+
+func githubToPullRequest(ghPR githubPullRequest, repo githubRepository, installationID int64) *PullRequest {
+	pr := &PullRequest{
+		Provider:       "github",
+		ID:             ghPR.Number,
+		Title:          ghPR.Title,
+		Description:    ghPR.Body,
+		Author:         ghPR.User.Login,
+		Repository:     repo.FullName,
+		RepoURL:        repo.HTMLURL,
+		URL:            ghPR.HTMLURL,
+		SourceBranch:   ghPR.Head.Ref,
+		DestBranch:     ghPR.Base.Ref,
+		SourceCommit:   ghPR.Head.SHA,
+		DestCommit:     ghPR.Base.SHA,
+		InstallationID: installationID,
+	}
+	for _, reviewer := range ghPR.RequestedReviewers {
+		pr.Reviewers = append(pr.Reviewers, Reviewer{DisplayName: reviewer.Login})
+	}
+	return pr
+}
+
+// verifySignature checks the X-Hub-Signature-256 HMAC. Without a secret
+// every delivery is rejected.
+func (g *GitHubProvider) verifySignature(signature string, body []byte) error {
+	if g.WebhookSecret == "" {
+		return fmt.Errorf("no webhook secret configured")
+	}
+	mac := hmac.New(sha256.New, []byte(g.WebhookSecret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("invalid X-Hub-Signature-256")
+	}
+	return nil
+}
+
+// appJWT returns a short-lived RS256 JWT identifying the GitHub App
+func (g *GitHubProvider) appJWT() (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": g.AppID,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, g.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign GitHub App JWT: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// installationToken returns a cached installation access token, minting a
+// new one when the cached token is about to expire.
+func (g *GitHubProvider) installationToken(ctx context.Context, installationID int64) (string, error) {
+	if installationID == 0 {
+		return "", fmt.Errorf("webhook payload has no GitHub App installation")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if tok, ok := g.tokens[installationID]; ok && time.Until(tok.ExpiresAt) > 5*time.Minute {
+		return tok.Token, nil
+	}
+
+	jwt, err := g.appJWT()
+	if err != nil {
+		return "", err
+	}
+
+	var tok githubToken
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", g.APIURL, installationID)
+	headers := map[string]string{
+		"Authorization": "Bearer " + jwt,
+		"Accept":        "application/vnd.github+json",
+	}
+	if err := sendJSON(ctx, "GitHub", http.MethodPost, url, headers, nil, &tok); err != nil {
+		return "", fmt.Errorf("failed to create installation token: %w", err)
+	}
+	g.tokens[installationID] = tok
+	return tok.Token, nil
+}
+
+func (g *GitHubProvider) headers(ctx context.Context, installationID int64) (map[string]string, error) {
+	token, err := g.installationToken(ctx, installationID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"Authorization":        "Bearer " + token,
+		"Accept":               "application/vnd.github+json",
+		"X-GitHub-Api-Version": "2022-11-28",
+	}, nil
+}
+
+func (g *GitHubProvider) CloneURL(ctx context.Context, pr *PullRequest) (string, error) {
+	token, err := g.installationToken(ctx, pr.InstallationID)
+	if err != nil {
+		return "", err
+	}
+	host := "github.com"
+	if u, err := url.Parse(pr.RepoURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	u := url.URL{
+		Scheme: "https",
+		User:   url.UserPassword("x-access-token", token),
+		Host:   host,
+		Path:   "/" + pr.Repository + ".git",
+	}
+	return u.String(), nil
+}
+
+// githubReviewComment is an inline comment as accepted by the pulls APIs
+type githubReviewComment struct {
+	Path     string `json:"path"`
+	Line     int    `json:"line"`
+	Side     string `json:"side"`
+	Body     string `json:"body"`
+	CommitID string `json:"commit_id,omitempty"`
+}
+
+func toGitHubReviewComment(comment CommentPayload) githubReviewComment {
+	rc := githubReviewComment{
+		Path: comment.Inline.Path,
+		Line: comment.Inline.To,
+		Side: "RIGHT",
+		Body: comment.Content.Raw,
+	}
+	if rc.Line == 0 {
+		rc.Line = comment.Inline.From
+		rc.Side = "LEFT"
+	}
+	return rc
+}
+
+func (g *GitHubProvider) PostComment(ctx context.Context, pr *PullRequest, comment CommentPayload) (string, error) {
+	headers, err := g.headers(ctx, pr.InstallationID)
+	if err != nil {
+		return "", err
+	}
+
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if comment.Inline == nil {
+		url := fmt.Sprintf("%s/repos/%s/issues/%d/comments", g.APIURL, pr.Repository, pr.ID)
+		body := map[string]string{"body": comment.Content.Raw}
+		if err := sendJSON(ctx, "GitHub", http.MethodPost, url, headers, body, &created); err != nil {
+			return "", err
+		}
+	} else {
+		url := fmt.Sprintf("%s/repos/%s/pulls/%d/comments", g.APIURL, pr.Repository, pr.ID)
+		body := toGitHubReviewComment(comment)
+		body.CommitID = pr.SourceCommit
+		if err := sendJSON(ctx, "GitHub", http.MethodPost, url, headers, body, &created); err != nil {
+			return "", err
+		}
+	}
+	return strconv.FormatInt(created.ID, 10), nil
+}
+
+// SubmitReview posts all inline comments as a single PR review with the
+// general comments as its body. GitHub rejects the whole review if any
+// comment is outside the diff, so that case falls back to posting one by one.
+func (g *GitHubProvider) SubmitReview(ctx context.Context, pr *PullRequest, comments []CommentPayload) []PostResult {
+	headers, err := g.headers(ctx, pr.InstallationID)
+	if err != nil {
+		results := make([]PostResult, 0, len(comments))
+		for _, comment := range comments {
+			results = append(results, PostResult{Comment: comment, Err: err})
+		}
+		return results
+	}
+
+	var general []string
+	inline := []githubReviewComment{}
+	for _, comment := range comments {
+		if comment.Inline == nil {
+			general = append(general, comment.Content.Raw)
+		} else {
+			inline = append(inline, toGitHubReviewComment(comment))
+		}
+	}
+
+	review := map[string]interface{}{
+		"commit_id": pr.SourceCommit,
+		"event":     "COMMENT",
+		"body":      strings.Join(general, "\n\n---\n\n"),
+		"comments":  inline,
+	}
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	url := fmt.Sprintf("%s/repos/%s/pulls/%d/reviews", g.APIURL, pr.Repository, pr.ID)
+	if err := sendJSON(ctx, "GitHub", http.MethodPost, url, headers, review, &created); err != nil {
+		slog.WarnContext(ctx, "Batched GitHub review failed, posting comments individually", "error", err)
+		return postEach(ctx, g, pr, comments)
+	}
+
+	id := strconv.FormatInt(created.ID, 10)
+	results := make([]PostResult, 0, len(comments))
+	for _, comment := range comments {
+		results = append(results, PostResult{Comment: comment, ID: id})
+	}
+	return results
+}
+
+func (g *GitHubProvider) SetStatus(ctx context.Context, pr *PullRequest, state StatusState, description string) error {
+	if pr.SourceCommit == "" {
+		return fmt.Errorf("no source commit to attach status to")
+	}
+	headers, err := g.headers(ctx, pr.InstallationID)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/repos/%s/statuses/%s", g.APIURL, pr.Repository, pr.SourceCommit)
+	status := map[string]string{
+		"state":       string(state),
+		"context":     statusKey,
+		"description": truncate(description, 140),
+		"target_url":  pr.URL,
+	}
+	return sendJSON(ctx, "GitHub", http.MethodPost, url, headers, status, nil)
+}
+
+func (g *GitHubProvider) ListComments(ctx context.Context, pr *PullRequest) ([]PostedComment, error) {
+	headers, err := g.headers(ctx, pr.InstallationID)
+	if err != nil {
+		return nil, err
+	}
+	login, err := g.botLogin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var comments []PostedComment
+	for page := 1; ; page++ {
+		var issueComments []struct {
+			ID   int64  `json:"id"`
+			Body string `json:"body"`
+			User struct {
+				Login string `json:"login"`
+			} `json:"user"`
+		}
+		url := fmt.Sprintf("%s/repos/%s/issues/%d/comments?per_page=100&page=%d", g.APIURL, pr.Repository, pr.ID, page)
+		if err := sendJSON(ctx, "GitHub", http.MethodGet, url, headers, nil, &issueComments); err != nil {
+			return nil, err
+		}
+		for _, c := range issueComments {
+			comments = append(comments, PostedComment{ID: strconv.FormatInt(c.ID, 10), Text: c.Body, Author: c.User.Login, Mine: c.User.Login == login})
+		}
+		if len(issueComments) < 100 {
+			return comments, nil
+		}
+	}
+}
+
+func (g *GitHubProvider) EditComment(ctx context.Context, pr *PullRequest, id, text string) error {
+	headers, err := g.headers(ctx, pr.InstallationID)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/repos/%s/issues/comments/%s", g.APIURL, pr.Repository, id)
+	return sendJSON(ctx, "GitHub", http.MethodPatch, url, headers, map[string]string{"body": text}, nil)
+}
+
+// RequestChanges submits a "request changes" review with reason as its body.
+// Withdrawing dismisses the App's outstanding change requests.
+func (g *GitHubProvider) RequestChanges(ctx context.Context, pr *PullRequest, requested bool, reason string) error {
+	headers, err := g.headers(ctx, pr.InstallationID)
+	if err != nil {
+		return err
+	}
+	reviewsURL := fmt.Sprintf("%s/repos/%s/pulls/%d/reviews", g.APIURL, pr.Repository, pr.ID)
+	if requested {
+		review := map[string]string{
+			"commit_id": pr.SourceCommit,
+			"event":     "REQUEST_CHANGES",
+			"body":      reason,
+		}
+		return sendJSON(ctx, "GitHub", http.MethodPost, reviewsURL, headers, review, nil)
+	}
+
+	login, err := g.botLogin(ctx)
+	if err != nil {
+		return err
+	}
+	for page := 1; ; page++ {
+		var reviews []struct {
+			ID    int64  `json:"id"`
+			State string `json:"state"`
+			User  struct {
+				Login string `json:"login"`
+			} `json:"user"`
+		}
+		url := fmt.Sprintf("%s?per_page=100&page=%d", reviewsURL, page)
+		if err := sendJSON(ctx, "GitHub", http.MethodGet, url, headers, nil, &reviews); err != nil {
+			return err
+		}
+		for _, review := range reviews {
+			if review.State != "CHANGES_REQUESTED" || review.User.Login != login {
+				continue
+			}
+			url := fmt.Sprintf("%s/%d/dismissals", reviewsURL, review.ID)
+			dismissal := map[string]string{"message": reason, "event": "DISMISS"}
+			if err := sendJSON(ctx, "GitHub", http.MethodPut, url, headers, dismissal, nil); err != nil {
+				return err
+			}
+		}
+		if len(reviews) < 100 {
+			return nil
+		}
+	}
+}
+
+// botLogin returns the login of the App's bot user, "<app-slug>[bot]"
+func (g *GitHubProvider) botLogin(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.login != "" {
+		return g.login, nil
+	}
+
+	jwt, err := g.appJWT()
+	if err != nil {
+		return "", err
+	}
+	var app struct {
+		Slug string `json:"slug"`
+	}
+	headers := map[string]string{
+		"Authorization": "Bearer " + jwt,
+		"Accept":        "application/vnd.github+json",
+	}
+	if err := sendJSON(ctx, "GitHub", http.MethodGet, g.APIURL+"/app", headers, nil, &app); err != nil {
+		return "", fmt.Errorf("failed to look up GitHub App: %w", err)
+	}
+	g.login = app.Slug + "[bot]"
+	return g.login, nil
+}
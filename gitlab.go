@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const gitlabURL = "https://gitlab.com"
+
+type GitLabMergeRequestPayload struct {
+	ObjectKind string `json:"object_kind"`
+	User       struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Project struct {
+		ID                int    `json:"id"`
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		IID          int    `json:"iid"`
+		Title        string `json:"title"`
+		Description  string `json:"description"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		Action       string `json:"action"`
+		OldRev       string `json:"oldrev"`
+		Draft        bool   `json:"draft"`
+		URL          string `json:"url"`
+		LastCommit   struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+	Reviewers []struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"reviewers"`
+}
+
+// GitLabProvider talks to gitlab.com or a self-managed GitLab instance using a
+// personal, project or group access token.
+type GitLabProvider struct {
+	BaseURL       string
+	Token         string
+	WebhookSecret string
+
+	mu     sync.Mutex
+	userID int // The token's user, looked up on first use
+}
+
+// newGitLabProvider builds a provider from GITLAB_TOKEN, GITLAB_WEBHOOK_SECRET
+// and an optional GITLAB_URL.
+func newGitLabProvider() (*GitLabProvider, error) {
+	token := os.Getenv("GITLAB_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("GITLAB_TOKEN environment variable not set")
+	}
+	secret := os.Getenv("GITLAB_WEBHOOK_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("GITLAB_WEBHOOK_SECRET environment variable not set")
+	}
+	baseURL := os.Getenv("GITLAB_URL")
+	if baseURL == "" {
+		baseURL = gitlabURL
+	}
+	return &GitLabProvider{
+		BaseURL:       strings.TrimSuffix(baseURL, "/"),
+		Token:         token,
+		WebhookSecret: secret,
+	}, nil
+}
+
+func (g *GitLabProvider) Name() string { return "gitlab" }
+
+func (g *GitLabProvider) apiURL(format string, args ...interface{}) string {
+	return g.BaseURL + "/api/v4" + fmt.Sprintf(format, args...)
+}
+
+func (g *GitLabProvider) headers() map[string]string {
+	return map[string]string{"PRIVATE-TOKEN": g.Token}
+}
+
+func (g *GitLabProvider) ParseWebhook(r *http.Request, body []byte) (*PullRequest, error) {
+	// Without a secret every delivery is rejected
+	token := r.Header.Get("X-Gitlab-Token")
+	if g.WebhookSecret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(g.WebhookSecret)) != 1 {
+		return nil, fmt.Errorf("invalid X-Gitlab-Token")
+	}
+
+	event := strings.TrimSpace(r.Header.Get("X-Gitlab-Event"))
+	slog.DebugContext(r.Context(), "Received webhook", "header", "X-Gitlab-Event", "event", event)
+	if event != "Merge Request Hook" {
+		return nil, fmt.Errorf("%w: %s", ErrIgnoredEvent, event)
+	}
+
+	var payload GitLabMergeRequestPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	attrs := payload.ObjectAttributes
+	switch {
+	case attrs.Action == "open" || attrs.Action == "reopen":
+	case attrs.Action == "update" && attrs.OldRev != "":
+		// An update with oldrev means new commits were pushed
+	default:
+		return nil, fmt.Errorf("%w: merge request %s", ErrIgnoredEvent, attrs.Action)
+	}
+	if attrs.Draft {
+		return nil, fmt.Errorf("%w: MR !%d is a draft", ErrIgnoredEvent, attrs.IID)
+	}
+
+	pr := &PullRequest{
+		Provider:     "gitlab",
+		ID:           attrs.IID,
+		Title:        attrs.Title,
+		Description:  attrs.Description,
+		Author:       payload.User.Name,
+		Repository:   payload.Project.PathWithNamespace,
+		RepoURL:      payload.Project.WebURL,
+		URL:          attrs.URL,
+		SourceBranch: attrs.SourceBranch,
+		DestBranch:   attrs.TargetBranch,
+		SourceCommit: attrs.LastCommit.ID,
+		ProjectID:    payload.Project.ID,
+	}
+	for _, reviewer := range payload.Reviewers {
+		pr.Reviewers = append(pr.Reviewers, Reviewer{DisplayName: reviewer.Name, UUID: reviewer.Username})
+	}
+	return pr, nil
+}
+
+func (g *GitLabProvider) CloneURL(ctx context.Context, pr *PullRequest) (string, error) {
+	base, err := url.Parse(g.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid GITLAB_URL: %v", err)
+	}
+	u := url.URL{
+		Scheme: base.Scheme,
+		User:   url.UserPassword("oauth2", g.Token),
+		Host:   base.Host,
+		Path:   strings.TrimSuffix(base.Path, "/") + "/" + pr.Repository + ".git",
+	}
+	return u.String(), nil
+}
+
+// ensureDiffRefs loads the MR's base, start and head SHAs, which merge
+// request webhooks do not carry but diff discussions must be positioned with.
+func (g *GitLabProvider) ensureDiffRefs(ctx context.Context, pr *PullRequest) error {
+	if pr.BaseCommit != "" && pr.DestCommit != "" && pr.SourceCommit != "" {
+		return nil
+	}
+	var mr struct {
+		DiffRefs struct {
+			BaseSHA  string `json:"base_sha"`
+			HeadSHA  string `json:"head_sha"`
+			StartSHA string `json:"start_sha"`
+		} `json:"diff_refs"`
+	}
+	url := g.apiURL("/projects/%d/merge_requests/%d", pr.ProjectID, pr.ID)
+	if err := sendJSON(ctx, "GitLab", http.MethodGet, url, g.headers(), nil, &mr); err != nil {
+		return fmt.Errorf("failed to load diff refs: %w", err)
+	}
+	pr.BaseCommit = mr.DiffRefs.BaseSHA
+	pr.DestCommit = mr.DiffRefs.StartSHA
+	pr.SourceCommit = mr.DiffRefs.HeadSHA
+	return nil
+}
+
+func (g *GitLabProvider) PostComment(ctx context.Context, pr *PullRequest, comment CommentPayload) (string, error) {
+	if comment.Inline == nil {
+		return g.postNote(ctx, pr, comment.Content.Raw)
+	}
+
+	if err := g.ensureDiffRefs(ctx, pr); err != nil {
+		return "", err
+	}
+
+	position := map[string]interface{}{
+		"position_type": "text",
+		"base_sha":      pr.BaseCommit,
+		"start_sha":     pr.DestCommit,
+		"head_sha":      pr.SourceCommit,
+		"new_path":      comment.Inline.Path,
+		"old_path":      comment.Inline.Path,
+	}
+	if comment.Inline.To > 0 {
+		position["new_line"] = comment.Inline.To
+	} else {
+		position["old_line"] = comment.Inline.From
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	url := g.apiURL("/projects/%d/merge_requests/%d/discussions", pr.ProjectID, pr.ID)
+	body := map[string]interface{}{
+		"body":     comment.Content.Raw,
+		"position": position,
+	}
+	if err := sendJSON(ctx, "GitLab", http.MethodPost, url, g.headers(), body, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (g *GitLabProvider) postNote(ctx context.Context, pr *PullRequest, text string) (string, error) {
+	var created struct {
+		ID int `json:"id"`
+	}
+	url := g.apiURL("/projects/%d/merge_requests/%d/notes", pr.ProjectID, pr.ID)
+	if err := sendJSON(ctx, "GitLab", http.MethodPost, url, g.headers(), map[string]string{"body": text}, &created); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(created.ID), nil
+}
+
+// SubmitReview posts every inline comment as its own diff discussion and
+// combines the general comments into one overall MR note.
+func (g *GitLabProvider) SubmitReview(ctx context.Context, pr *PullRequest, comments []CommentPayload) []PostResult {
+	results := make([]PostResult, 0, len(comments))
+	var general []CommentPayload
+	for _, comment := range comments {
+		if comment.Inline == nil {
+			general = append(general, comment)
+			continue
+		}
+		id, err := postCommentTraced(ctx, g, pr, comment)
+		results = append(results, PostResult{Comment: comment, ID: id, Err: err})
+	}
+
+	if len(general) == 0 {
+		return results
+	}
+
+	var note strings.Builder
+	note.WriteString("### exoReviewer summary\n\n")
+	for i, comment := range general {
+		if i > 0 {
+			note.WriteString("\n\n---\n\n")
+		}
+		note.WriteString(comment.Content.Raw)
+	}
+	id, err := g.postNote(ctx, pr, note.String())
+	for _, comment := range general {
+		results = append(results, PostResult{Comment: comment, ID: id, Err: err})
+	}
+	return results
+}
+
+func (g *GitLabProvider) SetStatus(ctx context.Context, pr *PullRequest, state StatusState, description string) error {
+	if pr.SourceCommit == "" {
+		return fmt.Errorf("no source commit to attach status to")
+	}
+
+	glState := "running"
+	switch state {
+	case StatusSuccess:
+		glState = "success"
+	case StatusFailure, StatusError:
+		glState = "failed"
+	}
+
+	url := g.apiURL("/projects/%d/statuses/%s", pr.ProjectID, pr.SourceCommit)
+	status := map[string]string{
+		"state":       glState,
+		"name":        statusKey,
+		"ref":         pr.SourceBranch,
+		"description": truncate(description, 255),
+		"target_url":  pr.URL,
+	}
+	return sendJSON(ctx, "GitLab", http.MethodPost, url, g.headers(), status, nil)
+}
+
+// ListComments returns the MR's notes, leaving out system notes and the
+// notes of diff discussions
+func (g *GitLabProvider) ListComments(ctx context.Context, pr *PullRequest) ([]PostedComment, error) {
+	userID, err := g.tokenUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var comments []PostedComment
+	for page := 1; ; page++ {
+		var notes []struct {
+			ID       int              `json:"id"`
+			Body     string           `json:"body"`
+			System   bool             `json:"system"`
+			Position *json.RawMessage `json:"position"`
+			Author   struct {
+				ID       int    `json:"id"`
+				Username string `json:"username"`
+			} `json:"author"`
+		}
+		url := g.apiURL("/projects/%d/merge_requests/%d/notes?per_page=100&page=%d", pr.ProjectID, pr.ID, page)
+		if err := sendJSON(ctx, "GitLab", http.MethodGet, url, g.headers(), nil, &notes); err != nil {
+			return nil, err
+		}
+		for _, note := range notes {
+			if !note.System && note.Position == nil {
+				comments = append(comments, PostedComment{ID: strconv.Itoa(note.ID), Text: note.Body, Author: note.Author.Username, Mine: note.Author.ID == userID})
+			}
+		}
+		if len(notes) < 100 {
+			return comments, nil
+		}
+	}
+}
+
+// tokenUserID returns the ID of the user GITLAB_TOKEN belongs to
+func (g *GitLabProvider) tokenUserID(ctx context.Context) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.userID != 0 {
+		return g.userID, nil
+	}
+	var user struct {
+		ID int `json:"id"`
+	}
+	if err := sendJSON(ctx, "GitLab", http.MethodGet, g.apiURL("/user"), g.headers(), nil, &user); err != nil {
+		return 0, fmt.Errorf("failed to look up GitLab user: %w", err)
+	}
+	g.userID = user.ID
+	return g.userID, nil
+}
+
+func (g *GitLabProvider) EditComment(ctx context.Context, pr *PullRequest, id, text string) error {
+	url := g.apiURL("/projects/%d/merge_requests/%d/notes/%s", pr.ProjectID, pr.ID, id)
+	return sendJSON(ctx, "GitLab", http.MethodPut, url, g.headers(), map[string]string{"body": text}, nil)
+}
+
+// RequestChanges is unsupported: GitLab's API has no review vote that blocks
+// a merge request.
+func (g *GitLabProvider) RequestChanges(ctx context.Context, pr *PullRequest, requested bool, reason string) error {
+	return fmt.Errorf("GitLab merge requests: %w", errors.ErrUnsupported)
+}
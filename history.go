@@ -0,0 +1,408 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// reviewHistory stores every review run. It is nil, and saving is a no-op,
+// when the database could not be opened.
+var reviewHistory *historyDB
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS reviews (
+	id                TEXT PRIMARY KEY,
+	provider          TEXT NOT NULL,
+	repository        TEXT NOT NULL,
+	pr_id             INTEGER NOT NULL,
+	pr_title          TEXT NOT NULL,
+	pr_url            TEXT NOT NULL,
+	source_branch     TEXT NOT NULL,
+	dest_branch       TEXT NOT NULL,
+	source_commit     TEXT NOT NULL,
+	dest_commit       TEXT NOT NULL,
+	pull_request      TEXT NOT NULL,
+	dry_run           INTEGER NOT NULL,
+	status            TEXT NOT NULL,
+	error             TEXT NOT NULL,
+	model             TEXT NOT NULL,
+	prompt_hash       TEXT NOT NULL,
+	prompt_tokens     INTEGER NOT NULL,
+	completion_tokens INTEGER NOT NULL,
+	total_tokens      INTEGER NOT NULL,
+	latency_ms        INTEGER NOT NULL,
+	cached            INTEGER NOT NULL DEFAULT 0,
+	posted            INTEGER NOT NULL,
+	failed            INTEGER NOT NULL,
+	created_at        TEXT NOT NULL,
+	finished_at       TEXT
+);
+CREATE INDEX IF NOT EXISTS reviews_pr ON reviews (provider, repository, pr_id);
+
+CREATE TABLE IF NOT EXISTS findings (
+	review_id  TEXT NOT NULL REFERENCES reviews (id) ON DELETE CASCADE,
+	position   INTEGER NOT NULL,
+	path       TEXT NOT NULL,
+	line       INTEGER NOT NULL,
+	body       TEXT NOT NULL,
+	posted     INTEGER NOT NULL,
+	comment_id TEXT NOT NULL,
+	error      TEXT NOT NULL,
+	PRIMARY KEY (review_id, position)
+);
+`
+
+// historyDB is the SQLite review history: one row per job in reviews and
+// one row per produced comment in findings.
+type historyDB struct {
+	db *sql.DB
+}
+
+// historyPath returns EXOREVIEWER_DB, defaulting to exoreviewer.db
+func historyPath() string {
+	if path := os.Getenv("EXOREVIEWER_DB"); path != "" {
+		return path
+	}
+	return "exoreviewer.db"
+}
+
+func openHistory(path string) (*historyDB, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serialising here avoids SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %v", err)
+	}
+	if err := migrateHistory(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %v", err)
+	}
+	return &historyDB{db: db}, nil
+}
+
+// historyColumns are the reviews columns added after the table was first
+// created, with their definitions. CREATE TABLE IF NOT EXISTS leaves an
+// existing table alone, so migrateHistory adds whichever are missing.
+var historyColumns = []struct{ name, definition string }{
+	{"cached", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+func migrateHistory(db *sql.DB) error {
+	for _, column := range historyColumns {
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('reviews') WHERE name = ?`, column.name).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE reviews ADD COLUMN " + column.name + " " + column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveReview inserts or replaces the job's review row and its findings
+func (h *historyDB) saveReview(job *Job) error {
+	if h == nil {
+		return nil
+	}
+	pr := job.PR
+	prJSON, err := json.Marshal(pr)
+	if err != nil {
+		return err
+	}
+	var finishedAt interface{}
+	if job.FinishedAt != nil {
+		finishedAt = job.FinishedAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO reviews (
+		id, provider, repository, pr_id, pr_title, pr_url, source_branch, dest_branch,
+		source_commit, dest_commit, pull_request, dry_run, status, error, model, prompt_hash,
+		prompt_tokens, completion_tokens, total_tokens, latency_ms, cached, posted, failed,
+		created_at, finished_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.ID, pr.Provider, pr.Repository, pr.ID, pr.Title, pr.URL, pr.SourceBranch, pr.DestBranch,
+		pr.SourceCommit, pr.DestCommit, string(prJSON), job.DryRun, job.Status, job.Error, job.Model, job.PromptHash,
+		job.Usage.PromptTokens, job.Usage.CompletionTokens, job.Usage.TotalTokens, job.LatencyMS, job.Cached, job.Posted, job.Failed,
+		job.CreatedAt.UTC().Format(time.RFC3339Nano), finishedAt)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM findings WHERE review_id = ?`, job.ID); err != nil {
+		return err
+	}
+	for i, f := range job.Findings {
+		_, err := tx.Exec(`INSERT INTO findings (review_id, position, path, line, body, posted, comment_id, error)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			job.ID, i, f.Path, f.Line, f.Body, f.Posted, f.CommentID, f.Error)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// historyQuery selects reviews. Zero fields match everything.
+type historyQuery struct {
+	ID         string
+	Provider   string
+	Repository string
+	PRID       int
+	Limit      int
+}
+
+// reviews returns the matching reviews, newest first, with their findings
+func (h *historyDB) reviews(q historyQuery) ([]*Job, error) {
+	if h == nil {
+		return nil, fmt.Errorf("review history is not available")
+	}
+
+	var where []string
+	var args []interface{}
+	if q.ID != "" {
+		where = append(where, "id = ?")
+		args = append(args, q.ID)
+	}
+	if q.Provider != "" {
+		where = append(where, "provider = ?")
+		args = append(args, q.Provider)
+	}
+	if q.Repository != "" {
+		where = append(where, "repository = ?")
+		args = append(args, q.Repository)
+	}
+	if q.PRID != 0 {
+		where = append(where, "pr_id = ?")
+		args = append(args, q.PRID)
+	}
+	query := `SELECT id, pull_request, dry_run, status, error, model, prompt_hash,
+		prompt_tokens, completion_tokens, total_tokens, latency_ms, cached, posted, failed,
+		created_at, finished_at FROM reviews`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC"
+	if q.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(q.Limit)
+	}
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		var job Job
+		var prJSON, createdAt string
+		var finishedAt sql.NullString
+		err := rows.Scan(&job.ID, &prJSON, &job.DryRun, &job.Status, &job.Error, &job.Model, &job.PromptHash,
+			&job.Usage.PromptTokens, &job.Usage.CompletionTokens, &job.Usage.TotalTokens, &job.LatencyMS,
+			&job.Cached, &job.Posted, &job.Failed, &createdAt, &finishedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(prJSON), &job.PR); err != nil {
+			return nil, fmt.Errorf("review %s: invalid pull request: %v", job.ID, err)
+		}
+		job.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+		if finishedAt.Valid {
+			t, _ := time.Parse(time.RFC3339Nano, finishedAt.String)
+			job.FinishedAt = &t
+		}
+		jobs = append(jobs, &job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		if job.Findings, err = h.findings(job.ID); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+// review returns a single review by job ID, or nil if there is none
+func (h *historyDB) review(id string) (*Job, error) {
+	jobs, err := h.reviews(historyQuery{ID: id})
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return jobs[0], nil
+}
+
+func (h *historyDB) findings(reviewID string) ([]Finding, error) {
+	rows, err := h.db.Query(`SELECT path, line, body, posted, comment_id, error
+		FROM findings WHERE review_id = ? ORDER BY position`, reviewID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []Finding
+	for rows.Next() {
+		var f Finding
+		if err := rows.Scan(&f.Path, &f.Line, &f.Body, &f.Posted, &f.CommentID, &f.Error); err != nil {
+			return nil, err
+		}
+		findings = append(findings, f)
+	}
+	return findings, rows.Err()
+}
+
+// reviewsHandler serves GET /reviews?provider=&repository=&pr=&limit= (a JSON
+// list of matching reviews) and GET /reviews/{id} (a single review).
+func reviewsHandler(w http.ResponseWriter, r *http.Request) {
+	if id := r.PathValue("id"); id != "" {
+		job, err := reviewHistory.review(id)
+		if err != nil {
+			log.Printf("Error loading review %s: %v", id, err)
+			http.Error(w, "Failed to load review", http.StatusInternalServerError)
+			return
+		}
+		if job == nil {
+			http.Error(w, "Review not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+
+	query := r.URL.Query()
+	q := historyQuery{
+		Provider:   query.Get("provider"),
+		Repository: query.Get("repository"),
+		Limit:      100,
+	}
+	for name, dest := range map[string]*int{"pr": &q.PRID, "limit": &q.Limit} {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*dest = n
+		}
+	}
+
+	jobs, err := reviewHistory.reviews(q)
+	if err != nil {
+		log.Printf("Error querying review history: %v", err)
+		http.Error(w, "Failed to query reviews", http.StatusInternalServerError)
+		return
+	}
+	if jobs == nil {
+		jobs = []*Job{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// runHistoryCommand implements `exoreviewer history <repository> <pr-id>`:
+// it prints every review of the PR with what the bot said and whether it
+// was posted.
+func runHistoryCommand(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	provider := fs.String("provider", "", "only show reviews from this provider")
+	asJSON := fs.Bool("json", false, "print the reviews as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: exoreviewer history [-provider name] [-json] <repository> <pr-id>")
+	}
+	prID, err := strconv.Atoi(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("invalid PR ID %q", fs.Arg(1))
+	}
+
+	h, err := openHistory(historyPath())
+	if err != nil {
+		return err
+	}
+	defer h.db.Close()
+
+	jobs, err := h.reviews(historyQuery{Provider: *provider, Repository: fs.Arg(0), PRID: prID})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(jobs)
+	}
+	if len(jobs) == 0 {
+		fmt.Println("No reviews found.")
+		return nil
+	}
+
+	for _, job := range jobs {
+		fmt.Printf("Job %s  %s  %s\n", job.ID, job.CreatedAt.Local().Format("2006-01-02 15:04:05"), job.Status)
+		fmt.Printf("  %s #%d %q  %s..%s\n", job.PR.Provider, job.PR.ID, job.PR.Title,
+			shortCommit(job.PR.DestCommit), shortCommit(job.PR.SourceCommit))
+		fmt.Printf("  model %s, %d tokens, %dms, prompt %s (artifacts: exoreviewer artifacts %s)\n",
+			job.Model, job.Usage.TotalTokens, job.LatencyMS, shortCommit(job.PromptHash), job.ID)
+		if job.Cached {
+			fmt.Println("  cached: the model response was reused, not requested")
+		}
+		if job.DryRun {
+			fmt.Println("  dry run: nothing was posted")
+		}
+		if job.Error != "" {
+			fmt.Printf("  error: %s\n", job.Error)
+		}
+		for _, f := range job.Findings {
+			location := "general"
+			if f.Path != "" {
+				location = fmt.Sprintf("%s:%d", f.Path, f.Line)
+			}
+			state := "not posted"
+			switch {
+			case f.Posted:
+				state = "posted as " + f.CommentID
+			case f.Error != "":
+				state = "failed: " + f.Error
+			}
+			fmt.Printf("  - %s [%s]\n", location, state)
+			for _, line := range strings.Split(strings.TrimSpace(f.Body), "\n") {
+				fmt.Printf("      %s\n", line)
+			}
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func shortCommit(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
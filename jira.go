@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maxJiraTickets caps how many referenced tickets are fetched per review
+const maxJiraTickets = 5
+
+// maxJiraDescription is how much of a ticket description goes in the prompt
+const maxJiraDescription = 4000
+
+// jiraKeyPattern matches issue keys such as "PROJ-123". Branch names are
+// often lower-cased, so jiraBranchKeyPattern also matches "proj-123"; such
+// keys only count for projects listed in the config, since branches like
+// "release-2" or "bump-go-1" would read as keys otherwise.
+var jiraKeyPattern = regexp.MustCompile(`\b[A-Z][A-Z0-9]+-[1-9][0-9]*\b`)
+var jiraBranchKeyPattern = regexp.MustCompile(`(?i)\b[a-z][a-z0-9]+-[1-9][0-9]*\b`)
+
+// notJiraProjects are prefixes of common terms that look like issue keys
+var notJiraProjects = map[string]bool{
+	"UTF": true, "SHA": true, "ISO": true, "RFC": true, "CVE": true,
+	"HTTP": true, "TLS": true, "MD": true, "AES": true, "RSA": true,
+}
+
+// jiraKeys returns the distinct issue keys from the allowed projects (any
+// project when projects is empty) referenced in pr's title, description and
+// source branch, or only in the given locations.
+func jiraKeys(pr *PullRequest, projects []string, locations ...string) []string {
+	if len(locations) == 0 {
+		locations = []string{"title", "description", "branch"}
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	add := func(key string) {
+		key = strings.ToUpper(key)
+		project, _, _ := strings.Cut(key, "-")
+		allowed := !notJiraProjects[project]
+		if len(projects) > 0 {
+			allowed = slices.Contains(projects, project)
+		}
+		if !seen[key] && allowed {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, where := range locations {
+		switch where {
+		case "title":
+			for _, key := range jiraKeyPattern.FindAllString(pr.Title, -1) {
+				add(key)
+			}
+		case "description":
+			for _, key := range jiraKeyPattern.FindAllString(pr.Description, -1) {
+				add(key)
+			}
+		case "branch":
+			for _, key := range jiraBranchKeyPattern.FindAllString(pr.SourceBranch, -1) {
+				if key == strings.ToUpper(key) || len(projects) > 0 {
+					add(key)
+				}
+			}
+		}
+	}
+	return keys
+}
+
+// JiraTicket is the part of a Jira issue the review prompt uses
+type JiraTicket struct {
+	Key                string `json:"key"`
+	URL                string `json:"url,omitempty"`
+	Summary            string `json:"summary"`
+	Description        string `json:"description,omitempty"`
+	AcceptanceCriteria string `json:"acceptance_criteria,omitempty"`
+	Type               string `json:"type,omitempty"`
+	Status             string `json:"status,omitempty"`
+	StatusCategory     string `json:"status_category,omitempty"` // "new", "indeterminate" or "done"
+	EpicKey            string `json:"epic_key,omitempty"`
+	EpicSummary        string `json:"epic_summary,omitempty"`
+}
+
+// JiraClient is the part of Jira exoReviewer uses
+type JiraClient interface {
+	// FetchTicket reads ticket key; errJiraNotFound if it doesn't exist
+	FetchTicket(ctx context.Context, key string) (JiraTicket, error)
+	// AddComment comments on ticket key; body is Jira wiki markup
+	AddComment(ctx context.Context, key, body string) error
+	// AddRemoteLink links ticket key to a web page. Links with the same
+	// GlobalID replace each other.
+	AddRemoteLink(ctx context.Context, key string, link JiraRemoteLink) error
+}
+
+// JiraRemoteLink is a link from a ticket to a page outside Jira
+type JiraRemoteLink struct {
+	GlobalID string `json:"global_id"`
+	URL      string `json:"url"`
+	Title    string `json:"title"`
+	Summary  string `json:"summary"`
+}
+
+// errJiraNotFound is returned for tickets that don't exist, or that the
+// configured user can't see
+var errJiraNotFound = errors.New("Jira ticket not found")
+
+// restJiraClient uses the Jira REST API (v2, which returns descriptions as
+// plain text on both Jira Cloud and Jira Server).
+type restJiraClient struct {
+	baseURL string
+	headers map[string]string
+	// Custom field IDs, e.g. "customfield_10100"; optional
+	acceptanceField string
+	epicLinkField   string
+}
+
+// newJiraClient configures a client from JIRA_BASE_URL and either
+// JIRA_EMAIL and JIRA_API_TOKEN (Jira Cloud) or JIRA_TOKEN (a Jira Server
+// personal access token). JIRA_FAKE_FILE selects an in-memory fake instead.
+// It returns nil when Jira is not configured.
+func newJiraClient() (JiraClient, error) {
+	if path := os.Getenv("JIRA_FAKE_FILE"); path != "" {
+		return loadFakeJiraClient(path)
+	}
+	baseURL := strings.TrimSuffix(os.Getenv("JIRA_BASE_URL"), "/")
+	if baseURL == "" {
+		return nil, nil
+	}
+	c := &restJiraClient{
+		baseURL:         baseURL,
+		headers:         make(map[string]string),
+		acceptanceField: os.Getenv("JIRA_ACCEPTANCE_CRITERIA_FIELD"),
+		epicLinkField:   os.Getenv("JIRA_EPIC_LINK_FIELD"),
+	}
+	switch {
+	case os.Getenv("JIRA_EMAIL") != "" && os.Getenv("JIRA_API_TOKEN") != "":
+		c.headers["Authorization"] = basicAuth(os.Getenv("JIRA_EMAIL"), os.Getenv("JIRA_API_TOKEN"))
+	case os.Getenv("JIRA_TOKEN") != "":
+		c.headers["Authorization"] = "Bearer " + os.Getenv("JIRA_TOKEN")
+	default:
+		return nil, fmt.Errorf("JIRA_BASE_URL is set but neither JIRA_EMAIL/JIRA_API_TOKEN nor JIRA_TOKEN is")
+	}
+	return c, nil
+}
+
+// jiraIssue is the REST API representation of an issue. Custom fields are
+// kept raw since their IDs are configured at runtime.
+type jiraIssue struct {
+	Key    string                     `json:"key"`
+	Fields map[string]json.RawMessage `json:"fields"`
+}
+
+type jiraNamed struct {
+	Name string `json:"name"`
+}
+
+type jiraStatus struct {
+	Name     string `json:"name"`
+	Category struct {
+		Key string `json:"key"`
+	} `json:"statusCategory"`
+}
+
+type jiraParent struct {
+	Key    string `json:"key"`
+	Fields struct {
+		Summary   string    `json:"summary"`
+		IssueType jiraNamed `json:"issuetype"`
+	} `json:"fields"`
+}
+
+func (c *restJiraClient) getIssue(ctx context.Context, key string, fields ...string) (*jiraIssue, error) {
+	u := fmt.Sprintf("%s/rest/api/2/issue/%s?fields=%s", c.baseURL, url.PathEscape(key), url.QueryEscape(strings.Join(fields, ",")))
+	var issue jiraIssue
+	err := sendJSON(ctx, "Jira", http.MethodGet, u, c.headers, nil, &issue)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", errJiraNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &issue, nil
+}
+
+// FetchTicket reads issue key and its epic, if it has one
+func (c *restJiraClient) FetchTicket(ctx context.Context, key string) (JiraTicket, error) {
+	fields := []string{"summary", "description", "issuetype", "status", "parent"}
+	for _, field := range []string{c.acceptanceField, c.epicLinkField} {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	issue, err := c.getIssue(ctx, key, fields...)
+	if err != nil {
+		return JiraTicket{}, err
+	}
+
+	ticket := JiraTicket{Key: issue.Key, URL: c.baseURL + "/browse/" + issue.Key}
+	var issueType jiraNamed
+	var status jiraStatus
+	var parent jiraParent
+	jiraField(issue, "summary", &ticket.Summary)
+	jiraField(issue, "description", &ticket.Description)
+	jiraField(issue, "issuetype", &issueType)
+	jiraField(issue, "status", &status)
+	ticket.Type, ticket.Status, ticket.StatusCategory = issueType.Name, status.Name, status.Category.Key
+
+	if c.acceptanceField != "" {
+		jiraField(issue, c.acceptanceField, &ticket.AcceptanceCriteria)
+	}
+	if ticket.AcceptanceCriteria == "" {
+		ticket.Description, ticket.AcceptanceCriteria = splitAcceptanceCriteria(ticket.Description)
+	}
+
+	// Team-managed and newer Cloud projects link epics as the parent; Jira
+	// Server uses an "Epic Link" custom field holding the epic's key
+	if jiraField(issue, "parent", &parent) && parent.Fields.IssueType.Name == "Epic" {
+		ticket.EpicKey, ticket.EpicSummary = parent.Key, parent.Fields.Summary
+	} else if c.epicLinkField != "" && jiraField(issue, c.epicLinkField, &ticket.EpicKey) && ticket.EpicKey != "" {
+		if epic, err := c.getIssue(ctx, ticket.EpicKey, "summary"); err == nil {
+			jiraField(epic, "summary", &ticket.EpicSummary)
+		} else {
+			slog.WarnContext(ctx, "Error fetching Jira epic", "epic", ticket.EpicKey, "error", err)
+		}
+	}
+	return ticket, nil
+}
+
+func (c *restJiraClient) AddComment(ctx context.Context, key, body string) error {
+	u := fmt.Sprintf("%s/rest/api/2/issue/%s/comment", c.baseURL, url.PathEscape(key))
+	return sendJSON(ctx, "Jira", http.MethodPost, u, c.headers, map[string]string{"body": body}, nil)
+}
+
+func (c *restJiraClient) AddRemoteLink(ctx context.Context, key string, link JiraRemoteLink) error {
+	u := fmt.Sprintf("%s/rest/api/2/issue/%s/remotelink", c.baseURL, url.PathEscape(key))
+	body := map[string]interface{}{
+		"globalId": link.GlobalID,
+		"object": map[string]string{
+			"url":     link.URL,
+			"title":   link.Title,
+			"summary": link.Summary,
+		},
+	}
+	return sendJSON(ctx, "Jira", http.MethodPost, u, c.headers, body, nil)
+}
+
+// jiraField decodes issue field name into v, reporting whether it was set.
+// Fields of an unexpected shape are treated as unset.
+func jiraField(issue *jiraIssue, name string, v interface{}) bool {
+	raw, ok := issue.Fields[name]
+	if !ok || string(raw) == "null" {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
+
+var acceptanceHeading = regexp.MustCompile(`(?im)^\s*(?:h[1-6]\.\s*|#+\s*|\*)?acceptance criteria\*?:?\s*$`)
+
+// splitAcceptanceCriteria separates an "Acceptance Criteria" section from a
+// ticket description, for projects that keep it there rather than in a field
+func splitAcceptanceCriteria(description string) (rest, criteria string) {
+	loc := acceptanceHeading.FindStringIndex(description)
+	if loc == nil {
+		return description, ""
+	}
+	return strings.TrimSpace(description[:loc[0]]), strings.TrimSpace(description[loc[1]:])
+}
+
+// fetchJiraTickets fetches the tickets referenced by pr. Failed lookups are
+// logged, counted and returned alongside the tickets that were found.
+func fetchJiraTickets(ctx context.Context, client JiraClient, keys []string) ([]JiraTicket, map[string]error) {
+	if len(keys) > maxJiraTickets {
+		keys = keys[:maxJiraTickets]
+	}
+	var tickets []JiraTicket
+	failures := make(map[string]error)
+	for _, key := range keys {
+		ticket, err := client.FetchTicket(ctx, key)
+		if err != nil {
+			slog.WarnContext(ctx, "Error fetching Jira ticket", "ticket", key, "error", err)
+			lookupFailures.WithLabelValues("jira").Inc()
+			failures[key] = err
+			continue
+		}
+		tickets = append(tickets, ticket)
+	}
+	return tickets, failures
+}
+
+// generateJiraChunk looks up the Jira tickets pr references so the model can
+// check the diff against them
+func generateJiraChunk(ctx context.Context, pr *PullRequest) string {
+	const header = "### CHUNK: JIRA CONTEXT\n"
+	keys := jiraKeys(pr, appConfig.ForRepo(pr).Jira.Projects)
+	if len(keys) == 0 {
+		return header + "# No Jira tickets referenced in the PR title, description or branch\n"
+	}
+	client, err := newJiraClient()
+	if err != nil {
+		lookupFailures.WithLabelValues("jira").Inc()
+		return header + "# Jira is misconfigured: " + err.Error() + "\n"
+	}
+	if client == nil {
+		return header + "# Referenced tickets (Jira lookups are not configured): " + strings.Join(keys, ", ") + "\n"
+	}
+
+	tickets, failures := fetchJiraTickets(ctx, client, keys)
+	var builder strings.Builder
+	builder.WriteString(header)
+	builder.WriteString("# Jira Tickets\n")
+	builder.WriteString("Check whether the changes implement these tickets and meet their acceptance criteria.\n")
+	for _, ticket := range tickets {
+		builder.WriteString(fmt.Sprintf("\n## %s: %s\n", ticket.Key, ticket.Summary))
+		builder.WriteString(fmt.Sprintf("- Type: %s\n", ticket.Type))
+		builder.WriteString(fmt.Sprintf("- Status: %s\n", ticket.Status))
+		if ticket.EpicKey != "" {
+			builder.WriteString(fmt.Sprintf("- Epic: %s %s\n", ticket.EpicKey, ticket.EpicSummary))
+		}
+		builder.WriteString(fmt.Sprintf("- Link: %s\n", ticket.URL))
+
+		description := strings.TrimSpace(ticket.Description)
+		if len(description) > maxJiraDescription {
+			description = description[:maxJiraDescription] + "\n... (truncated)"
+		}
+		if description == "" {
+			description = "No description"
+		}
+		builder.WriteString("\n**Description:**\n" + description + "\n")
+		if ticket.AcceptanceCriteria != "" {
+			builder.WriteString("\n**Acceptance Criteria:**\n" + strings.TrimSpace(ticket.AcceptanceCriteria) + "\n")
+		}
+	}
+	for _, key := range keys {
+		if err, ok := failures[key]; ok {
+			builder.WriteString(fmt.Sprintf("\n## %s\n# Error fetching ticket: %v\n", key, err))
+		}
+	}
+	return builder.String()
+}
+
+// fakeJiraClient serves tickets from a JSON file and records the comments
+// and remote links it is sent back into the same file, for trying out the
+// Jira integration without a Jira site.
+type fakeJiraClient struct {
+	mu   sync.Mutex
+	path string
+	data fakeJiraData
+}
+
+type fakeJiraData struct {
+	Tickets     []JiraTicket      `json:"tickets"`
+	Comments    []fakeJiraComment `json:"comments,omitempty"`
+	RemoteLinks []fakeJiraLink    `json:"remote_links,omitempty"`
+}
+
+type fakeJiraComment struct {
+	Key  string `json:"key"`
+	Body string `json:"body"`
+}
+
+type fakeJiraLink struct {
+	Key string `json:"key"`
+	JiraRemoteLink
+}
+
+func loadFakeJiraClient(path string) (*fakeJiraClient, error) {
+	c := &fakeJiraClient{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fake Jira file: %v", err)
+	}
+	if err := json.Unmarshal(data, &c.data); err != nil {
+		return nil, fmt.Errorf("invalid fake Jira file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+func (c *fakeJiraClient) FetchTicket(ctx context.Context, key string) (JiraTicket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ticket := range c.data.Tickets {
+		if ticket.Key == key {
+			return ticket, nil
+		}
+	}
+	return JiraTicket{}, fmt.Errorf("%w: %s", errJiraNotFound, key)
+}
+
+func (c *fakeJiraClient) AddComment(ctx context.Context, key, body string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data.Comments = append(c.data.Comments, fakeJiraComment{Key: key, Body: body})
+	return c.save()
+}
+
+func (c *fakeJiraClient) AddRemoteLink(ctx context.Context, key string, link JiraRemoteLink) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	links := c.data.RemoteLinks[:0]
+	for _, existing := range c.data.RemoteLinks {
+		if existing.Key != key || existing.GlobalID != link.GlobalID {
+			links = append(links, existing)
+		}
+	}
+	c.data.RemoteLinks = append(links, fakeJiraLink{Key: key, JiraRemoteLink: link})
+	return c.save()
+}
+
+func (c *fakeJiraClient) save() error {
+	data, err := json.MarshalIndent(c.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0644)
+}
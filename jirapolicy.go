@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// jiraReminderMarker ends every Jira reminder comment, so later reviews of
+// the PR find and edit that comment instead of posting another one
+const jiraReminderMarker = "_exoReviewer Jira link check_"
+
+// jiraResolvedPrefix starts a reminder comment once the PR complies
+const jiraResolvedPrefix = "✅"
+
+// checkJiraPolicy returns the ticket keys pr references under policy and,
+// if it doesn't comply, the problems found. Tickets are only checked in
+// Jira when the policy asks for it; a lookup that fails for another reason
+// than the ticket not existing gives the PR the benefit of the doubt.
+func checkJiraPolicy(ctx context.Context, client JiraClient, pr *PullRequest, policy JiraPolicy) (keys []string, problems []string) {
+	keys = jiraKeys(pr, policy.Projects, policy.RequireIn...)
+	if len(keys) == 0 {
+		problem := "No Jira ticket"
+		if len(policy.Projects) > 0 {
+			problem += " from " + strings.Join(policy.Projects, ", ")
+		}
+		locations := policy.RequireIn
+		if len(locations) == 0 {
+			locations = []string{"title", "branch", "description"}
+		}
+		problem += " is referenced in the PR " + joinOr(locations)
+		return nil, []string{problem}
+	}
+	if !policy.MustExist && !policy.RequireOpen {
+		return keys, nil
+	}
+	if client == nil {
+		slog.WarnContext(ctx, "Jira policy checks tickets but JIRA_BASE_URL is not set; skipping the check")
+		return keys, nil
+	}
+
+	for _, key := range keys {
+		ticket, err := client.FetchTicket(ctx, key)
+		if errors.Is(err, errJiraNotFound) {
+			problems = append(problems, key+" does not exist in Jira")
+			continue
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Error checking Jira ticket", "ticket", key, "error", err)
+			lookupFailures.WithLabelValues("jira").Inc()
+			return keys, nil
+		}
+		if policy.RequireOpen && ticket.StatusCategory == "done" {
+			problems = append(problems, fmt.Sprintf("%s is already %s", key, ticket.Status))
+			continue
+		}
+		// One ticket in good standing is enough
+		return keys, nil
+	}
+	return keys, problems
+}
+
+func joinOr(items []string) string {
+	if len(items) <= 1 {
+		return strings.Join(items, "")
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " or " + items[len(items)-1]
+}
+
+func jiraReminderText(problems []string) string {
+	var b strings.Builder
+	b.WriteString("⚠️ **This PR is not linked to a valid Jira ticket.**\n\n")
+	for _, problem := range problems {
+		b.WriteString("- " + problem + "\n")
+	}
+	b.WriteString("\nPlease reference the Jira ticket this PR implements. This comment is updated on the next review.\n\n")
+	b.WriteString(jiraReminderMarker)
+	return b.String()
+}
+
+func jiraResolvedText(keys []string) string {
+	return fmt.Sprintf("%s This PR is linked to Jira: %s.\n\n%s", jiraResolvedPrefix, strings.Join(keys, ", "), jiraReminderMarker)
+}
+
+// enforceJiraPolicy checks pr against policy and keeps a single reminder
+// comment on the PR up to date with the outcome. With the request_changes
+// action, changes are also requested while the PR doesn't comply.
+func enforceJiraPolicy(ctx context.Context, p Provider, pr *PullRequest, policy JiraPolicy, dryRun bool) error {
+	client, err := newJiraClient()
+	if err != nil {
+		return err
+	}
+	keys, problems := checkJiraPolicy(ctx, client, pr, policy)
+	if len(problems) == 0 {
+		slog.InfoContext(ctx, "Jira policy satisfied", "tickets", keys)
+	} else {
+		slog.InfoContext(ctx, "Jira policy not met", "problems", problems)
+	}
+	if dryRun {
+		return nil
+	}
+
+	comments, err := p.ListComments(ctx, pr)
+	if err != nil {
+		return fmt.Errorf("failed to list comments: %w", err)
+	}
+	var reminder *PostedComment
+	for i := range comments {
+		if !strings.Contains(comments[i].Text, jiraReminderMarker) {
+			continue
+		}
+		// Anyone can paste the marker; only exoReviewer's own reminder counts
+		if !comments[i].Mine {
+			slog.InfoContext(ctx, "Ignoring Jira reminder marker in a comment exoReviewer didn't post", "author", comments[i].Author)
+			continue
+		}
+		reminder = &comments[i]
+		break
+	}
+	wasFailing := reminder != nil && !strings.HasPrefix(reminder.Text, jiraResolvedPrefix)
+
+	text := jiraResolvedText(keys)
+	if len(problems) > 0 {
+		text = jiraReminderText(problems)
+	}
+	switch {
+	case reminder == nil && len(problems) > 0:
+		if _, err := p.PostComment(ctx, pr, CommentPayload{Content: Content{Raw: text}}); err != nil {
+			return fmt.Errorf("failed to post Jira reminder: %w", err)
+		}
+	case reminder != nil && reminder.Text != text:
+		if err := p.EditComment(ctx, pr, reminder.ID, text); err != nil {
+			return fmt.Errorf("failed to update Jira reminder: %w", err)
+		}
+	}
+
+	// Only vote when the outcome changes, so re-reviews don't pile up votes
+	if policy.Action != "request_changes" || wasFailing == (len(problems) > 0) {
+		return nil
+	}
+	reason := "Jira linkage: " + strings.Join(problems, "; ")
+	if len(problems) == 0 {
+		reason = "Jira linkage fixed: " + strings.Join(keys, ", ")
+	}
+	err = p.RequestChanges(ctx, pr, len(problems) > 0, reason)
+	if errors.Is(err, errors.ErrUnsupported) {
+		slog.InfoContext(ctx, "Provider can't request changes; the Jira reminder comment stands alone", "error", err)
+		return nil
+	}
+	return err
+}
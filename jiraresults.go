@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// reviewVerdict summarises findings by their most severe ones
+func reviewVerdict(findings []Finding) (verdict string, blockers, majors int) {
+	for _, f := range findings {
+		switch f.Severity() {
+		case "blocker":
+			blockers++
+		case "major":
+			majors++
+		}
+	}
+	switch {
+	case blockers > 0:
+		verdict = "Changes required"
+	case majors > 0:
+		verdict = "Needs attention"
+	default:
+		verdict = "No major issues"
+	}
+	return verdict, blockers, majors
+}
+
+// jiraResultsComment is the Jira wiki markup comment for job's review
+func jiraResultsComment(pr *PullRequest, job *Job) string {
+	verdict, blockers, majors := reviewVerdict(job.Findings)
+	title := fmt.Sprintf("PR #%d: %s", pr.ID, pr.Title)
+	if pr.URL != "" {
+		title = fmt.Sprintf("[%s|%s]", strings.ReplaceAll(title, "|", "-"), pr.URL)
+	}
+
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("*exoReviewer* reviewed %s in %s", title, pr.Repository))
+	if pr.SourceCommit != "" {
+		b.WriteString(" at commit " + shortCommit(pr.SourceCommit))
+	}
+	b.WriteString(".\n\n")
+	b.WriteString(fmt.Sprintf("Verdict: *%s*\n", verdict))
+	b.WriteString(fmt.Sprintf("* Blocker findings: %d\n", blockers))
+	b.WriteString(fmt.Sprintf("* Major findings: %d\n", majors))
+	b.WriteString(fmt.Sprintf("* Other findings: %d\n", len(job.Findings)-blockers-majors))
+	return b.String()
+}
+
+// postJiraResults comments on every Jira ticket pr references with the
+// review's verdict and adds a remote link from the ticket to the PR. Each
+// review of the PR adds a comment; the link is replaced.
+func postJiraResults(ctx context.Context, pr *PullRequest, job *Job) error {
+	client, err := newJiraClient()
+	if err != nil || client == nil {
+		return err
+	}
+	keys := jiraKeys(pr, appConfig.ForRepo(pr).Jira.Projects)
+	if len(keys) > maxJiraTickets {
+		keys = keys[:maxJiraTickets]
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	comment := jiraResultsComment(pr, job)
+	verdict, blockers, majors := reviewVerdict(job.Findings)
+	link := JiraRemoteLink{
+		GlobalID: fmt.Sprintf("exoreviewer:%s:%s:%d", pr.Provider, pr.Repository, pr.ID),
+		URL:      pr.URL,
+		Title:    fmt.Sprintf("PR #%d: %s", pr.ID, pr.Title),
+		Summary:  fmt.Sprintf("exoReviewer: %s (%d blocker, %d major)", verdict, blockers, majors),
+	}
+
+	var errs []error
+	for _, key := range keys {
+		if err := client.AddComment(ctx, key, comment); err != nil {
+			errs = append(errs, fmt.Errorf("failed to comment on %s: %w", key, err))
+			continue
+		}
+		if link.URL != "" {
+			if err := client.AddRemoteLink(ctx, key, link); err != nil {
+				errs = append(errs, fmt.Errorf("failed to link %s to the PR: %w", key, err))
+				continue
+			}
+		}
+		slog.InfoContext(ctx, "Posted review results to Jira", "ticket", key, "verdict", verdict)
+	}
+	return errors.Join(errs...)
+}
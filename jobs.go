@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// artifactsDir holds one directory of inspectable artifacts per review job
+const artifactsDir = "./artifacts"
+
+// Artifact file names written for every job
+const (
+	artifactJob      = "job.json"
+	artifactPrompt   = "prompt.txt"
+	artifactResponse = "response.txt"
+	artifactComments = "comments.json"
+)
+
+var jobIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// Job is a single review run of a pull request
+type Job struct {
+	ID         string       `json:"id"`
+	PR         *PullRequest `json:"pull_request"`
+	DryRun     bool         `json:"dry_run"`
+	RerunOf    string       `json:"rerun_of,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Status     string       `json:"status"`
+	Error      string       `json:"error,omitempty"`
+	Model      string       `json:"model,omitempty"`
+	PromptHash string       `json:"prompt_hash,omitempty"`
+	Usage      TokenUsage   `json:"usage"`
+	LatencyMS  int64        `json:"latency_ms"`
+	Cached     bool         `json:"cached,omitempty"`
+	Findings   []Finding    `json:"findings,omitempty"`
+	Posted     int          `json:"posted"`
+	Failed     int          `json:"failed"`
+}
+
+// Finding is one review comment produced by a job and what became of it
+type Finding struct {
+	Path      string `json:"path,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Body      string `json:"body"`
+	Posted    bool   `json:"posted"`
+	CommentID string `json:"comment_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// severityTag matches the severity the review output format asks the model
+// to start each comment with
+var severityTag = regexp.MustCompile(`(?i)^\W*\[(blocker|major|minor|nit)\]`)
+
+// Severity returns the finding's severity (blocker, major, minor or nit),
+// or "" when the model didn't give one
+func (f Finding) Severity() string {
+	if m := severityTag.FindStringSubmatch(f.Body); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return ""
+}
+
+func newFinding(comment CommentPayload) Finding {
+	f := Finding{Body: comment.Content.Raw}
+	if comment.Inline != nil {
+		f.Path = comment.Inline.Path
+		f.Line = commentLine(comment.Inline)
+	}
+	return f
+}
+
+func newJobID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
+
+func newJob(pr *PullRequest, dryRun bool) *Job {
+	return &Job{
+		ID:        newJobID(),
+		PR:        pr,
+		DryRun:    dryRun,
+		CreatedAt: time.Now(),
+		Status:    jobQueued,
+	}
+}
+
+// artifactPath validates jobID and name and returns the artifact's path
+func artifactPath(jobID, name string) (string, error) {
+	if !jobIDPattern.MatchString(jobID) {
+		return "", fmt.Errorf("invalid job ID %q", jobID)
+	}
+	if name != "" && (filepath.Base(name) != name || name == "." || name == "..") {
+		return "", fmt.Errorf("invalid artifact name %q", name)
+	}
+	return filepath.Join(artifactsDir, jobID, name), nil
+}
+
+func writeArtifact(jobID, name string, data []byte) error {
+	path, err := artifactPath(jobID, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create artifact directory: %v", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func writeJSONArtifact(jobID, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeArtifact(jobID, name, data)
+}
+
+// saveJob records the job's current state as its job.json artifact
+func saveJob(job *Job) error {
+	return writeJSONArtifact(job.ID, artifactJob, job)
+}
+
+func listArtifacts(jobID string) ([]string, error) {
+	dir, err := artifactPath(jobID, "")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func readArtifact(jobID, name string) ([]byte, error) {
+	path, err := artifactPath(jobID, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// adminCookie carries the ID of a dashboard session in a browser
+const adminCookie = "exoreviewer_admin"
+
+// adminSessionTTL is how long a dashboard login lasts
+const adminSessionTTL = 12 * time.Hour
+
+// adminSessions maps the IDs of dashboard sessions to when they expire. The
+// cookie holds a random ID rather than the admin token, so the token never
+// sits in a browser and logging out ends the session.
+var adminSessions = struct {
+	sync.Mutex
+	expiry map[string]time.Time
+}{expiry: make(map[string]time.Time)}
+
+// newAdminSession starts a dashboard session and returns its ID
+func newAdminSession() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	adminSessions.Lock()
+	defer adminSessions.Unlock()
+	for other, expiry := range adminSessions.expiry {
+		if time.Now().After(expiry) {
+			delete(adminSessions.expiry, other)
+		}
+	}
+	adminSessions.expiry[id] = time.Now().Add(adminSessionTTL)
+	return id, nil
+}
+
+func adminSessionValid(id string) bool {
+	adminSessions.Lock()
+	defer adminSessions.Unlock()
+	expiry, ok := adminSessions.expiry[id]
+	return ok && time.Now().Before(expiry)
+}
+
+func endAdminSession(id string) {
+	adminSessions.Lock()
+	defer adminSessions.Unlock()
+	delete(adminSessions.expiry, id)
+}
+
+// adminAuthorized reports whether r carries EXOREVIEWER_ADMIN_TOKEN as a
+// bearer token, or the cookie of a live dashboard session.
+func adminAuthorized(r *http.Request) bool {
+	token := os.Getenv("EXOREVIEWER_ADMIN_TOKEN")
+	if token == "" {
+		return false
+	}
+	if given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+	}
+	cookie, err := r.Cookie(adminCookie)
+	return err == nil && adminSessionValid(cookie.Value)
+}
+
+// requireAdmin rejects requests that don't carry EXOREVIEWER_ADMIN_TOKEN.
+// Admin routes are disabled when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if os.Getenv("EXOREVIEWER_ADMIN_TOKEN") == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !adminAuthorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// artifactsHandler serves GET /jobs/{id}/artifacts (a JSON list of artifact
+// names) and GET /jobs/{id}/artifacts/{name} (the artifact itself).
+func artifactsHandler(w http.ResponseWriter, r *http.Request) {
+	jobID, name := r.PathValue("id"), r.PathValue("name")
+
+	if name == "" {
+		names, err := listArtifacts(jobID)
+		if err != nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(names)
+		return
+	}
+
+	data, err := readArtifact(jobID, name)
+	if err != nil {
+		http.Error(w, "Artifact not found", http.StatusNotFound)
+		return
+	}
+	if strings.HasSuffix(name, ".json") {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxLintFindings caps how many diagnostics become findings
+const maxLintFindings = 30
+
+// Diagnostic is a linter message on a line the PR added
+type Diagnostic struct {
+	Tool     string
+	Severity string
+	Path     string
+	Line     int
+	Column   int
+	Message  string
+}
+
+// LintResult is the outcome of linting a PR's changes
+type LintResult struct {
+	// Tools are the linters that ran
+	Tools       []string
+	Diagnostics []Diagnostic
+	// Elsewhere counts diagnostics on lines the PR didn't add
+	Elsewhere int
+	// Errors describes linters that couldn't run
+	Errors []string
+}
+
+// linter is a command run at the PR head, with the packages or files to lint
+// appended to it
+type linter struct {
+	name     string
+	command  []string
+	targets  []string
+	severity string
+	goTool   bool
+}
+
+// diagnosticLine matches file:line[:column]: message, the format go vet,
+// staticcheck, golangci-lint and most other linters share
+var diagnosticLine = regexp.MustCompile(`^(?:\./)?([^\s:]+\.\w+):(\d+)(?::(\d+))?: (.+)$`)
+
+// toolSuffix is the linter name golangci-lint and staticcheck append to
+// their messages
+var toolSuffix = regexp.MustCompile(`\s+\([\w-]+\)$`)
+
+// runStaticAnalysis lints the files changed between destRef and sourceRef at
+// sourceRef, in the sandbox under limits, and keeps the diagnostics on added
+// lines. It returns nil when no linter applies to the changes.
+func runStaticAnalysis(ctx context.Context, repoPath, sourceRef, destRef string, cfg StaticAnalysisConfig, limits sandboxLimits) *LintResult {
+	ctx, span := tracer.Start(ctx, "static analysis")
+	defer span.End()
+
+	changed, err := getChangedFiles(repoPath, sourceRef, destRef)
+	if err != nil {
+		return &LintResult{Errors: []string{fmt.Sprintf("failed to list changed files: %v", err)}}
+	}
+	files, err := filesAt(ctx, repoPath, sourceRef)
+	if err != nil {
+		return &LintResult{Errors: []string{err.Error()}}
+	}
+	linters := lintersFor(changed, files, cfg)
+	if len(linters) == 0 {
+		return nil
+	}
+	added, err := addedLines(ctx, repoPath, sourceRef, destRef)
+	if err != nil {
+		return &LintResult{Errors: []string{err.Error()}}
+	}
+
+	worktree, remove, err := exportTree(ctx, repoPath, sourceRef)
+	if err != nil {
+		return &LintResult{Errors: []string{err.Error()}}
+	}
+	defer remove()
+
+	result := &LintResult{}
+	modulesReady := false
+	for _, l := range linters {
+		if l.goTool && !modulesReady {
+			if err := downloadModules(ctx, worktree); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+				break
+			}
+			modulesReady = true
+		}
+		diagnostics, err := runLinter(ctx, worktree, l, limits)
+		if err != nil {
+			slog.WarnContext(ctx, "Linter failed", "linter", l.name, "error", err)
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", l.name, err))
+			continue
+		}
+		result.Tools = append(result.Tools, l.name)
+		for _, d := range diagnostics {
+			if !slices.Contains(added[d.Path], d.Line) {
+				result.Elsewhere++
+			} else if !slices.ContainsFunc(result.Diagnostics, d.duplicates) {
+				result.Diagnostics = append(result.Diagnostics, d)
+			}
+		}
+	}
+	slices.SortStableFunc(result.Diagnostics, func(a, b Diagnostic) int {
+		if a.Path != b.Path {
+			return strings.Compare(a.Path, b.Path)
+		}
+		return a.Line - b.Line
+	})
+
+	slog.InfoContext(ctx, "Static analysis complete",
+		"linters", strings.Join(result.Tools, ","), "diagnostics", len(result.Diagnostics),
+		"elsewhere", result.Elsewhere, "errors", len(result.Errors))
+	if len(result.Errors) > 0 {
+		endSpan(span, errors.New(strings.Join(result.Errors, "; ")))
+	}
+	return result
+}
+
+// lintersFor picks the linters for the changed files that exist at the PR
+// head: the Go tools for changed Go packages, and each configured linter
+// whose extensions match
+func lintersFor(changed []string, files map[string]bool, cfg StaticAnalysisConfig) []linter {
+	var linters []linter
+	if dirs := affectedGoPackages(changed, files); len(dirs) > 0 && files["go.mod"] {
+		var packages []string
+		for _, dir := range dirs {
+			packages = append(packages, "./"+dir)
+		}
+		linters = append(linters, linter{name: "go vet", command: []string{"go", "vet"}, targets: packages, severity: "MAJOR", goTool: true})
+		if _, err := exec.LookPath("staticcheck"); err == nil {
+			linters = append(linters, linter{name: "staticcheck", command: []string{"staticcheck"}, targets: packages, severity: "MINOR", goTool: true})
+		}
+		if _, err := exec.LookPath("golangci-lint"); err == nil {
+			linters = append(linters, linter{name: "golangci-lint", command: []string{"golangci-lint", "run"}, targets: packages, severity: "MINOR", goTool: true})
+		}
+	}
+	for _, configured := range cfg.Linters {
+		var targets []string
+		for _, file := range changed {
+			// The ./ keeps a file named like "--fix" from reading as a flag
+			if files[file] && slices.Contains(configured.Extensions, path.Ext(file)) {
+				targets = append(targets, "./"+file)
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		severity := configured.Severity
+		if severity == "" {
+			severity = "MINOR"
+		}
+		linters = append(linters, linter{name: configured.Name, command: configured.Command, targets: targets, severity: severity})
+	}
+	return linters
+}
+
+// runLinter runs l in worktree and parses its diagnostics. Linters exit
+// non-zero when they find problems, so that's only an error when the output
+// holds no diagnostics.
+func runLinter(ctx context.Context, worktree string, l linter, limits sandboxLimits) ([]Diagnostic, error) {
+	ctx, cancel := context.WithTimeout(ctx, limits.Timeout)
+	defer cancel()
+	args := append(slices.Clone(l.command[1:]), l.targets...)
+	env, readOnly := []string{"PATH=" + os.Getenv("PATH"), "HOME=/tmp"}, []string(nil)
+	if l.goTool {
+		var err error
+		if env, readOnly, err = goEnv(true); err != nil {
+			return nil, err
+		}
+	}
+	cmd, err := sandboxCommand(ctx, worktree, limits, sandboxPaths{ReadOnly: readOnly}, l.command[0], args...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = env
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	runErr := cmd.Run()
+
+	var diagnostics []Diagnostic
+	for _, line := range strings.Split(output.String(), "\n") {
+		m := diagnosticLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		d := Diagnostic{Tool: l.name, Severity: l.severity, Message: m[4]}
+		d.Path = filepath.ToSlash(strings.TrimPrefix(m[1], worktree+string(filepath.Separator)))
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		diagnostics = append(diagnostics, d)
+	}
+	if ctx.Err() != nil {
+		return diagnostics, fmt.Errorf("timed out after %s", limits.Timeout)
+	}
+	if runErr != nil && len(diagnostics) == 0 {
+		return nil, fmt.Errorf("%v\n%s", runErr, truncatePayload(output.String()))
+	}
+	return diagnostics, nil
+}
+
+// duplicates reports whether d and other are the same problem, as when
+// golangci-lint's govet repeats go vet
+func (d Diagnostic) duplicates(other Diagnostic) bool {
+	return d.Path == other.Path && d.Line == other.Line &&
+		toolSuffix.ReplaceAllString(d.Message, "") == toolSuffix.ReplaceAllString(other.Message, "")
+}
+
+// flags reports whether a linter flagged the line inline refers to
+func (r *LintResult) flags(inline *Inline) bool {
+	return r != nil && inline != nil && slices.ContainsFunc(r.Diagnostics, func(d Diagnostic) bool {
+		return d.Path == inline.Path && d.Line == commentLine(inline)
+	})
+}
+
+// Comments turns the diagnostics into inline findings
+func (r *LintResult) Comments() []CommentPayload {
+	if r == nil {
+		return nil
+	}
+	var comments []CommentPayload
+	for i, d := range r.Diagnostics {
+		if i == maxLintFindings {
+			comments = append(comments, CommentPayload{Content: Content{Raw: fmt.Sprintf(
+				"[MINOR] 🔍 %d more linter diagnostics on changed lines are not shown.", len(r.Diagnostics)-i)}})
+			break
+		}
+		comments = append(comments, CommentPayload{
+			Content: Content{Raw: fmt.Sprintf("[%s] 🔍 **%s**: %s", d.Severity, d.Tool, d.Message)},
+			Inline:  &Inline{Path: d.Path, To: d.Line},
+		})
+	}
+	return comments
+}
+
+// generateStaticAnalysisChunk lists the diagnostics so the model doesn't
+// repeat them
+func generateStaticAnalysisChunk(r *LintResult) string {
+	const header = "### CHUNK: STATIC ANALYSIS\n"
+	if r == nil {
+		return header + "# Static analysis did not run on these changes\n"
+	}
+	var b strings.Builder
+	b.WriteString(header)
+	for _, e := range r.Errors {
+		b.WriteString("# Could not run " + e + "\n")
+	}
+	if len(r.Tools) == 0 {
+		return b.String()
+	}
+	b.WriteString(fmt.Sprintf("Linters run at the PR head: %s\n", strings.Join(r.Tools, ", ")))
+	if len(r.Diagnostics) == 0 {
+		b.WriteString("No diagnostics on changed lines.\n")
+		return b.String()
+	}
+	b.WriteString("These diagnostics on changed lines are already reported to the author. Do not repeat them; look for what linters can't catch.\n\n")
+	for _, d := range r.Diagnostics {
+		b.WriteString(fmt.Sprintf("- %s:%d: [%s] %s\n", d.Path, d.Line, d.Tool, d.Message))
+	}
+	return b.String()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Model is a language model backend that turns a review prompt into a
+// response the pipeline can parse into comments.
+type Model interface {
+	// Name identifies the backend and model, e.g. "azure-openai/gpt4Hackathon"
+	Name() string
+	Complete(ctx context.Context, prompt string) (Completion, error)
+}
+
+// Completion is a model's response to a prompt
+type Completion struct {
+	Text  string
+	Usage TokenUsage
+	// Cached is set when the response came from the response cache; Usage
+	// is then what the original completion consumed
+	Cached bool
+}
+
+// TokenUsage counts the tokens a completion consumed, as reported by the
+// backend. Backends that don't report usage leave it zero.
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// reviewModel is the model used by the webhook pipeline and the CLI
+var reviewModel Model = azureOpenAIModel{}
+
+// azureOpenAIModel is the Azure OpenAI deployment configured by the
+// endpoint, deployment and apiVersion constants.
+type azureOpenAIModel struct{}
+
+func (azureOpenAIModel) Name() string { return "azure-openai/" + deployment }
+
+func (azureOpenAIModel) Complete(ctx context.Context, prompt string) (Completion, error) {
+	return analyzeWithGPT4(ctx, prompt)
+}
+
+// replayModel replays recorded model responses in order. It stands in for
+// the real model during replays.
+type replayModel struct {
+	mu        sync.Mutex
+	responses []string
+	next      int
+}
+
+func (m *replayModel) Name() string { return "fixture" }
+
+func (m *replayModel) Complete(ctx context.Context, prompt string) (Completion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.next >= len(m.responses) {
+		return Completion{}, fmt.Errorf("fixture has no model response #%d", m.next+1)
+	}
+	response := m.responses[m.next]
+	m.next++
+	return Completion{Text: response}, nil
+}
+
+// stubModel returns a fixed response without calling out anywhere. The
+// evaluation harness uses it to exercise benchmarks offline.
+type stubModel struct {
+	response string
+}
+
+func (m stubModel) Name() string { return "stub" }
+
+func (m stubModel) Complete(ctx context.Context, prompt string) (Completion, error) {
+	return Completion{Text: m.response}, nil
+}
+
+// modelByName returns the model backend registered under name
+func modelByName(name string) (Model, error) {
+	switch name {
+	case "", "azure-openai":
+		return azureOpenAIModel{}, nil
+	case "stub":
+		return stubModel{response: "[]"}, nil
+	}
+	return nil, fmt.Errorf("unknown model %q", name)
+}
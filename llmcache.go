@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLLMCacheDir   = "./llm-cache"
+	defaultLLMCacheTTL   = 7 * 24 * time.Hour
+	defaultLLMCacheMaxMB = 256
+)
+
+// parameterizedModel is a Model whose responses depend on settings besides
+// the prompt, such as temperature. The settings are part of the cache key.
+type parameterizedModel interface {
+	Parameters() map[string]any
+}
+
+func (azureOpenAIModel) Parameters() map[string]any {
+	return map[string]any{"api_version": apiVersion, "temperature": temperature, "max_tokens": maxTokens}
+}
+
+// cacheKey identifies a completion by the model, its parameters and the
+// prompt
+func cacheKey(model Model, prompt string) string {
+	var params []byte
+	if p, ok := model.(parameterizedModel); ok {
+		// Maps marshal with sorted keys, so the key is stable
+		params, _ = json.Marshal(p.Parameters())
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", model.Name(), params)
+	h.Write([]byte(prompt))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseCache stores completions on disk, one JSON file per key. Entries
+// expire after ttl, and the least recently used go once the cache is over
+// maxBytes.
+type responseCache struct {
+	dir      string
+	ttl      time.Duration
+	maxBytes int64
+	mu       sync.Mutex
+}
+
+type cacheEntry struct {
+	Model     string     `json:"model"`
+	CreatedAt time.Time  `json:"created_at"`
+	Text      string     `json:"text"`
+	Usage     TokenUsage `json:"usage"`
+}
+
+func (c *responseCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// get returns the completion stored under key, if it hasn't expired
+func (c *responseCache) get(key string) (Completion, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Completion{}, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || time.Since(entry.CreatedAt) > c.ttl {
+		os.Remove(path)
+		return Completion{}, false
+	}
+	// The modification time orders entries for eviction
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return Completion{Text: entry.Text, Usage: entry.Usage, Cached: true}, true
+}
+
+// put stores completion under key and evicts entries to stay within the
+// size limit
+func (c *responseCache) put(key, model string, completion Completion) error {
+	data, err := json.Marshal(cacheEntry{Model: model, CreatedAt: time.Now(), Text: completion.Text, Usage: completion.Usage})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	// Written aside and renamed, so a reader never sees half an entry
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return c.prune()
+}
+
+// prune removes expired entries, then the least recently used until the
+// cache fits in maxBytes
+func (c *responseCache) prune() error {
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	var total int64
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		// Hits refresh the modification time, so this only catches entries
+		// nobody asked for within the TTL; get checks the creation time
+		if time.Since(info.ModTime()) > c.ttl {
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, file{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan cache: %v", err)
+	}
+	slices.SortFunc(files, func(a, b file) int { return a.modTime.Compare(b.modTime) })
+	for _, f := range files {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err == nil {
+			total -= f.size
+			llmCacheEvictions.Inc()
+		}
+	}
+	return nil
+}
+
+type noCacheKey struct{}
+
+// withoutResponseCache makes completions under ctx skip the cache lookup.
+// Their responses still replace what the cache held.
+func withoutResponseCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+// cachedModel answers prompts it has seen before from the cache and sends
+// the rest to model. Failed completions aren't cached.
+type cachedModel struct {
+	model Model
+	cache *responseCache
+}
+
+func (m cachedModel) Name() string { return m.model.Name() }
+
+func (m cachedModel) Complete(ctx context.Context, prompt string) (Completion, error) {
+	key := cacheKey(m.model, prompt)
+	if ctx.Value(noCacheKey{}) != nil {
+		llmCacheRequests.WithLabelValues(m.Name(), "bypass").Inc()
+	} else if completion, ok := m.cache.get(key); ok {
+		llmCacheRequests.WithLabelValues(m.Name(), "hit").Inc()
+		slog.InfoContext(ctx, "Model response served from cache", "model", m.Name(), "key", key[:12])
+		return completion, nil
+	} else {
+		llmCacheRequests.WithLabelValues(m.Name(), "miss").Inc()
+	}
+	completion, err := m.model.Complete(ctx, prompt)
+	if err != nil {
+		return completion, err
+	}
+	if err := m.cache.put(key, m.Name(), completion); err != nil {
+		slog.WarnContext(ctx, "Error caching model response", "error", err)
+	}
+	return completion, nil
+}
+
+// setupResponseCache puts the response cache configured by the
+// EXOREVIEWER_LLM_CACHE_* variables in front of reviewModel. A TTL of 0
+// disables it.
+func setupResponseCache() error {
+	cache := &responseCache{dir: defaultLLMCacheDir, ttl: defaultLLMCacheTTL, maxBytes: defaultLLMCacheMaxMB << 20}
+	if dir := os.Getenv("EXOREVIEWER_LLM_CACHE_DIR"); dir != "" {
+		cache.dir = dir
+	}
+	if value := os.Getenv("EXOREVIEWER_LLM_CACHE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid EXOREVIEWER_LLM_CACHE_TTL %q", value)
+		}
+		cache.ttl = ttl
+	}
+	if value := os.Getenv("EXOREVIEWER_LLM_CACHE_MAX_MB"); value != "" {
+		mb, err := strconv.Atoi(value)
+		if err != nil || mb <= 0 {
+			return fmt.Errorf("invalid EXOREVIEWER_LLM_CACHE_MAX_MB %q", value)
+		}
+		cache.maxBytes = int64(mb) << 20
+	}
+	if cache.ttl == 0 {
+		slog.Info("Model response cache disabled")
+		return nil
+	}
+	reviewModel = cachedModel{model: reviewModel, cache: cache}
+	slog.Info("Model response cache enabled", "dir", cache.dir, "ttl", cache.ttl, "max_mb", cache.maxBytes>>20)
+	return nil
+}
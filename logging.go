@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// maxLogPayload is how much of a prompt, model response or comment body a
+// log line may carry. Full bodies are kept in the job's artifacts.
+const maxLogPayload = 500
+
+// logLevel is the minimum level logged, set from EXOREVIEWER_LOG_LEVEL
+var logLevel = new(slog.LevelVar)
+
+// setupLogging installs the default logger, which the standard log package
+// also writes through. Lines go to stderr as JSON, or as text when format is
+// "text"; EXOREVIEWER_LOG_FORMAT overrides format. EXOREVIEWER_LOG_LEVEL sets
+// the minimum level (debug, info, warn or error; default info).
+func setupLogging(format string) error {
+	if level := os.Getenv("EXOREVIEWER_LOG_LEVEL"); level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("invalid EXOREVIEWER_LOG_LEVEL %q", level)
+		}
+	}
+	if f := os.Getenv("EXOREVIEWER_LOG_FORMAT"); f != "" {
+		format = f
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (want json or text)", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+type logAttrsKey struct{}
+type logJobKey struct{}
+
+// withLogAttrs returns a context whose log lines carry attrs in addition to
+// any attributes ctx already carries.
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	combined := append(append([]slog.Attr{}, existing...), attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, combined)
+}
+
+// withJobLogging tags every line logged under ctx with the job, PR and
+// repository, and lets debug payloads find the job's artifact directory.
+func withJobLogging(ctx context.Context, job *Job) context.Context {
+	ctx = withLogAttrs(ctx,
+		slog.String("job_id", job.ID),
+		slog.Int("pr_id", job.PR.ID),
+		slog.String("repo", job.PR.Repository),
+		slog.String("provider", job.PR.Provider),
+	)
+	return context.WithValue(ctx, logJobKey{}, job.ID)
+}
+
+// contextHandler adds the attributes carried by a record's context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// truncatePayload shortens a large body for logging
+func truncatePayload(s string) string {
+	if len(s) <= maxLogPayload {
+		return s
+	}
+	return s[:maxLogPayload] + fmt.Sprintf("... (%d more bytes)", len(s)-maxLogPayload)
+}
+
+// debugPayload writes a full payload to the job's artifacts at debug level.
+// Log lines only ever carry truncated payloads.
+func debugPayload(ctx context.Context, name string, data []byte) {
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	jobID, ok := ctx.Value(logJobKey{}).(string)
+	if !ok {
+		return
+	}
+	if err := writeArtifact(jobID, name, data); err != nil {
+		slog.WarnContext(ctx, "Error writing debug payload", "artifact", name, "error", err)
+		return
+	}
+	slog.DebugContext(ctx, "Wrote debug payload", "artifact", name, "bytes", len(data))
+}
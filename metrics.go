@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served on /metrics
+var (
+	webhooksReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exoreviewer_webhooks_received_total",
+		Help: "Webhook deliveries by provider, event key and outcome (accepted, ignored, rejected or error).",
+	}, []string{"provider", "event", "outcome"})
+
+	jobsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "exoreviewer_jobs_queued",
+		Help: "Review jobs waiting in the queue.",
+	})
+	jobsRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "exoreviewer_jobs_running",
+		Help: "Review jobs currently running.",
+	})
+	jobsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exoreviewer_jobs_finished_total",
+		Help: "Review jobs finished, by final status (completed, failed or cancelled).",
+	}, []string{"status"})
+
+	gitFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "exoreviewer_git_fetch_duration_seconds",
+		Help:    "Time spent cloning or pulling a repository and fetching the PR branches.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"provider"})
+
+	promptChunkTokens = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "exoreviewer_prompt_chunk_tokens",
+		Help:    "Estimated size of each review prompt chunk in tokens.",
+		Buckets: prometheus.ExponentialBuckets(64, 2, 12),
+	}, []string{"chunk"})
+
+	promptRedactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exoreviewer_prompt_redactions_total",
+		Help: "Distinct values replaced with placeholders in review prompts, by kind (secret, email, phone, person or a configured pattern).",
+	}, []string{"kind"})
+
+	llmLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "exoreviewer_llm_request_duration_seconds",
+		Help:    "Model completion latency by model backend.",
+		Buckets: []float64{1, 2.5, 5, 10, 20, 30, 60, 120},
+	}, []string{"model"})
+	llmErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exoreviewer_llm_errors_total",
+		Help: "Failed model completions by model backend.",
+	}, []string{"model"})
+	llmTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exoreviewer_llm_tokens_total",
+		Help: "Tokens consumed by model backend and kind (prompt or completion), as reported by the backend.",
+	}, []string{"model", "kind"})
+	llmCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exoreviewer_llm_cache_requests_total",
+		Help: "Model completions looked up in the response cache by model backend and result (hit, miss or bypass).",
+	}, []string{"model", "result"})
+	llmCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "exoreviewer_llm_cache_evictions_total",
+		Help: "Response cache entries evicted to stay within the size limit.",
+	})
+
+	commentsPosted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exoreviewer_comments_total",
+		Help: "Review comments by provider and result (posted or failed).",
+	}, []string{"provider", "result"})
+
+	lookupFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exoreviewer_lookup_failures_total",
+		Help: "Failed lookups of prompt context by source (jira or test_cases).",
+	}, []string{"source"})
+)
+
+// webhookEvent returns the event key of a webhook delivery from whichever
+// provider's event header it carries
+func webhookEvent(r *http.Request) string {
+	for _, header := range []string{"X-Event-Key", "X-GitHub-Event", "X-Gitlab-Event"} {
+		if event := r.Header.Get(header); event != "" {
+			return event
+		}
+	}
+	return "unknown"
+}
+
+// webhookEventLabels are the event keys the providers send that are
+// recorded as themselves; the header is client-controlled, so anything else
+// is recorded as "other"
+var webhookEventLabels = []string{
+	"pullrequest:created", "pullrequest:updated", "pullrequest:fulfilled", "pullrequest:rejected", "pullrequest:comment_created",
+	"pr:opened", "pr:from_ref_updated", "pr:modified", "pr:merged", "pr:declined", "pr:comment:added", "diagnostics:ping",
+	"pull_request", "pull_request_review", "issue_comment", "push", "ping",
+	"Merge Request Hook", "Note Hook", "Push Hook", "Pipeline Hook",
+}
+
+// webhookEventLabel is the event label for a delivery of event
+func webhookEventLabel(event string) string {
+	if slices.Contains(webhookEventLabels, event) {
+		return event
+	}
+	return "other"
+}
+
+// estimateTokens approximates the token count of s. Around four characters
+// per token holds well enough for English text and code.
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrIgnoredEvent is returned by Provider.ParseWebhook for events that should
+// be acknowledged but not reviewed.
+var ErrIgnoredEvent = errors.New("ignored event")
+
+// Reviewer is a user assigned to review a pull request
+type Reviewer struct {
+	DisplayName string `json:"display_name"`
+	UUID        string `json:"uuid"`
+}
+
+// PullRequest is the provider-neutral view of a pull/merge request that the
+// review pipeline works on.
+type PullRequest struct {
+	Provider     string
+	ID           int
+	Title        string
+	Description  string
+	Author       string
+	Repository   string // Full repository name, e.g. "workspace/repo"
+	RepoURL      string // Web URL of the repository
+	URL          string // Web URL of the pull request
+	SourceBranch string
+	DestBranch   string
+	SourceCommit string
+	DestCommit   string
+	Reviewers    []Reviewer
+
+	// GitHub only: the App installation the webhook was delivered for
+	InstallationID int64
+
+	// GitLab only: the numeric project ID and the MR's diff base commit
+	ProjectID  int
+	BaseCommit string
+}
+
+// StatusState is the provider-neutral state of a commit status check
+type StatusState string
+
+const (
+	StatusPending StatusState = "pending"
+	StatusSuccess StatusState = "success"
+	StatusFailure StatusState = "failure"
+	StatusError   StatusState = "error"
+)
+
+// statusKey identifies exoReviewer's status check on every provider
+const statusKey = "exoreviewer"
+
+// PostResult records the outcome of posting a single review comment
+type PostResult struct {
+	Comment CommentPayload
+	ID      string // Provider-assigned comment (or review) ID
+	Err     error
+}
+
+// PostedComment is a general comment already on a pull request
+type PostedComment struct {
+	ID     string
+	Text   string
+	Author string
+	// Mine reports whether exoReviewer's own user posted it
+	Mine bool
+}
+
+// Provider abstracts a source-control host: webhook parsing, repository
+// access and writing review results back to the pull request.
+type Provider interface {
+	// Name returns a short identifier such as "bitbucket" or "github"
+	Name() string
+	// ParseWebhook validates and decodes a webhook delivery. It returns
+	// ErrIgnoredEvent (possibly wrapped) for events that need no review.
+	ParseWebhook(r *http.Request, body []byte) (*PullRequest, error)
+	// CloneURL returns an authenticated git URL for the PR's repository
+	CloneURL(ctx context.Context, pr *PullRequest) (string, error)
+	// PostComment posts a single general or inline comment and returns its ID
+	PostComment(ctx context.Context, pr *PullRequest, comment CommentPayload) (string, error)
+	// SubmitReview posts all comments of a review, reporting each outcome
+	SubmitReview(ctx context.Context, pr *PullRequest, comments []CommentPayload) []PostResult
+	// SetStatus sets exoReviewer's status check on the PR's source commit
+	SetStatus(ctx context.Context, pr *PullRequest, state StatusState, description string) error
+	// ListComments returns the PR's general (non-inline) comments and who
+	// posted them
+	ListComments(ctx context.Context, pr *PullRequest) ([]PostedComment, error)
+	// EditComment replaces the text of the PR's comment id
+	EditComment(ctx context.Context, pr *PullRequest, id, text string) error
+	// RequestChanges sets or withdraws exoReviewer's request for changes on
+	// the PR. Hosts without such a review vote return errors.ErrUnsupported.
+	RequestChanges(ctx context.Context, pr *PullRequest, requested bool, reason string) error
+}
+
+// providers holds the providers main serves webhooks for, by name, so jobs
+// can be re-run through the provider that accepted them
+var providers = make(map[string]Provider)
+
+// httpClient is shared by all outbound API calls made by providers
+var httpClient = &http.Client{
+	Timeout:   60 * time.Second,
+	Transport: otelhttp.NewTransport(recordingTransport{next: http.DefaultTransport}),
+}
+
+// APIError is returned when a provider API responds with a non-2xx status
+type APIError struct {
+	Service    string
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	body := e.Body
+	if len(body) > 512 {
+		body = body[:512] + "..."
+	}
+	return fmt.Sprintf("%s API returned status %d for %s %s: %s", e.Service, e.StatusCode, e.Method, e.URL, body)
+}
+
+// sendJSON sends body (if non-nil) as JSON and decodes the JSON response into
+// out (if non-nil). Non-2xx responses are returned as *APIError.
+func sendJSON(ctx context.Context, service, method, url string, headers map[string]string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal payload: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		return &APIError{
+			Service:    service,
+			Method:     method,
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Body:       string(respBody),
+		}
+	}
+
+	if out != nil && len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return nil
+}
+
+// postEach submits comments one at a time through PostComment. It is the
+// SubmitReview strategy for providers without a batch review API.
+func postEach(ctx context.Context, p Provider, pr *PullRequest, comments []CommentPayload) []PostResult {
+	results := make([]PostResult, 0, len(comments))
+	for _, comment := range comments {
+		id, err := postCommentTraced(ctx, p, pr, comment)
+		results = append(results, PostResult{Comment: comment, ID: id, Err: err})
+	}
+	return results
+}
+
+// postCommentTraced posts comment through p in its own span
+func postCommentTraced(ctx context.Context, p Provider, pr *PullRequest, comment CommentPayload) (string, error) {
+	ctx, span := tracer.Start(ctx, "post comment")
+	if comment.Inline != nil {
+		span.SetAttributes(
+			attribute.String("comment.path", comment.Inline.Path),
+			attribute.Int("comment.line", commentLine(comment.Inline)),
+		)
+	}
+	id, err := p.PostComment(ctx, pr, comment)
+	span.SetAttributes(attribute.String("comment.id", id))
+	endSpan(span, err)
+	return id, err
+}
+
+// truncate shortens s to at most n bytes, marking the cut with "..."
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	if n <= 3 {
+		return s[:n]
+	}
+	return s[:n-3] + "..."
+}
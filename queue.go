@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Queue states of a job that hasn't finished yet
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+)
+
+// queuedJob is a review waiting for, or being run by, the queue's worker
+type queuedJob struct {
+	job      *Job
+	provider Provider
+	ctx      context.Context
+	cancel   context.CancelFunc
+	rec      *recorder
+	state    string
+	done     chan struct{}
+}
+
+// jobQueue runs reviews one at a time, in the order they were accepted.
+// Reviews of the same repository share a clone, so they must not overlap.
+type jobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*queuedJob
+	active  map[string]*queuedJob
+	once    sync.Once
+}
+
+// reviewQueue runs every review accepted by the webhook handlers and the
+// dashboard, once the server (or a replay) starts it
+var reviewQueue = newJobQueue()
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{active: make(map[string]*queuedJob)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// start runs the queue's worker. Later calls do nothing.
+func (q *jobQueue) start() {
+	q.once.Do(func() { go q.worker() })
+}
+
+// enqueue schedules job to be reviewed through p. ctx carries request-scoped
+// values such as the recorder; its cancellation is not inherited, so the
+// review outlives the webhook request that triggered it.
+func (q *jobQueue) enqueue(ctx context.Context, p Provider, job *Job, rec *recorder) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	qj := &queuedJob{
+		job:      job,
+		provider: p,
+		ctx:      ctx,
+		cancel:   cancel,
+		rec:      rec,
+		state:    jobQueued,
+		done:     make(chan struct{}),
+	}
+
+	job.Status = jobQueued
+	if err := saveJob(job); err != nil {
+		slog.WarnContext(ctx, "Error saving job", "error", err)
+	}
+	if err := reviewHistory.saveReview(job); err != nil {
+		slog.WarnContext(ctx, "Error saving review history", "error", err)
+	}
+
+	q.mu.Lock()
+	q.pending = append(q.pending, qj)
+	q.active[job.ID] = qj
+	position := len(q.pending)
+	q.mu.Unlock()
+	jobsQueued.Inc()
+	q.cond.Signal()
+
+	slog.InfoContext(ctx, "Queued job", "position", position)
+}
+
+func (q *jobQueue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		qj := q.pending[0]
+		q.pending = q.pending[1:]
+		qj.state = jobRunning
+		q.mu.Unlock()
+		jobsQueued.Dec()
+		jobsRunning.Inc()
+
+		q.run(qj)
+	}
+}
+
+func (q *jobQueue) run(qj *queuedJob) {
+	job := qj.job
+	// qj.ctx carries the webhook's span, so the job's trace continues it
+	ctx, span := tracer.Start(qj.ctx, "review job", trace.WithAttributes(prAttributes(job.PR)...))
+	span.SetAttributes(
+		attribute.String("job.id", job.ID),
+		attribute.Bool("job.dry_run", job.DryRun),
+		attribute.Int64("job.queue_wait_ms", time.Since(job.CreatedAt).Milliseconds()),
+	)
+	err := reviewRecovered(ctx, qj.provider, job)
+	if err != nil {
+		slog.ErrorContext(ctx, "Review failed", "status", job.Status, "error", err)
+	}
+	span.SetAttributes(attribute.String("job.status", job.Status))
+	endSpan(span, err)
+	jobsRunning.Dec()
+
+	if qj.rec != nil {
+		fixtureDir := filepath.Join(os.Getenv("EXOREVIEWER_RECORD_DIR"), job.ID)
+		if err := qj.rec.save(ctx, fixtureDir); err != nil {
+			slog.WarnContext(ctx, "Error saving fixture", "error", err)
+		} else {
+			slog.InfoContext(ctx, "Recorded fixture", "dir", fixtureDir)
+		}
+	}
+
+	q.finish(qj)
+}
+
+// reviewRecovered runs reviewPullRequest, failing the job if it panics so the
+// worker can carry on with the next one
+func reviewRecovered(ctx context.Context, p Provider, job *Job) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = reportPanic(ctx, v, job.PR)
+			job.Status = "failed"
+			job.Error = err.Error()
+			finished := time.Now()
+			job.FinishedAt = &finished
+			if saveErr := saveJob(job); saveErr != nil {
+				slog.WarnContext(ctx, "Error saving job", "error", saveErr)
+			}
+			if saveErr := reviewHistory.saveReview(job); saveErr != nil {
+				slog.WarnContext(ctx, "Error saving review history", "error", saveErr)
+			}
+			if !job.DryRun {
+				if statusErr := p.SetStatus(ctx, job.PR, StatusError, "Review failed"); statusErr != nil {
+					slog.WarnContext(ctx, "Error setting error status", "error", statusErr)
+				}
+			}
+		}
+	}()
+	return reviewPullRequest(ctx, p, job)
+}
+
+func (q *jobQueue) finish(qj *queuedJob) {
+	q.mu.Lock()
+	delete(q.active, qj.job.ID)
+	q.mu.Unlock()
+	jobsFinished.WithLabelValues(qj.job.Status).Inc()
+	qj.cancel()
+	close(qj.done)
+}
+
+// cancel stops a job. A queued job is dropped before it starts; a running
+// job has its context cancelled, which aborts its in-flight requests.
+func (q *jobQueue) cancel(id string) error {
+	q.mu.Lock()
+	qj, ok := q.active[id]
+	if !ok {
+		q.mu.Unlock()
+		return fmt.Errorf("job %s is not queued or running", id)
+	}
+	if qj.state == jobRunning {
+		q.mu.Unlock()
+		slog.InfoContext(qj.ctx, "Cancelling running job")
+		qj.cancel()
+		return nil
+	}
+	for i, pending := range q.pending {
+		if pending == qj {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	q.mu.Unlock()
+	jobsQueued.Dec()
+
+	slog.InfoContext(qj.ctx, "Cancelled queued job")
+	job := qj.job
+	job.Status = "cancelled"
+	finished := time.Now()
+	job.FinishedAt = &finished
+	if err := saveJob(job); err != nil {
+		slog.WarnContext(qj.ctx, "Error saving job", "error", err)
+	}
+	if err := reviewHistory.saveReview(job); err != nil {
+		slog.WarnContext(qj.ctx, "Error saving review history", "error", err)
+	}
+	q.finish(qj)
+	return nil
+}
+
+// state returns the queue state of job id, or "" once it has finished
+func (q *jobQueue) state(id string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if qj, ok := q.active[id]; ok {
+		return qj.state
+	}
+	return ""
+}
+
+// wait blocks until job id has finished
+func (q *jobQueue) wait(id string) {
+	q.mu.Lock()
+	qj, ok := q.active[id]
+	q.mu.Unlock()
+	if ok {
+		<-qj.done
+	}
+}
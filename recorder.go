@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Fixture file names written by the recorder and read by replay
+const (
+	fixtureWebhook = "webhook.json"
+	fixtureHTTP    = "http.json"
+	fixtureModel   = "model.json"
+	fixtureRepo    = "repo.bundle"
+	fixtureGolden  = "golden.json"
+	// Optional, written by hand: the repository config and fake Jira tickets
+	fixtureConfig = "config.json"
+	fixtureJira   = "jira.json"
+)
+
+// redactedHeaders are webhook headers whose values are secrets
+var redactedHeaders = []string{"Authorization", "X-Gitlab-Token"}
+
+type recordedWebhook struct {
+	Provider    string            `json:"provider"`
+	APIBasePath string            `json:"api_base_path"`
+	Method      string            `json:"method"`
+	Query       string            `json:"query,omitempty"`
+	Headers     map[string]string `json:"headers"`
+	Body        string            `json:"body"`
+}
+
+type recordedExchange struct {
+	Method       string `json:"method"`
+	Path         string `json:"path"`
+	RequestBody  string `json:"request_body,omitempty"`
+	Status       int    `json:"status"`
+	ResponseBody string `json:"response_body"`
+}
+
+// recorder captures a webhook delivery together with the provider API
+// exchanges, model responses and repository state of the review it
+// triggers, so the review can later be replayed offline.
+type recorder struct {
+	mu             sync.Mutex
+	webhook        recordedWebhook
+	exchanges      []recordedExchange
+	modelResponses []string
+	repoDir        string
+	branches       []string
+}
+
+type recorderKey struct{}
+
+func newRecorder(p Provider, r *http.Request, body []byte) *recorder {
+	headers := make(map[string]string)
+	for name := range r.Header {
+		headers[name] = r.Header.Get(name)
+	}
+	for _, name := range redactedHeaders {
+		if _, ok := headers[http.CanonicalHeaderKey(name)]; ok {
+			headers[http.CanonicalHeaderKey(name)] = "REDACTED"
+		}
+	}
+	return &recorder{
+		webhook: recordedWebhook{
+			Provider:    p.Name(),
+			APIBasePath: apiBasePath(p),
+			Method:      r.Method,
+			Query:       r.URL.RawQuery,
+			Headers:     headers,
+			Body:        string(body),
+		},
+	}
+}
+
+// apiBasePath returns the path prefix of p's API base URL, which replays
+// must serve the recorded exchanges under.
+func apiBasePath(p Provider) string {
+	var base string
+	switch p := p.(type) {
+	case bundleProvider:
+		return apiBasePath(p.Provider)
+	case *BitbucketCloudProvider:
+		base = p.APIURL
+	case *GitHubProvider:
+		base = p.APIURL
+	case *GitLabProvider:
+		base = p.BaseURL
+	case *BitbucketServerProvider:
+		base = p.BaseURL
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+func withRecorder(ctx context.Context, rec *recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, rec)
+}
+
+// recorderFrom returns the recorder attached to ctx, or nil. All recorder
+// methods are no-ops on a nil recorder.
+func recorderFrom(ctx context.Context) *recorder {
+	rec, _ := ctx.Value(recorderKey{}).(*recorder)
+	return rec
+}
+
+func (rec *recorder) recordExchange(ex recordedExchange) {
+	if rec == nil {
+		return
+	}
+	// Installation tokens are live credentials; replays accept any token
+	if strings.HasSuffix(ex.Path, "/access_tokens") {
+		ex.ResponseBody = `{"token":"recorded-token","expires_at":"2099-01-01T00:00:00Z"}`
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.exchanges = append(rec.exchanges, ex)
+}
+
+func (rec *recorder) recordModelResponse(response string) {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.modelResponses = append(rec.modelResponses, response)
+}
+
+// recordRepo notes the clone and branches to bundle when the fixture is saved
+func (rec *recorder) recordRepo(repoDir string, branches ...string) {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.repoDir = repoDir
+	rec.branches = branches
+}
+
+// save writes the fixture files into dir
+func (rec *recorder) save(ctx context.Context, dir string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files := map[string]interface{}{
+		fixtureWebhook: rec.webhook,
+		fixtureHTTP:    rec.exchanges,
+		fixtureModel:   rec.modelResponses,
+	}
+	for name, v := range files {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	if rec.repoDir == "" {
+		return nil
+	}
+	return bundleBranches(ctx, rec.repoDir, filepath.Join(dir, fixtureRepo), rec.branches)
+}
+
+// bundleBranches writes a git bundle of the clone's origin/<branch> refs as
+// plain branches, so the bundle can be cloned and fetched from like the
+// original remote. The last branch becomes the bundle's HEAD.
+func bundleBranches(ctx context.Context, repoDir, bundlePath string, branches []string) error {
+	tmp, err := os.MkdirTemp("", "exoreviewer-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if output, err := runGitCommand(ctx, "", "git", "init", "--bare", "-q", tmp); err != nil {
+		return fmt.Errorf("git init failed: %v\n%s", err, output)
+	}
+	args := []string{"push", "-q", tmp}
+	for _, branch := range branches {
+		args = append(args, fmt.Sprintf("refs/remotes/origin/%s:refs/heads/%s", branch, branch))
+	}
+	if output, err := runGitCommand(ctx, repoDir, "git", args...); err != nil {
+		return fmt.Errorf("git push failed: %v\n%s", err, output)
+	}
+	if len(branches) > 0 {
+		head := "refs/heads/" + branches[len(branches)-1]
+		if output, err := runGitCommand(ctx, tmp, "git", "symbolic-ref", "HEAD", head); err != nil {
+			return fmt.Errorf("git symbolic-ref failed: %v\n%s", err, output)
+		}
+	}
+	absBundle, err := filepath.Abs(bundlePath)
+	if err != nil {
+		return err
+	}
+	if output, err := runGitCommand(ctx, tmp, "git", "bundle", "create", "-q", absBundle, "--all"); err != nil {
+		return fmt.Errorf("git bundle failed: %v\n%s", err, output)
+	}
+	return nil
+}
+
+// recordingTransport copies provider API exchanges into the recorder carried
+// by the request's context, if any.
+type recordingTransport struct {
+	next http.RoundTripper
+}
+
+func (t recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := recorderFrom(req.Context())
+	if rec == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	var reqBody []byte
+	if req.Body != nil {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = data
+		req.Body = io.NopCloser(bytes.NewReader(data))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	rec.recordExchange(recordedExchange{
+		Method:       req.Method,
+		Path:         req.URL.RequestURI(),
+		RequestBody:  string(reqBody),
+		Status:       resp.StatusCode,
+		ResponseBody: string(respBody),
+	})
+	return resp, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// piiPatterns are the built-in patterns RedactionConfig.PII can name
+var piiPatterns = map[string]*regexp.Regexp{
+	"email": regexp.MustCompile(`\b[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}\b`),
+	// International numbers, numbers written with spaces or hyphens, and
+	// Indian mobile numbers. Dots don't separate, so IP addresses and
+	// version numbers don't match.
+	"phone": regexp.MustCompile(`\+\d{1,3}[ .\-]?\(?\d{2,5}\)?[ .\-]?\d{3,5}(?:[ .\-]?\d{1,5})?\b|\b\(?0?\d{2,5}\)?[ \-]\d{3,5}[ \-]\d{3,5}\b|\b0?[6-9]\d{9}\b`),
+}
+
+// prosePII are the piiPatterns loose enough to match values code is full of,
+// such as number triples; they skip the codeChunks
+var prosePII = map[string]bool{"phone": true}
+
+// codeChunks are the prompt chunks that hold code
+var codeChunks = []string{"CODE CONTEXT", "GIT DIFF", "COMPLETE FILES"}
+
+// defaultDenyPaths are files whose contents never go into the prompt
+var defaultDenyPaths = []string{".env", ".env.*", "*.pem", "*.key", "*.p12", "*.pfx", "*.jks", "id_rsa", "id_ed25519"}
+
+// placeholderPattern matches the placeholders a Redactor writes
+var placeholderPattern = regexp.MustCompile(`\[([A-Z][A-Z0-9_]*)_(\d+)\]`)
+
+// matchesPathPattern reports whether file matches one of patterns. A pattern
+// matches a file's whole path or, without a /, its base name, and dir/**
+// matches everything under dir.
+func matchesPathPattern(file string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if dir, ok := strings.CutSuffix(pattern, "/**"); ok && strings.HasPrefix(file, dir+"/") {
+			return true
+		}
+		if ok, _ := path.Match(pattern, file); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(file)); ok && !strings.Contains(pattern, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// denied reports whether file's contents must be kept out of the prompt
+func (c RedactionConfig) denied(file string) bool {
+	return matchesPathPattern(file, defaultDenyPaths) || matchesPathPattern(file, c.Deny)
+}
+
+// withholdDenied replaces the sections of a git diff for denied files with
+// a note, keeping their headers
+func withholdDenied(diff string, denied func(string) bool) string {
+	var b strings.Builder
+	skipping := false
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		if rest, ok := strings.CutPrefix(line, "diff --git a/"); ok {
+			file := strings.TrimSpace(rest)
+			if i := strings.Index(file, " b/"); i >= 0 {
+				file = file[i+3:]
+			}
+			skipping = denied(file)
+			b.WriteString(line)
+			if skipping {
+				b.WriteString("# Contents withheld: the file is on the redaction deny list\n")
+			}
+			continue
+		}
+		if !skipping {
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// redactionPattern is a kind of value to replace, such as EMAIL
+type redactionPattern struct {
+	kind      string
+	pattern   *regexp.Regexp
+	proseOnly bool
+}
+
+// Redactor replaces sensitive values in a prompt with placeholders such as
+// [EMAIL_1], the same value always getting the same placeholder. It keeps
+// the mapping so placeholders in the model's comments can be shown as the
+// original values; secrets are only ever shown masked. A Redactor lives for
+// one review and is never persisted.
+type Redactor struct {
+	patterns []redactionPattern
+	secrets  []SecretFinding
+	authors  bool
+	names    []string
+	// placeholders maps values to their placeholders, shown maps
+	// placeholders to what replaces them in comments
+	placeholders map[string]string
+	shown        map[string]string
+	counts       map[string]int
+}
+
+// newRedactor builds the redaction stage for a review. secrets are the
+// scanner's findings; every secret signature is also applied to the whole
+// prompt, since complete files can hold credentials the diff doesn't touch.
+// names, such as the PR author, are replaced when cfg.Authors is set, along
+// with the commit authors the prompt lists.
+func newRedactor(cfg RedactionConfig, secrets []SecretFinding, names ...string) *Redactor {
+	r := &Redactor{
+		secrets:      secrets,
+		placeholders: make(map[string]string),
+		shown:        make(map[string]string),
+		counts:       make(map[string]int),
+	}
+	for _, sig := range secretSignatures {
+		r.patterns = append(r.patterns, redactionPattern{kind: "SECRET", pattern: sig.pattern})
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Patterns)) {
+		r.patterns = append(r.patterns, redactionPattern{kind: strings.ToUpper(name), pattern: regexp.MustCompile(cfg.Patterns[name])})
+	}
+	for _, name := range cfg.PII {
+		r.patterns = append(r.patterns, redactionPattern{kind: strings.ToUpper(name), pattern: piiPatterns[name], proseOnly: prosePII[name]})
+	}
+	if r.authors = cfg.Authors; r.authors {
+		for _, name := range names {
+			// Very short names would replace parts of words
+			if name = strings.TrimSpace(name); len(name) >= 3 && !slices.Contains(r.names, name) {
+				r.names = append(r.names, name)
+			}
+		}
+	}
+	return r
+}
+
+// placeholder returns the placeholder for value, shown in comments as shown
+func (r *Redactor) placeholder(kind, value, shown string) string {
+	if p, ok := r.placeholders[value]; ok {
+		return p
+	}
+	r.counts[kind]++
+	p := fmt.Sprintf("[%s_%d]", kind, r.counts[kind])
+	r.placeholders[value] = p
+	r.shown[p] = shown
+	return p
+}
+
+// Redact replaces the sensitive values in each chunk of prompt and logs what
+// it replaced, by chunk
+func (r *Redactor) Redact(ctx context.Context, prompt string) string {
+	chunks := strings.Split(prompt, chunkSeparator)
+	for i, chunk := range chunks {
+		before := len(r.placeholders)
+		chunks[i] = r.redactChunk(chunk)
+		if n := len(r.placeholders) - before; n > 0 {
+			slog.DebugContext(ctx, "Redacted prompt chunk", "chunk", chunkTitle(chunk), "new_values", n)
+		}
+	}
+	if len(r.placeholders) > 0 {
+		kinds := make([]any, 0, 2*len(r.counts))
+		for _, kind := range slices.Sorted(maps.Keys(r.counts)) {
+			kinds = append(kinds, strings.ToLower(kind), r.counts[kind])
+			promptRedactions.WithLabelValues(strings.ToLower(kind)).Add(float64(r.counts[kind]))
+		}
+		slog.InfoContext(ctx, "Redacted prompt", kinds...)
+	}
+	return strings.Join(chunks, chunkSeparator)
+}
+
+func (r *Redactor) redactChunk(chunk string) string {
+	// The scanner's findings go first: they include values no signature
+	// matches, such as high-entropy strings and private key bodies
+	for _, f := range r.secrets {
+		if strings.Contains(chunk, f.Value) {
+			chunk = strings.ReplaceAll(chunk, f.Value, r.placeholder("SECRET", f.Value, f.masked()))
+		}
+	}
+	code := slices.Contains(codeChunks, chunkTitle(chunk))
+	for _, p := range r.patterns {
+		if p.proseOnly && code {
+			continue
+		}
+		chunk = p.pattern.ReplaceAllStringFunc(chunk, func(value string) string {
+			if placeholderPattern.MatchString(value) {
+				return value
+			}
+			shown := value
+			if p.kind == "SECRET" {
+				shown = SecretFinding{Value: value}.masked()
+			}
+			return r.placeholder(p.kind, value, shown)
+		})
+	}
+	if strings.HasPrefix(strings.TrimSpace(chunk), "### CHUNK: COMMIT HISTORY") {
+		chunk = r.redactCommitAuthors(chunk)
+	}
+	for _, name := range r.names {
+		chunk = strings.ReplaceAll(chunk, name, r.placeholder("PERSON", name, name))
+	}
+	return chunk
+}
+
+// redactCommitAuthors replaces the author of each "* message (date) by
+// author" line of the COMMIT HISTORY chunk, when authors are redacted
+func (r *Redactor) redactCommitAuthors(chunk string) string {
+	if !r.authors {
+		return chunk
+	}
+	lines := strings.Split(chunk, "\n")
+	for i, line := range lines {
+		at := strings.LastIndex(line, ") by ")
+		if !strings.HasPrefix(line, "* ") || at < 0 {
+			continue
+		}
+		author := line[at+len(") by "):]
+		if author != "" && !placeholderPattern.MatchString(author) {
+			lines[i] = line[:at+len(") by ")] + r.placeholder("PERSON", author, author)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Restore replaces the placeholders in text with what they stand for
+func (r *Redactor) Restore(text string) string {
+	if r == nil {
+		return text
+	}
+	return placeholderPattern.ReplaceAllStringFunc(text, func(p string) string {
+		if shown, ok := r.shown[p]; ok {
+			return shown
+		}
+		return p
+	})
+}
+
+// RestoreComments restores the placeholders in the model's comments
+func (r *Redactor) RestoreComments(comments []CommentPayload) []CommentPayload {
+	for i := range comments {
+		comments[i].Content.Raw = r.Restore(comments[i].Content.Raw)
+	}
+	return comments
+}
+
+// promptNames are the people named in pr's prompt
+func promptNames(pr *PullRequest) []string {
+	names := []string{pr.Author}
+	for _, reviewer := range pr.Reviewers {
+		names = append(names, reviewer.DisplayName)
+	}
+	return names
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// replayedRequest is a write request the pipeline made during a replay.
+// The list of them is what golden files pin down.
+type replayedRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Body   interface{} `json:"body,omitempty"`
+}
+
+type replayResult struct {
+	WebhookStatus int               `json:"webhook_status"`
+	Requests      []replayedRequest `json:"requests"`
+	// JiraComments and JiraRemoteLinks are what the fake Jira client of a
+	// fixture with a jira.json recorded
+	JiraComments    []fakeJiraComment `json:"jira_comments,omitempty"`
+	JiraRemoteLinks []fakeJiraLink    `json:"jira_remote_links,omitempty"`
+}
+
+// fakeAPI serves a fixture's recorded provider API exchanges and records
+// every write request made against it.
+type fakeAPI struct {
+	mu        sync.Mutex
+	exchanges []recordedExchange
+	used      []bool
+	requests  []replayedRequest
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	path := r.URL.RequestURI()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Method != http.MethodGet {
+		f.requests = append(f.requests, replayedRequest{Method: r.Method, Path: path, Body: normalizeBody(body)})
+	}
+
+	for i, ex := range f.exchanges {
+		if !f.used[i] && ex.Method == r.Method && ex.Path == path {
+			f.used[i] = true
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(ex.Status)
+			io.WriteString(w, ex.ResponseBody)
+			return
+		}
+	}
+	log.Printf("Replay: no recorded response for %s %s", r.Method, path)
+	http.Error(w, `{"error":"no recorded response"}`, http.StatusNotFound)
+}
+
+// normalizeBody decodes JSON bodies so golden files compare them
+// structurally; other bodies are kept as strings.
+func normalizeBody(body []byte) interface{} {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return string(body)
+	}
+	return v
+}
+
+// bundleProvider serves the repository from a fixture's git bundle instead
+// of the provider's remote.
+type bundleProvider struct {
+	Provider
+	bundle string
+}
+
+func (b bundleProvider) CloneURL(ctx context.Context, pr *PullRequest) (string, error) {
+	return b.bundle, nil
+}
+
+// replaySecret is the webhook secret of replayed providers. Recorded
+// deliveries are signed again with it, since their signatures were made with
+// the real secret.
+const replaySecret = "replay"
+
+// replayProviderFor builds a provider named name whose API is served at
+// baseURL, with throwaway credentials.
+func replayProviderFor(name, baseURL string) (Provider, error) {
+	switch name {
+	case "bitbucket":
+		return &BitbucketCloudProvider{Username: "replay", AppPassword: "replay", APIURL: baseURL, WebhookSecret: replaySecret}, nil
+	case "github":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return &GitHubProvider{AppID: "replay", PrivateKey: key, WebhookSecret: replaySecret, APIURL: baseURL, tokens: make(map[int64]githubToken)}, nil
+	case "gitlab":
+		return &GitLabProvider{BaseURL: baseURL, Token: "replay", WebhookSecret: replaySecret}, nil
+	case "bitbucket-server":
+		return &BitbucketServerProvider{BaseURL: baseURL, Username: "replay", Token: "replay", WebhookSecret: replaySecret}, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q", name)
+}
+
+func readFixtureJSON(dir, name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return nil
+}
+
+// replayFixture runs the webhook pipeline end-to-end against the fixture in
+// dir, using a fake provider API and the recorded model responses. It runs
+// inside workDir so prompts and artifacts don't leak into the caller's tree.
+func replayFixture(dir, workDir string) (replayResult, error) {
+	var result replayResult
+
+	var webhook recordedWebhook
+	if err := readFixtureJSON(dir, fixtureWebhook, &webhook); err != nil {
+		return result, err
+	}
+	var exchanges []recordedExchange
+	if err := readFixtureJSON(dir, fixtureHTTP, &exchanges); err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	var responses []string
+	if err := readFixtureJSON(dir, fixtureModel, &responses); err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+
+	api := &fakeAPI{exchanges: exchanges, used: make([]bool, len(exchanges))}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	provider, err := replayProviderFor(webhook.Provider, server.URL+webhook.APIBasePath)
+	if err != nil {
+		return result, err
+	}
+	provider = bundleProvider{Provider: provider, bundle: filepath.Join(dir, fixtureRepo)}
+
+	previousModel := reviewModel
+	reviewModel = &replayModel{responses: responses}
+	defer func() { reviewModel = previousModel }()
+
+	// A fixture may bring its own repository config; the default is empty
+	config, err := loadConfig(filepath.Join(dir, fixtureConfig))
+	if err != nil {
+		return result, err
+	}
+	previousConfig := appConfig
+	appConfig = config
+	defer func() { appConfig = previousConfig }()
+
+	// and a fake Jira, which is copied so the fixture's file stays as is
+	jiraFile := ""
+	if data, err := os.ReadFile(filepath.Join(dir, fixtureJira)); err == nil {
+		jiraFile = filepath.Join(workDir, fixtureJira)
+		if err := os.WriteFile(jiraFile, data, 0644); err != nil {
+			return result, err
+		}
+	} else if !os.IsNotExist(err) {
+		return result, err
+	}
+	os.Setenv("JIRA_FAKE_FILE", jiraFile)
+	defer os.Unsetenv("JIRA_FAKE_FILE")
+
+	previousDir, err := os.Getwd()
+	if err != nil {
+		return result, err
+	}
+	if err := os.Chdir(workDir); err != nil {
+		return result, err
+	}
+	defer os.Chdir(previousDir)
+	os.Setenv("REPOS_DIR", filepath.Join(workDir, "repos"))
+
+	target := "/webhook"
+	if webhook.Query != "" {
+		target += "?" + webhook.Query
+	}
+	req := httptest.NewRequest(webhook.Method, target, strings.NewReader(webhook.Body))
+	for name, value := range webhook.Headers {
+		req.Header.Set(name, value)
+	}
+	mac := hmac.New(sha256.New, []byte(replaySecret))
+	mac.Write([]byte(webhook.Body))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	switch webhook.Provider {
+	case "github":
+		req.Header.Set("X-Hub-Signature-256", signature)
+	case "bitbucket", "bitbucket-server":
+		req.Header.Set("X-Hub-Signature", signature)
+	case "gitlab":
+		req.Header.Set("X-Gitlab-Token", replaySecret)
+	}
+	rr := httptest.NewRecorder()
+	webhookHandler(provider)(rr, req)
+	if jobID := rr.Header().Get("X-Exoreviewer-Job-Id"); jobID != "" {
+		reviewQueue.wait(jobID)
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	result.WebhookStatus = rr.Code
+	result.Requests = append([]replayedRequest{}, api.requests...)
+
+	if jiraFile != "" {
+		var jira fakeJiraData
+		if err := readFixtureJSON(workDir, fixtureJira, &jira); err != nil {
+			return result, err
+		}
+		result.JiraComments = jira.Comments
+		result.JiraRemoteLinks = jira.RemoteLinks
+	}
+	return result, nil
+}
+
+// runReplayCommand implements `exoreviewer replay [-update] <fixture-dir>...`.
+// Each fixture is replayed and its write requests are compared against the
+// fixture's golden.json; -update rewrites the golden files instead.
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	update := fs.Bool("update", false, "rewrite golden files with the replayed requests")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: exoreviewer replay [-update] <fixture-dir>...")
+	}
+
+	// Replays must never record or post for real
+	os.Unsetenv("EXOREVIEWER_RECORD_DIR")
+	os.Unsetenv("JIRA_BASE_URL")
+	reviewQueue.start()
+
+	failed := 0
+	for _, arg := range fs.Args() {
+		dir, err := filepath.Abs(arg)
+		if err != nil {
+			return err
+		}
+		ok, err := replayAndCompare(dir, *update)
+		switch {
+		case err != nil:
+			fmt.Printf("ERROR %s: %v\n", arg, err)
+			failed++
+		case !ok:
+			fmt.Printf("FAIL  %s\n", arg)
+			failed++
+		case *update:
+			fmt.Printf("UPDATED %s\n", arg)
+		default:
+			fmt.Printf("PASS  %s\n", arg)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d fixtures failed", failed, fs.NArg())
+	}
+	return nil
+}
+
+func replayAndCompare(dir string, update bool) (bool, error) {
+	workDir, err := os.MkdirTemp("", "exoreviewer-replay")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(workDir)
+
+	result, err := replayFixture(dir, workDir)
+	if err != nil {
+		return false, err
+	}
+	actual, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	actual = append(actual, '\n')
+
+	goldenPath := filepath.Join(dir, fixtureGolden)
+	if update {
+		return true, os.WriteFile(goldenPath, actual, 0644)
+	}
+
+	expected, err := os.ReadFile(goldenPath)
+	if err != nil {
+		return false, fmt.Errorf("no golden file (run with -update to create it): %v", err)
+	}
+	if bytes.Equal(expected, actual) {
+		return true, nil
+	}
+	fmt.Print(lineDiff(string(expected), string(actual)))
+	return false, nil
+}
+
+// lineDiff renders a minimal line-based diff of want and got, prefixing
+// removed lines with "-" and added lines with "+".
+func lineDiff(want, got string) string {
+	a := strings.Split(want, "\n")
+	b := strings.Split(got, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:], b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			out.WriteString("+ " + b[j] + "\n")
+			j++
+		default:
+			out.WriteString("- " + a[i] + "\n")
+			i++
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"syscall"
+)
+
+// sandboxSystemPaths are the host paths a jail sees, read-only, besides the
+// ones a command asks for
+var sandboxSystemPaths = []string{
+	"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64",
+	"/etc/alternatives", "/etc/ssl", "/etc/ca-certificates", "/etc/ld.so.cache",
+	"/etc/passwd", "/etc/group", "/etc/nsswitch.conf", "/etc/localtime",
+}
+
+// sandboxCommand runs name in dir inside a bubblewrap jail, within limits.
+// The jail has its own mount, user, PID and network namespaces. It sees the
+// system directories and paths.ReadOnly read-only, dir and paths.Writable
+// read-write and a private /tmp, and nothing else of the host: not the
+// clones, the service's config or its home directory. prlimit caps its CPU
+// time and address space, and the whole process group is killed when ctx is
+// done.
+func sandboxCommand(ctx context.Context, dir string, limits sandboxLimits, paths sandboxPaths, name string, args ...string) (*exec.Cmd, error) {
+	for _, tool := range []string{"bwrap", "prlimit"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, fmt.Errorf("sandboxed runs need %s: %w", tool, err)
+		}
+	}
+	binary, err := exec.LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	argv := []string{
+		fmt.Sprintf("--cpu=%d", limits.CPUSeconds),
+		fmt.Sprintf("--as=%d", int64(limits.MemoryMB)<<20),
+		"--", "bwrap", "--unshare-all", "--die-with-parent", "--new-session",
+		"--proc", "/proc", "--dev", "/dev", "--tmpfs", "/tmp",
+	}
+	for _, path := range slices.Concat(sandboxSystemPaths, paths.ReadOnly, []string{filepath.Dir(binary)}) {
+		argv = append(argv, "--ro-bind-try", path, path)
+	}
+	for _, path := range paths.Writable {
+		argv = append(argv, "--bind", path, path)
+	}
+	argv = append(argv, "--bind", dir, dir, "--chdir", dir, "--", binary)
+	cmd := exec.CommandContext(ctx, "prlimit", append(argv, args...)...)
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd, nil
+}
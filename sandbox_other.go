@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+func sandboxCommand(ctx context.Context, dir string, limits sandboxLimits, paths sandboxPaths, name string, args ...string) (*exec.Cmd, error) {
+	return nil, errors.New("sandboxed test runs are only supported on Linux")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// allowSecretMarker on a line stops the scanner reporting it
+const allowSecretMarker = "exoreviewer:allow-secret"
+
+// secretSignature recognises one kind of credential. The value is the first
+// submatch if there is one, or the whole match.
+type secretSignature struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+var secretSignatures = []secretSignature{
+	{"Bitbucket app password", regexp.MustCompile(`\bATBB[A-Za-z0-9_=.\-]{28,}`)},
+	{"Atlassian API token", regexp.MustCompile(`\bATATT[A-Za-z0-9_=.\-]{60,}`)},
+	{"AWS access key ID", regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA)[A-Z0-9]{16}\b`)},
+	{"AWS secret access key", regexp.MustCompile(`(?i)aws.{0,20}?(?:secret|sk).{0,20}?['"=:\s]([A-Za-z0-9/+]{40})\b`)},
+	{"GCP service account key ID", regexp.MustCompile(`"private_key_id"\s*:\s*"([a-f0-9]{40})"`)},
+	{"GCP API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"JSON Web Token", regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]{10,}\.eyJ[A-Za-z0-9_\-]{10,}\.[A-Za-z0-9_\-]{10,}`)},
+	// A key on one line, as in service account JSON, matches whole; otherwise
+	// the lines up to the END marker are collected separately
+	{"private key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----(?:[^"'\x60]*?-----END [A-Z ]*PRIVATE KEY-----)?`)},
+}
+
+var (
+	privateKeyBegin = regexp.MustCompile(`^-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+	privateKeyEnd   = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY-----`)
+	// secretCandidate is a quoted string or an assigned value, the places a
+	// hard-coded credential turns up
+	secretCandidate = regexp.MustCompile(`["'\x60]([^"'\x60\s]{20,})["'\x60]|[:=]\s*([A-Za-z0-9+/=_\-.]{20,})`)
+	hexString       = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+	tokenString     = regexp.MustCompile(`^[A-Za-z0-9+/=_\-.~]+$`)
+)
+
+// defaultSecretAllowPaths are files full of hashes that aren't secrets
+var defaultSecretAllowPaths = []string{"go.sum", "*.lock", "package-lock.json", "pnpm-lock.yaml", "*.svg"}
+
+// SecretFinding is a credential on an added line
+type SecretFinding struct {
+	Rule string
+	Path string
+	Line int
+	// Value is the credential itself. It is never logged, posted or sent to
+	// the model.
+	Value string
+	// continuation marks the later lines of a multi-line private key, which
+	// are redacted but not reported again
+	continuation bool
+}
+
+// masked shows enough of the value to find it again
+func (f SecretFinding) masked() string {
+	if header := privateKeyBegin.FindString(f.Value); header != "" {
+		return strings.Trim(header, "-") + "…"
+	}
+	if len(f.Value) <= 12 {
+		return "****"
+	}
+	return f.Value[:4] + "…****"
+}
+
+// scanSecrets looks for credentials on the lines added between destRef and
+// sourceRef
+func scanSecrets(ctx context.Context, repoPath, sourceRef, destRef string, cfg SecretsConfig) ([]SecretFinding, error) {
+	added, err := addedLineContents(ctx, repoPath, sourceRef, destRef)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(added))
+	for file := range added {
+		files = append(files, file)
+	}
+	slices.Sort(files)
+
+	allow := cfg.allowPatterns()
+	var findings []SecretFinding
+	for _, file := range files {
+		if secretPathAllowed(file, cfg.AllowPaths) {
+			continue
+		}
+		findings = append(findings, scanLines(file, added[file], allow)...)
+	}
+	for _, f := range findings {
+		if !f.continuation {
+			slog.WarnContext(ctx, "Possible secret in diff", "rule", f.Rule, "path", f.Path, "line", f.Line)
+		}
+	}
+	return findings, nil
+}
+
+// scanLines scans the added lines of one file
+func scanLines(file string, lines []diffLine, allow []*regexp.Regexp) []SecretFinding {
+	var findings []SecretFinding
+	inKey := false
+	for i, line := range lines {
+		// The body of a multi-line private key ends at its END marker, or at
+		// the end of the added run
+		if inKey {
+			inKey = !privateKeyEnd.MatchString(line.Text) && i+1 < len(lines) && lines[i+1].Number == line.Number+1
+			if value := strings.TrimSpace(line.Text); value != "" {
+				findings = append(findings, SecretFinding{Rule: "private key", Path: file, Line: line.Number, Value: value, continuation: true})
+			}
+			continue
+		}
+		if strings.Contains(line.Text, allowSecretMarker) {
+			continue
+		}
+		var found []SecretFinding
+		for _, sig := range secretSignatures {
+			for _, m := range sig.pattern.FindAllStringSubmatch(line.Text, -1) {
+				value := m[0]
+				if len(m) > 1 && m[1] != "" {
+					value = m[1]
+				}
+				found = append(found, SecretFinding{Rule: sig.name, Path: file, Line: line.Number, Value: value})
+				if sig.name == "private key" && !privateKeyEnd.MatchString(value) {
+					inKey = i+1 < len(lines) && lines[i+1].Number == line.Number+1
+				}
+			}
+		}
+		for _, m := range secretCandidate.FindAllStringSubmatch(line.Text, -1) {
+			value := m[1] + m[2]
+			if highEntropy(value) && !slices.ContainsFunc(found, func(f SecretFinding) bool {
+				return strings.Contains(f.Value, value) || strings.Contains(value, f.Value)
+			}) {
+				found = append(found, SecretFinding{Rule: "high-entropy string", Path: file, Line: line.Number, Value: value})
+			}
+		}
+		for _, f := range found {
+			if !slices.ContainsFunc(allow, func(re *regexp.Regexp) bool { return re.MatchString(f.Value) }) {
+				findings = append(findings, f)
+			}
+		}
+	}
+	return findings
+}
+
+// highEntropy reports whether s looks random enough to be a credential:
+// it must be made of token characters mixing letters and digits, and hex
+// needs 3 bits of entropy per character, anything else 4.5
+func highEntropy(s string) bool {
+	if !tokenString.MatchString(s) || !strings.ContainsAny(s, "0123456789") || strings.Trim(s, "0123456789") == "" {
+		return false
+	}
+	// Paths, URLs and dotted identifiers have low entropy per segment but can
+	// look random as a whole
+	if strings.Count(s, "/") > 2 || strings.Count(s, ".") > 1 {
+		return false
+	}
+	threshold := 4.5
+	if hexString.MatchString(s) {
+		threshold = 3.0
+	}
+	return shannonEntropy(s) >= threshold
+}
+
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	var entropy float64
+	n := float64(len([]rune(s)))
+	for _, count := range counts {
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// secretPathAllowed reports whether file matches one of the default or
+// configured patterns
+func secretPathAllowed(file string, patterns []string) bool {
+	return matchesPathPattern(file, defaultSecretAllowPaths) || matchesPathPattern(file, patterns)
+}
+
+// maskSecrets replaces every occurrence of the findings' values in s with
+// their masked form
+func maskSecrets(s string, findings []SecretFinding) string {
+	for _, f := range findings {
+		s = strings.ReplaceAll(s, f.Value, f.masked())
+	}
+	return s
+}
+
+// secretComments turns the findings into blocker findings
+func secretComments(findings []SecretFinding) []CommentPayload {
+	var comments []CommentPayload
+	for _, f := range findings {
+		if f.continuation {
+			continue
+		}
+		comments = append(comments, CommentPayload{
+			Content: Content{Raw: fmt.Sprintf("[BLOCKER] 🔑 **Possible %s** (`%s`)\n\n"+
+				"Remove it and rotate it: it is in the branch history now. If it isn't a secret, add `%s` to the line "+
+				"or allow it under `secrets` in the exoReviewer config.", f.Rule, f.masked(), allowSecretMarker)},
+			Inline: &Inline{Path: f.Path, To: f.Line},
+		})
+	}
+	return comments
+}
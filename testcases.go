@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// maxTestCases caps how many test cases go in the prompt
+const maxTestCases = 50
+
+// defaultSheetRange covers the first sheet, header row included
+const defaultSheetRange = "A1:Z"
+
+// TestCaseSource reads the test cases that go with a PR
+type TestCaseSource interface {
+	// Name identifies the source in logs
+	Name() string
+	// TestCases returns pr's test cases. repoPath is the clone of the PR's
+	// source branch. errNoTestCases means the PR has none in this source.
+	TestCases(ctx context.Context, pr *PullRequest, repoPath string) (TestCaseContext, error)
+}
+
+// errNoTestCases is returned by sources that find nothing for a PR
+var errNoTestCases = errors.New("no test cases found")
+
+// newTestCaseSource returns the source configured in cfg
+func newTestCaseSource(cfg TestCaseConfig) (TestCaseSource, error) {
+	switch cfg.Source {
+	case "", "sheets":
+		return sheetsSource{cfg: cfg}, nil
+	case "file":
+		return tableFileSource{cfg: cfg}, nil
+	case "json":
+		return jsonFileSource{path: cfg.Path}, nil
+	case "xray":
+		return xraySource{}, nil
+	case "zephyr":
+		return newZephyrSource(), nil
+	}
+	return nil, fmt.Errorf("unknown test case source %q", cfg.Source)
+}
+
+// add appends test and counts it by status
+func (tc *TestCaseContext) add(test TestCase) {
+	tc.TestCases = append(tc.TestCases, test)
+	tc.TotalTests++
+	switch strings.ToLower(strings.TrimSpace(test.Status)) {
+	case "pass", "passed":
+		tc.PassedTests++
+	case "fail", "failed":
+		tc.FailedTests++
+	default:
+		tc.PendingTests++
+	}
+}
+
+type testCaseField struct {
+	name    string
+	headers []string
+}
+
+// testCaseFields are the TestCase fields a table column can map to, with the
+// headers recognised for each when no mapping is configured
+var testCaseFields = []testCaseField{
+	{"id", []string{"id", "test case id", "tc id", "test id", "key"}},
+	{"description", []string{"description", "title", "summary", "test case", "scenario"}},
+	{"steps", []string{"steps", "test steps", "procedure"}},
+	{"expected", []string{"expected", "expected result", "expected results"}},
+	{"actual", []string{"actual", "actual result", "actual results"}},
+	{"status", []string{"status", "result"}},
+}
+
+// testCaseColumns finds each field's column in header. Configured column
+// names take precedence over the recognised headers. It reports false when
+// neither an ID nor a description column is found, i.e. header doesn't look
+// like a header row.
+func testCaseColumns(header []string, columns map[string]string) (map[string]int, bool) {
+	found := make(map[string]int)
+	for _, field := range testCaseFields {
+		names := field.headers
+		if name, ok := columns[field.name]; ok {
+			names = []string{name}
+		}
+		for i, cell := range header {
+			if slices.ContainsFunc(names, func(name string) bool { return strings.EqualFold(name, strings.TrimSpace(cell)) }) {
+				found[field.name] = i
+				break
+			}
+		}
+	}
+	_, hasID := found["id"]
+	_, hasDescription := found["description"]
+	return found, hasID || hasDescription
+}
+
+// parseTestCaseRows turns table rows into test cases. The first row is the
+// header; without a recognisable one, columns are taken in the original
+// sheet layout: ID, description, steps, expected, actual, status.
+func parseTestCaseRows(rows [][]string, columns map[string]string) (TestCaseContext, error) {
+	var testContext TestCaseContext
+	if len(rows) == 0 {
+		return testContext, errNoTestCases
+	}
+	index, ok := testCaseColumns(rows[0], columns)
+	if !ok {
+		if len(columns) > 0 {
+			return testContext, fmt.Errorf("none of the configured columns are in the header row")
+		}
+		index = map[string]int{"id": 0, "description": 1, "steps": 2, "expected": 3, "actual": 4, "status": 5}
+	}
+
+	cell := func(row []string, field string) string {
+		i, ok := index[field]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+	for _, row := range rows[1:] {
+		test := TestCase{
+			ID:          cell(row, "id"),
+			Description: cell(row, "description"),
+			Expected:    cell(row, "expected"),
+			Actual:      cell(row, "actual"),
+			Status:      cell(row, "status"),
+		}
+		if test.ID == "" && test.Description == "" {
+			continue
+		}
+		for _, step := range strings.Split(cell(row, "steps"), "\n") {
+			if step = strings.TrimSpace(step); step != "" {
+				test.Steps = append(test.Steps, step)
+			}
+		}
+		testContext.add(test)
+	}
+	if testContext.TotalTests == 0 {
+		return testContext, errNoTestCases
+	}
+	return testContext, nil
+}
+
+// sheetsSource reads a Google Sheet linked from the PR title or description,
+// or the sheet configured for the repository
+type sheetsSource struct {
+	cfg TestCaseConfig
+}
+
+func (s sheetsSource) Name() string { return "sheets" }
+
+func (s sheetsSource) TestCases(ctx context.Context, pr *PullRequest, repoPath string) (TestCaseContext, error) {
+	sheetURL := extractGoogleSheetURL(pr.Title + "\n" + pr.Description)
+	if sheetURL == "" {
+		sheetURL = s.cfg.SheetURL
+	}
+	if sheetURL == "" {
+		return TestCaseContext{}, errNoTestCases
+	}
+	sheetID := getSheetIDFromURL(sheetURL)
+	if sheetID == "" {
+		return TestCaseContext{}, fmt.Errorf("invalid sheet URL")
+	}
+
+	// Load Google Sheets credentials from environment
+	credentials := os.Getenv("GOOGLE_SHEETS_CREDENTIALS")
+	if credentials == "" {
+		return TestCaseContext{}, fmt.Errorf("GOOGLE_SHEETS_CREDENTIALS environment variable not set")
+	}
+	config, err := google.JWTConfigFromJSON([]byte(credentials), sheets.SpreadsheetsReadonlyScope)
+	if err != nil {
+		return TestCaseContext{}, fmt.Errorf("unable to parse credentials: %v", err)
+	}
+	srv, err := sheets.NewService(ctx, option.WithHTTPClient(config.Client(ctx)))
+	if err != nil {
+		return TestCaseContext{}, fmt.Errorf("unable to create sheets service: %v", err)
+	}
+
+	sheetRange := s.cfg.Range
+	if sheetRange == "" {
+		sheetRange = defaultSheetRange
+	}
+	resp, err := srv.Spreadsheets.Values.Get(sheetID, sheetRange).Context(ctx).Do()
+	if err != nil {
+		return TestCaseContext{}, fmt.Errorf("unable to retrieve data from sheet: %v", err)
+	}
+	rows := make([][]string, len(resp.Values))
+	for i, row := range resp.Values {
+		for _, value := range row {
+			rows[i] = append(rows[i], fmt.Sprintf("%v", value))
+		}
+	}
+
+	testContext, err := parseTestCaseRows(rows, s.cfg.Columns)
+	if errors.Is(err, errNoTestCases) {
+		err = fmt.Errorf("no data found in sheet")
+	}
+	testContext.SheetURL, testContext.SheetID = sheetURL, sheetID
+	testContext.Source = sheetURL
+	return testContext, err
+}
+
+// tableFileSource reads a CSV, XLSX or JSON file committed in the repository
+type tableFileSource struct {
+	cfg TestCaseConfig
+}
+
+func (s tableFileSource) Name() string { return "file" }
+
+func (s tableFileSource) TestCases(ctx context.Context, pr *PullRequest, repoPath string) (TestCaseContext, error) {
+	if s.cfg.Path == "" {
+		return TestCaseContext{}, fmt.Errorf("test_cases.path is not set")
+	}
+	path, err := repoFilePath(repoPath, s.cfg.Path)
+	if err != nil {
+		return TestCaseContext{}, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return TestCaseContext{}, errNoTestCases
+	}
+
+	var testContext TestCaseContext
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		testContext, err = readCSVTestCases(path, s.cfg.Columns)
+	case ".xlsx":
+		testContext, err = readXLSXTestCases(path, s.cfg.Range, s.cfg.Columns)
+	case ".json":
+		testContext, err = readJSONTestCases(path)
+	default:
+		return TestCaseContext{}, fmt.Errorf("unsupported test case file %s (want .csv, .xlsx or .json)", s.cfg.Path)
+	}
+	testContext.Source = s.cfg.Path
+	return testContext, err
+}
+
+// repoFilePath resolves path inside the clone at repoPath, refusing paths
+// that lead out of it, including through a symlink the PR committed
+func repoFilePath(repoPath, path string) (string, error) {
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("test case file %s must be a relative path inside the repository", path)
+	}
+	full := filepath.Join(repoPath, path)
+	resolved, err := filepath.EvalSymlinks(full)
+	if os.IsNotExist(err) {
+		return full, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(repoPath)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("test case file %s must be a relative path inside the repository", path)
+	}
+	return resolved, nil
+}
+
+func readCSVTestCases(path string, columns map[string]string) (TestCaseContext, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return TestCaseContext{}, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return TestCaseContext{}, fmt.Errorf("invalid CSV %s: %v", filepath.Base(path), err)
+	}
+	return parseTestCaseRows(rows, columns)
+}
+
+// readXLSXTestCases reads the named sheet of an XLSX workbook, or its first
+// sheet when sheet is empty
+func readXLSXTestCases(path, sheet string, columns map[string]string) (TestCaseContext, error) {
+	f, err := excelize.OpenFile(path)
+	if err != nil {
+		return TestCaseContext{}, fmt.Errorf("invalid XLSX %s: %v", filepath.Base(path), err)
+	}
+	defer f.Close()
+	if sheet == "" {
+		sheet = f.GetSheetName(0)
+	}
+	rows, err := f.GetRows(sheet)
+	if err != nil {
+		return TestCaseContext{}, fmt.Errorf("failed to read sheet %q of %s: %v", sheet, filepath.Base(path), err)
+	}
+	return parseTestCaseRows(rows, columns)
+}
+
+// readJSONTestCases reads a JSON array of test cases
+func readJSONTestCases(path string) (TestCaseContext, error) {
+	var testContext TestCaseContext
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return testContext, err
+	}
+	var tests []TestCase
+	if err := json.Unmarshal(data, &tests); err != nil {
+		return testContext, fmt.Errorf("invalid test case file %s: %v", filepath.Base(path), err)
+	}
+	for _, test := range tests {
+		testContext.add(test)
+	}
+	if testContext.TotalTests == 0 {
+		return testContext, errNoTestCases
+	}
+	return testContext, nil
+}
+
+// jsonFileSource reads a JSON file on the reviewer's host. Every PR of the
+// repository gets the same test cases.
+type jsonFileSource struct {
+	path string
+}
+
+func (s jsonFileSource) Name() string { return "json" }
+
+func (s jsonFileSource) TestCases(ctx context.Context, pr *PullRequest, repoPath string) (TestCaseContext, error) {
+	if s.path == "" {
+		return TestCaseContext{}, fmt.Errorf("test_cases.path is not set")
+	}
+	testContext, err := readJSONTestCases(s.path)
+	testContext.Source = s.path
+	return testContext, err
+}
+
+// xraySource reads the Xray Test issues linked to the Jira tickets the PR
+// references. It uses the Jira settings, and Xray Server / Data Center's REST
+// API for test steps and the latest run status.
+type xraySource struct{}
+
+func (s xraySource) Name() string { return "xray" }
+
+type xrayStep struct {
+	Step   struct{ Raw string } `json:"step"`
+	Data   struct{ Raw string } `json:"data"`
+	Result struct{ Raw string } `json:"result"`
+}
+
+type xrayRun struct {
+	Status  string `json:"status"`
+	Comment string `json:"comment"`
+}
+
+func (s xraySource) TestCases(ctx context.Context, pr *PullRequest, repoPath string) (TestCaseContext, error) {
+	keys := jiraKeys(pr, appConfig.ForRepo(pr).Jira.Projects)
+	if len(keys) > maxJiraTickets {
+		keys = keys[:maxJiraTickets]
+	}
+	if len(keys) == 0 {
+		return TestCaseContext{}, errNoTestCases
+	}
+	client, err := newJiraClient()
+	if err != nil {
+		return TestCaseContext{}, err
+	}
+	jira, ok := client.(*restJiraClient)
+	if !ok {
+		return TestCaseContext{}, fmt.Errorf("the xray test case source needs JIRA_BASE_URL and Jira credentials")
+	}
+
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = fmt.Sprintf("linkedIssues(%q)", key)
+	}
+	jql := fmt.Sprintf("issuetype = Test AND (issue in %s) ORDER BY key", strings.Join(quoted, " OR issue in "))
+	u := fmt.Sprintf("%s/rest/api/2/search?jql=%s&fields=summary,description&maxResults=%d", jira.baseURL, url.QueryEscape(jql), maxTestCases)
+	var search struct {
+		Issues []jiraIssue `json:"issues"`
+	}
+	if err := sendJSON(ctx, "Jira", http.MethodGet, u, jira.headers, nil, &search); err != nil {
+		return TestCaseContext{}, fmt.Errorf("failed to search Xray tests: %w", err)
+	}
+	if len(search.Issues) == 0 {
+		return TestCaseContext{}, errNoTestCases
+	}
+
+	testContext := TestCaseContext{Source: "Xray tests linked to " + strings.Join(keys, ", ")}
+	for _, issue := range search.Issues {
+		test := TestCase{ID: issue.Key}
+		jiraField(&issue, "summary", &test.Description)
+
+		var steps []xrayStep
+		u := fmt.Sprintf("%s/rest/raven/1.0/api/test/%s/step", jira.baseURL, url.PathEscape(issue.Key))
+		if err := sendJSON(ctx, "Xray", http.MethodGet, u, jira.headers, nil, &steps); err != nil {
+			slog.WarnContext(ctx, "Error fetching Xray test steps", "test", issue.Key, "error", err)
+		}
+		var expected []string
+		for _, step := range steps {
+			text := step.Step.Raw
+			if step.Data.Raw != "" {
+				text += " (data: " + step.Data.Raw + ")"
+			}
+			test.Steps = append(test.Steps, text)
+			if step.Result.Raw != "" {
+				expected = append(expected, step.Result.Raw)
+			}
+		}
+		test.Expected = strings.Join(expected, "; ")
+		if len(test.Steps) == 0 {
+			var description string
+			if jiraField(&issue, "description", &description) && description != "" {
+				test.Steps = []string{description}
+			}
+		}
+
+		var runs []xrayRun
+		u = fmt.Sprintf("%s/rest/raven/1.0/testruns?testKey=%s", jira.baseURL, url.QueryEscape(issue.Key))
+		if err := sendJSON(ctx, "Xray", http.MethodGet, u, jira.headers, nil, &runs); err != nil {
+			slog.WarnContext(ctx, "Error fetching Xray test runs", "test", issue.Key, "error", err)
+		}
+		test.Status = "TODO"
+		if len(runs) > 0 {
+			last := runs[len(runs)-1]
+			test.Status, test.Actual = last.Status, last.Comment
+		}
+		testContext.add(test)
+	}
+	return testContext, nil
+}
+
+// zephyrSource reads the Zephyr Scale test cases linked to the Jira tickets
+// the PR references, with the status of each case's latest execution
+type zephyrSource struct {
+	baseURL string
+	headers map[string]string
+}
+
+// newZephyrSource configures the Zephyr Scale Cloud API from ZEPHYR_API_TOKEN,
+// and ZEPHYR_BASE_URL for a different API host
+func newZephyrSource() zephyrSource {
+	baseURL := strings.TrimSuffix(os.Getenv("ZEPHYR_BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = "https://api.zephyrscale.smartbear.com/v2"
+	}
+	headers := make(map[string]string)
+	if token := os.Getenv("ZEPHYR_API_TOKEN"); token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	return zephyrSource{baseURL: baseURL, headers: headers}
+}
+
+func (s zephyrSource) Name() string { return "zephyr" }
+
+type zephyrTestCase struct {
+	Key       string `json:"key"`
+	Name      string `json:"name"`
+	Objective string `json:"objective"`
+}
+
+type zephyrSteps struct {
+	Values []struct {
+		Inline struct {
+			Description    string `json:"description"`
+			TestData       string `json:"testData"`
+			ExpectedResult string `json:"expectedResult"`
+		} `json:"inline"`
+	} `json:"values"`
+}
+
+type zephyrExecutions struct {
+	Values []struct {
+		Status struct {
+			ID int `json:"id"`
+		} `json:"testExecutionStatus"`
+		Comment string `json:"comment"`
+	} `json:"values"`
+}
+
+func (s zephyrSource) TestCases(ctx context.Context, pr *PullRequest, repoPath string) (TestCaseContext, error) {
+	if s.headers["Authorization"] == "" {
+		return TestCaseContext{}, fmt.Errorf("the zephyr test case source needs ZEPHYR_API_TOKEN")
+	}
+	keys := jiraKeys(pr, appConfig.ForRepo(pr).Jira.Projects)
+	if len(keys) > maxJiraTickets {
+		keys = keys[:maxJiraTickets]
+	}
+
+	var caseKeys []string
+	for _, key := range keys {
+		var links []struct {
+			Key string `json:"key"`
+		}
+		u := fmt.Sprintf("%s/issuelinks/%s/testcases", s.baseURL, url.PathEscape(key))
+		if err := sendJSON(ctx, "Zephyr", http.MethodGet, u, s.headers, nil, &links); err != nil {
+			return TestCaseContext{}, fmt.Errorf("failed to list test cases linked to %s: %w", key, err)
+		}
+		for _, link := range links {
+			if !contains(caseKeys, link.Key) && len(caseKeys) < maxTestCases {
+				caseKeys = append(caseKeys, link.Key)
+			}
+		}
+	}
+	if len(caseKeys) == 0 {
+		return TestCaseContext{}, errNoTestCases
+	}
+
+	statuses := make(map[int]string)
+	testContext := TestCaseContext{Source: "Zephyr Scale test cases linked to " + strings.Join(keys, ", ")}
+	for _, key := range caseKeys {
+		var tc zephyrTestCase
+		if err := sendJSON(ctx, "Zephyr", http.MethodGet, s.baseURL+"/testcases/"+url.PathEscape(key), s.headers, nil, &tc); err != nil {
+			return testContext, fmt.Errorf("failed to fetch test case %s: %w", key, err)
+		}
+		test := TestCase{ID: tc.Key, Description: tc.Name, Status: "Not Executed"}
+		if tc.Objective != "" {
+			test.Description += ": " + tc.Objective
+		}
+
+		var steps zephyrSteps
+		if err := sendJSON(ctx, "Zephyr", http.MethodGet, s.baseURL+"/testcases/"+url.PathEscape(key)+"/teststeps", s.headers, nil, &steps); err != nil {
+			slog.WarnContext(ctx, "Error fetching Zephyr test steps", "test", key, "error", err)
+		}
+		var expected []string
+		for _, step := range steps.Values {
+			text := step.Inline.Description
+			if step.Inline.TestData != "" {
+				text += " (data: " + step.Inline.TestData + ")"
+			}
+			test.Steps = append(test.Steps, text)
+			if step.Inline.ExpectedResult != "" {
+				expected = append(expected, step.Inline.ExpectedResult)
+			}
+		}
+		test.Expected = strings.Join(expected, "; ")
+
+		var executions zephyrExecutions
+		u := fmt.Sprintf("%s/testexecutions?testCase=%s&onlyLastExecutions=true&maxResults=1", s.baseURL, url.QueryEscape(key))
+		if err := sendJSON(ctx, "Zephyr", http.MethodGet, u, s.headers, nil, &executions); err != nil {
+			slog.WarnContext(ctx, "Error fetching Zephyr test executions", "test", key, "error", err)
+		}
+		if len(executions.Values) > 0 {
+			last := executions.Values[0]
+			test.Actual = last.Comment
+			test.Status = s.statusName(ctx, statuses, last.Status.ID)
+		}
+		testContext.add(test)
+	}
+	return testContext, nil
+}
+
+// statusName resolves an execution status ID, caching names in statuses
+func (s zephyrSource) statusName(ctx context.Context, statuses map[int]string, id int) string {
+	if name, ok := statuses[id]; ok {
+		return name
+	}
+	var status struct {
+		Name string `json:"name"`
+	}
+	if err := sendJSON(ctx, "Zephyr", http.MethodGet, fmt.Sprintf("%s/statuses/%d", s.baseURL, id), s.headers, nil, &status); err != nil {
+		slog.WarnContext(ctx, "Error fetching Zephyr status", "status_id", id, "error", err)
+		return "Unknown"
+	}
+	statuses[id] = status.Name
+	return status.Name
+}
+
+// generateTestCasesChunk fetches pr's test cases from the repository's
+// configured source
+func generateTestCasesChunk(ctx context.Context, pr *PullRequest, repoPath string) string {
+	const header = "### CHUNK: TEST CASES\n"
+	cfg := appConfig.ForRepo(pr).TestCases
+	source, err := newTestCaseSource(cfg)
+	if err != nil {
+		return header + "# Test cases are misconfigured: " + err.Error() + "\n"
+	}
+	testContext, err := source.TestCases(ctx, pr, repoPath)
+	if errors.Is(err, errNoTestCases) {
+		if source.Name() == "sheets" {
+			return header + "# No test cases sheet found in PR description\n"
+		}
+		return header + "# No test cases found in " + source.Name() + "\n"
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Error fetching test cases", "source", source.Name(), "error", err)
+		lookupFailures.WithLabelValues("test_cases").Inc()
+		return header + "# Error fetching test cases\n" + err.Error()
+	}
+	if len(testContext.TestCases) > maxTestCases {
+		testContext.TestCases = testContext.TestCases[:maxTestCases]
+	}
+	return generateTestCaseChunk(testContext)
+}
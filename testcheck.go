@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// testRule describes how one language lays out its tests
+type testRule struct {
+	language   string
+	extensions []string
+	// isTest reports whether path is a test file
+	isTest func(path string) bool
+	// testFiles lists the test files that would cover source file path
+	testFiles func(path string) []string
+	// functions matches a function declaration, capturing its name
+	functions *regexp.Regexp
+	// bodyEnd returns the offset in content just past the body of the
+	// function whose declaration functions matched at content[start:end]
+	bodyEnd func(content string, start, end int) int
+}
+
+var testRules = []testRule{
+	{
+		language:   "Go",
+		extensions: []string{".go"},
+		isTest:     func(p string) bool { return strings.HasSuffix(p, "_test.go") },
+		testFiles: func(p string) []string {
+			return []string{strings.TrimSuffix(p, ".go") + "_test.go"}
+		},
+		functions: regexp.MustCompile(`(?m)^func\s+(?:\([^)]*\)\s*)?(\w+)\s*[\[(]`),
+		bodyEnd:   braceBodyEnd,
+	},
+	{
+		language:   "JavaScript/TypeScript",
+		extensions: []string{".js", ".jsx", ".mjs", ".cjs", ".ts", ".tsx"},
+		isTest: func(p string) bool {
+			base := path.Base(p)
+			return strings.Contains(base, ".test.") || strings.Contains(base, ".spec.") || slices.Contains(strings.Split(p, "/"), "__tests__")
+		},
+		testFiles: func(p string) []string {
+			dir, ext := path.Dir(p), path.Ext(p)
+			base := strings.TrimSuffix(path.Base(p), ext)
+			var files []string
+			for _, d := range []string{dir, path.Join(dir, "__tests__")} {
+				files = append(files, path.Join(d, base+".test"+ext), path.Join(d, base+".spec"+ext))
+			}
+			return append(files, path.Join(dir, "__tests__", base+ext))
+		},
+		functions: regexp.MustCompile(`(?m)^[ \t]*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*(\w+)|^[ \t]*(?:export\s+)?(?:const|let|var)\s+(\w+)\s*=\s*(?:async\s+)?(?:function\b|\([^)]*\)\s*(?::[^=]+)?=>|\w+\s*=>)`),
+		bodyEnd:   braceBodyEnd,
+	},
+	{
+		language:   "Python",
+		extensions: []string{".py"},
+		isTest: func(p string) bool {
+			base := path.Base(p)
+			return strings.HasPrefix(base, "test_") || strings.HasSuffix(base, "_test.py") || base == "conftest.py"
+		},
+		testFiles: func(p string) []string {
+			dir, base := path.Dir(p), strings.TrimSuffix(path.Base(p), ".py")
+			// Top-level tests/ usually mirrors the package, without any src/
+			mirror := path.Join("tests", strings.TrimPrefix(dir, "src/"))
+			return []string{
+				path.Join(dir, "test_"+base+".py"),
+				path.Join(dir, base+"_test.py"),
+				path.Join(dir, "tests", "test_"+base+".py"),
+				path.Join(mirror, "test_"+base+".py"),
+				path.Join("tests", "test_"+base+".py"),
+			}
+		},
+		functions: regexp.MustCompile(`(?m)^[ \t]*(?:async\s+)?def\s+(\w+)\s*\(`),
+		bodyEnd:   indentBodyEnd,
+	},
+	{
+		language:   "Java",
+		extensions: []string{".java"},
+		isTest: func(p string) bool {
+			base := strings.TrimSuffix(path.Base(p), ".java")
+			return strings.Contains(p, "src/test/") || strings.HasSuffix(base, "Test") || strings.HasSuffix(base, "Tests") || strings.HasSuffix(base, "IT")
+		},
+		testFiles: func(p string) []string {
+			i := strings.Index(p, "src/main/")
+			if i < 0 {
+				return nil
+			}
+			mirror := p[:i] + "src/test/" + p[i+len("src/main/"):]
+			dir, base := path.Dir(mirror), strings.TrimSuffix(path.Base(mirror), ".java")
+			return []string{
+				path.Join(dir, base+"Test.java"),
+				path.Join(dir, base+"Tests.java"),
+				path.Join(dir, "Test"+base+".java"),
+				path.Join(dir, base+"IT.java"),
+			}
+		},
+		functions: regexp.MustCompile(`(?m)^[ \t]*(?:(?:public|protected|private|static|final|abstract|synchronized|default)\s+)+(?:<[^>]+>\s*)?[\w<>\[\],.? ]+?\s+(\w+)\s*\(`),
+		bodyEnd:   braceBodyEnd,
+	},
+}
+
+// ignoredFunctions are entry points that are not unit tested by convention
+var ignoredFunctions = map[string]bool{"main": true, "init": true, "__init__": true}
+
+// testRuleFor returns the rule for path's language, or nil
+func testRuleFor(p string) *testRule {
+	ext := path.Ext(p)
+	for i := range testRules {
+		if slices.Contains(testRules[i].extensions, ext) {
+			return &testRules[i]
+		}
+	}
+	return nil
+}
+
+// isTestFile reports whether path is a test file in a known language
+func isTestFile(p string) bool {
+	rule := testRuleFor(p)
+	return rule != nil && rule.isTest(p)
+}
+
+// existingTestFiles returns the test files for source file p among files.
+// Go tests anywhere in the package count.
+func existingTestFiles(files map[string]bool, p string, rule *testRule) []string {
+	var found []string
+	for _, candidate := range rule.testFiles(p) {
+		if files[candidate] && !slices.Contains(found, candidate) {
+			found = append(found, candidate)
+		}
+	}
+	if rule.language == "Go" {
+		var pkgTests []string
+		for file := range files {
+			if path.Dir(file) == path.Dir(p) && strings.HasSuffix(file, "_test.go") && !slices.Contains(found, file) {
+				pkgTests = append(pkgTests, file)
+			}
+		}
+		slices.Sort(pkgTests)
+		found = append(found, pkgTests...)
+	}
+	return found
+}
+
+// filesAt lists the files in revision ref
+func filesAt(ctx context.Context, repoPath, ref string) (map[string]bool, error) {
+	output, err := runGitCommand(ctx, repoPath, "git", "ls-tree", "-r", "--name-only", ref)
+	if err != nil {
+		return nil, fmt.Errorf("ls-tree failed: %v\n%s", err, output)
+	}
+	files := make(map[string]bool)
+	for _, file := range strings.Split(strings.TrimSpace(output), "\n") {
+		files[file] = true
+	}
+	return files, nil
+}
+
+// fileAt returns the content of file p in revision ref
+func fileAt(ctx context.Context, repoPath, ref, p string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "show", ref+":"+p)
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	return string(output), err
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// diffLine is an added line of a diff
+type diffLine struct {
+	Number int
+	Text   string
+}
+
+// diffHunk is a hunk of a git diff
+type diffHunk struct {
+	// File is the path in the new version, "" for a deleted file
+	File string
+	// Start is the hunk's first line in the new version
+	Start int
+	Added []diffLine
+}
+
+// parseDiff splits git diff output into hunks. File headers are only read
+// between a "diff --git" line and the file's first hunk, so an added line
+// whose content starts with "++ " isn't taken for one.
+func parseDiff(diff string) []diffHunk {
+	var hunks []diffHunk
+	file, inHeader, next := "", false, 0
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "diff --git ") {
+			file, inHeader = "", true
+			continue
+		}
+		if m := hunkHeader.FindStringSubmatch(line); m != nil {
+			next, _ = strconv.Atoi(m[1])
+			hunks = append(hunks, diffHunk{File: file, Start: next})
+			inHeader = false
+			continue
+		}
+		if inHeader {
+			if name, ok := strings.CutPrefix(line, "+++ "); ok {
+				file = strings.TrimPrefix(name, "b/")
+				if name == "/dev/null" {
+					file = ""
+				}
+			}
+			continue
+		}
+		if len(hunks) == 0 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "+"):
+			hunk := &hunks[len(hunks)-1]
+			hunk.Added = append(hunk.Added, diffLine{Number: next, Text: line[1:]})
+			next++
+		case strings.HasPrefix(line, " "):
+			next++
+		}
+	}
+	return hunks
+}
+
+// diffHunks returns the hunks of the changes between destRef and sourceRef,
+// without context lines
+func diffHunks(ctx context.Context, repoPath, sourceRef, destRef string) ([]diffHunk, error) {
+	output, err := runGitCommand(ctx, repoPath, "git", "diff", "-U0", "--no-color", "--no-ext-diff", destRef+"..."+sourceRef)
+	if err != nil {
+		return nil, fmt.Errorf("diff failed: %v\n%s", err, output)
+	}
+	return parseDiff(output), nil
+}
+
+// changedLines maps each file changed between destRef and sourceRef to the
+// lines of its new version that were added or modified. A pure deletion
+// marks the line before it.
+func changedLines(ctx context.Context, repoPath, sourceRef, destRef string) (map[string][]int, error) {
+	hunks, err := diffHunks(ctx, repoPath, sourceRef, destRef)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[string][]int)
+	for _, hunk := range hunks {
+		if hunk.File == "" {
+			continue
+		}
+		if len(hunk.Added) == 0 {
+			lines[hunk.File] = append(lines[hunk.File], max(hunk.Start, 1))
+		}
+		for _, line := range hunk.Added {
+			lines[hunk.File] = append(lines[hunk.File], line.Number)
+		}
+	}
+	return lines, nil
+}
+
+// functionSpan is the lines a function's declaration and body take up
+type functionSpan struct {
+	name       string
+	start, end int
+}
+
+// goFunctionSpans parses content as Go source and returns its functions and
+// methods
+func goFunctionSpans(content string) ([]functionSpan, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", content, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	var spans []functionSpan
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			spans = append(spans, functionSpan{fn.Name.Name, fset.Position(fn.Pos()).Line, fset.Position(fn.End()).Line})
+		}
+	}
+	return spans, nil
+}
+
+// changedFunctions returns the functions in content whose declaration or
+// body contains one of the changed lines. Go source is parsed; in other
+// languages, and Go that doesn't parse, rule.functions finds declarations
+// and rule.bodyEnd where they end.
+func changedFunctions(content string, rule *testRule, changed []int) []string {
+	var spans []functionSpan
+	var err error
+	if rule.language == "Go" {
+		spans, err = goFunctionSpans(content)
+	}
+	if rule.language != "Go" || err != nil {
+		for _, m := range rule.functions.FindAllStringSubmatchIndex(content, -1) {
+			name := ""
+			for g := 2; g < len(m); g += 2 {
+				if m[g] >= 0 {
+					name = content[m[g]:m[g+1]]
+					break
+				}
+			}
+			end := rule.bodyEnd(content, m[0], m[1])
+			spans = append(spans, functionSpan{name, strings.Count(content[:m[0]], "\n") + 1, strings.Count(content[:end], "\n") + 1})
+		}
+	}
+
+	var names []string
+	for _, s := range spans {
+		if ignoredFunctions[s.name] || slices.Contains(names, s.name) {
+			continue
+		}
+		if slices.ContainsFunc(changed, func(line int) bool { return line >= s.start && line <= s.end }) {
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
+
+// braceBodyEnd finds the brace that closes a function body in a C-like
+// language, skipping strings, comments and braces inside parentheses, such
+// as destructured parameters. A declaration without a body ends at its
+// semicolon, and an arrow function with an expression body at the end of
+// its line.
+func braceBodyEnd(content string, start, end int) int {
+	if strings.HasSuffix(content[start:end], "=>") && !strings.HasPrefix(strings.TrimLeft(content[end:], " \t"), "{") {
+		if i := strings.IndexByte(content[end:], '\n'); i >= 0 {
+			return end + i
+		}
+		return len(content)
+	}
+	depth, parens := 0, 0
+	for i := start; i < len(content); i++ {
+		switch c := content[i]; {
+		case strings.HasPrefix(content[i:], "//"):
+			if j := strings.IndexByte(content[i:], '\n'); j >= 0 {
+				i += j
+			} else {
+				i = len(content)
+			}
+		case strings.HasPrefix(content[i:], "/*"):
+			if j := strings.Index(content[i+2:], "*/"); j >= 0 {
+				i += j + 3
+			} else {
+				i = len(content)
+			}
+		case c == '"' || c == '\'' || c == '`':
+			for i++; i < len(content) && content[i] != c; i++ {
+				if content[i] == '\\' {
+					i++
+				}
+			}
+		case c == '(':
+			parens++
+		case c == ')':
+			parens--
+		case parens > 0:
+		case c == '{':
+			depth++
+		case c == '}':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		case c == ';' && depth == 0:
+			return i + 1
+		}
+	}
+	return len(content)
+}
+
+// indentBodyEnd finds the end of a Python function: the last line, after
+// the signature, that is indented deeper than the def
+func indentBodyEnd(content string, start, end int) int {
+	lineStart := strings.LastIndexByte(content[:start], '\n') + 1
+	indent := len(content[lineStart:start]) + len(content[start:]) - len(strings.TrimLeft(content[start:], " \t"))
+	// The signature ends at the colon outside its parentheses
+	parens := 0
+	i := end - 1
+	for ; i < len(content); i++ {
+		if c := content[i]; c == '(' || c == '[' {
+			parens++
+		} else if c == ')' || c == ']' {
+			parens--
+		} else if c == ':' && parens == 0 {
+			break
+		}
+	}
+	bodyEnd := i
+	for i < len(content) {
+		next := strings.IndexByte(content[i:], '\n')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+		line := content[i:]
+		if j := strings.IndexByte(line, '\n'); j >= 0 {
+			line = line[:j]
+		}
+		text := strings.TrimLeft(line, " \t")
+		if text == "" {
+			continue
+		}
+		if len(line)-len(text) <= indent {
+			break
+		}
+		bodyEnd = i + len(line)
+	}
+	return bodyEnd
+}
+
+// untestedFile is a changed source file with changed functions that none of
+// its tests mention
+type untestedFile struct {
+	Path      string
+	Functions []string
+	// TestFiles are the file's existing tests; Touched reports whether any
+	// was changed in the PR
+	TestFiles []string
+	Touched   bool
+	Expected  string
+}
+
+// findUntestedChanges checks each changed source file in a known language
+// for tests. A changed function counts as tested when one of its file's
+// tests mentions it by name.
+func findUntestedChanges(ctx context.Context, repoPath, sourceRef, destRef string) ([]untestedFile, error) {
+	changed, err := changedLines(ctx, repoPath, sourceRef, destRef)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filesAt(ctx, repoPath, sourceRef)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(changed))
+	for p := range changed {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+
+	var untested []untestedFile
+	for _, p := range paths {
+		rule := testRuleFor(p)
+		if rule == nil || rule.isTest(p) || strings.Contains(p, "vendor/") || strings.Contains(p, "node_modules/") || strings.Contains(p, "testdata/") {
+			continue
+		}
+		content, err := fileAt(ctx, repoPath, sourceRef, p)
+		if err != nil {
+			continue
+		}
+		functions := changedFunctions(content, rule, changed[p])
+		if len(functions) == 0 {
+			continue
+		}
+
+		file := untestedFile{Path: p, TestFiles: existingTestFiles(files, p, rule)}
+		if candidates := rule.testFiles(p); len(candidates) > 0 {
+			file.Expected = candidates[0]
+		}
+		var tests strings.Builder
+		for _, testFile := range file.TestFiles {
+			if _, ok := changed[testFile]; ok {
+				file.Touched = true
+			}
+			content, _ := fileAt(ctx, repoPath, sourceRef, testFile)
+			tests.WriteString(content)
+		}
+		for _, function := range functions {
+			if !regexp.MustCompile(`\b` + regexp.QuoteMeta(function) + `\b`).MatchString(tests.String()) {
+				file.Functions = append(file.Functions, function)
+			}
+		}
+		if len(file.Functions) > 0 {
+			untested = append(untested, file)
+		}
+	}
+	return untested, nil
+}
+
+// missingTestsComment is the finding listing untested changed functions
+func missingTestsComment(untested []untestedFile) CommentPayload {
+	var b strings.Builder
+	b.WriteString("[MINOR] 🧪 **Missing tests**\n\nThese changed functions are not mentioned by any test:\n\n")
+	for _, file := range untested {
+		functions := make([]string, len(file.Functions))
+		for i, function := range file.Functions {
+			functions[i] = "`" + function + "`"
+		}
+		b.WriteString(fmt.Sprintf("- `%s`: %s", file.Path, strings.Join(functions, ", ")))
+		switch {
+		case len(file.TestFiles) == 0 && file.Expected != "":
+			b.WriteString(fmt.Sprintf(" (no tests found; expected `%s`)", file.Expected))
+		case len(file.TestFiles) == 0:
+			b.WriteString(" (no tests found)")
+		case file.Touched:
+			b.WriteString(" (tests were updated, but not for these)")
+		default:
+			b.WriteString(fmt.Sprintf(" (tests in `%s` were not updated)", strings.Join(file.TestFiles, "`, `")))
+		}
+		b.WriteString("\n")
+	}
+	return CommentPayload{Content: Content{Raw: b.String()}}
+}
+
+// checkMissingTests returns the missing tests finding for the changes
+// between destRef and sourceRef, or nil when every changed function is tested
+func checkMissingTests(ctx context.Context, repoPath, sourceRef, destRef string) (*CommentPayload, error) {
+	untested, err := findUntestedChanges(ctx, repoPath, sourceRef, destRef)
+	if err != nil || len(untested) == 0 {
+		return nil, err
+	}
+	comment := missingTestsComment(untested)
+	return &comment, nil
+}
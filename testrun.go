@@ -0,0 +1,579 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxTestFailureFindings caps how many test failures become findings
+const maxTestFailureFindings = 10
+
+// sandboxLimits bounds a sandboxed process
+type sandboxLimits struct {
+	Timeout    time.Duration
+	CPUSeconds int
+	MemoryMB   int
+}
+
+// sandboxPaths are host paths a sandboxed process may use besides its
+// working directory
+type sandboxPaths struct {
+	ReadOnly []string
+	Writable []string
+}
+
+// TestRunResult is the outcome of running the tests affected by a PR
+type TestRunResult struct {
+	Packages []string
+	Passed   int
+	Failed   int
+	Skipped  int
+	Failures []TestFailure
+	TimedOut bool
+	Duration time.Duration
+	// Coverage is the PR's diff coverage, when it was measured
+	Coverage *DiffCoverage
+	// Err is set when the tests couldn't be run at all
+	Err error
+}
+
+// TestFailure is a failing test, or a package that failed to build or run.
+// File is relative to the repository root and empty when unknown.
+type TestFailure struct {
+	Package string
+	Test    string
+	File    string
+	Line    int
+	Message string
+	Panic   bool
+	Build   bool
+}
+
+// goTestEvent is a line of `go test -json` output
+type goTestEvent struct {
+	Action     string
+	Package    string
+	Test       string
+	Output     string
+	ImportPath string
+}
+
+// affectedGoPackages returns the directories of Go packages with changed
+// files that still exist at the PR head
+func affectedGoPackages(changedFiles []string, files map[string]bool) []string {
+	var dirs []string
+	for _, file := range changedFiles {
+		dir := path.Dir(file)
+		if !strings.HasSuffix(file, ".go") || slices.Contains(dirs, dir) {
+			continue
+		}
+		if strings.Contains(file, "vendor/") || strings.Contains(file, "testdata/") {
+			continue
+		}
+		for f := range files {
+			if path.Dir(f) == dir && strings.HasSuffix(f, ".go") {
+				dirs = append(dirs, dir)
+				break
+			}
+		}
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+var goModulePattern = regexp.MustCompile(`(?m)^module\s+"?([^\s"]+)"?`)
+
+// runAffectedTests runs the tests of the Go packages changed between destRef
+// and sourceRef in a sandbox, at sourceRef. It returns nil when the PR
+// changes no Go packages or the repository isn't a Go module.
+func runAffectedTests(ctx context.Context, repoPath, sourceRef, destRef string, cfg TestRunConfig) *TestRunResult {
+	ctx, span := tracer.Start(ctx, "run tests")
+	defer span.End()
+
+	changed, err := getChangedFiles(repoPath, sourceRef, destRef)
+	if err != nil {
+		return &TestRunResult{Err: fmt.Errorf("failed to list changed files: %v", err)}
+	}
+	files, err := filesAt(ctx, repoPath, sourceRef)
+	if err != nil {
+		return &TestRunResult{Err: err}
+	}
+	goMod, err := fileAt(ctx, repoPath, sourceRef, "go.mod")
+	if err != nil {
+		return nil
+	}
+	dirs := affectedGoPackages(changed, files)
+	if len(dirs) == 0 {
+		return nil
+	}
+	module := goModulePattern.FindStringSubmatch(goMod)
+	if module == nil {
+		return &TestRunResult{Err: errors.New("go.mod has no module path")}
+	}
+
+	worktree, remove, err := exportTree(ctx, repoPath, sourceRef)
+	if err != nil {
+		return &TestRunResult{Err: err}
+	}
+	defer remove()
+
+	// The profile goes in a directory of its own outside the tree, so
+	// neither a committed file nor a test writing to its working directory
+	// can stand in for it
+	coverProfile := ""
+	if cfg.DiffCoverage {
+		coverDir, err := os.MkdirTemp("", "exoreviewer-cover-")
+		if err != nil {
+			return &TestRunResult{Err: err}
+		}
+		defer os.RemoveAll(coverDir)
+		coverProfile = filepath.Join(coverDir, "cover.out")
+	}
+	result := runGoTests(ctx, worktree, module[1], dirs, cfg.limits(), coverProfile)
+	if coverProfile != "" && result.Err == nil {
+		result.Coverage, err = measureDiffCoverage(ctx, repoPath, sourceRef, destRef, coverProfile, module[1], cfg.MinDiffCoverage)
+		if err != nil {
+			slog.WarnContext(ctx, "Error measuring diff coverage", "error", err)
+		}
+	}
+	slog.InfoContext(ctx, "Test run complete",
+		"packages", len(result.Packages), "passed", result.Passed, "failed", result.Failed,
+		"timed_out", result.TimedOut, "duration_ms", result.Duration.Milliseconds(), "error", result.Err)
+	endSpan(span, result.Err)
+	return result
+}
+
+// exportTree writes the files of ref in repoPath to a temporary directory
+// with git archive. Unlike a worktree, the copy has no link back to the
+// clone's .git, so code run in it can't read the clone's config or plant
+// hooks there. remove deletes it again.
+func exportTree(ctx context.Context, repoPath, ref string) (dir string, remove func(), err error) {
+	dir, err = os.MkdirTemp("", "exoreviewer-tree-")
+	if err != nil {
+		return "", nil, err
+	}
+	remove = func() { os.RemoveAll(dir) }
+	archive := exec.CommandContext(ctx, "git", "archive", "--format=tar", ref)
+	archive.Dir = repoPath
+	var stderr bytes.Buffer
+	archive.Stderr = &stderr
+	stdout, err := archive.StdoutPipe()
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	if err := archive.Start(); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("failed to export %s: %v", ref, err)
+	}
+	extractErr := extractTree(stdout, dir)
+	io.Copy(io.Discard, stdout)
+	if err := archive.Wait(); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("failed to export %s: %v\n%s", ref, err, stderr.String())
+	}
+	if extractErr != nil {
+		remove()
+		return "", nil, fmt.Errorf("failed to export %s: %v", ref, extractErr)
+	}
+	return dir, remove, nil
+}
+
+// extractTree unpacks a git archive into dir. Entries must stay inside dir,
+// and only under directories the archive itself created, so a symlink in
+// the tree can't redirect a later entry.
+func extractTree(r io.Reader, dir string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	dirs := map[string]bool{".": true}
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if !filepath.IsLocal(name) || !dirs[filepath.Dir(name)] {
+			return fmt.Errorf("unexpected archive entry %q", header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := root.Mkdir(name, 0755); err != nil {
+				return err
+			}
+			dirs[name] = true
+		case tar.TypeReg:
+			f, err := root.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(header.Mode)&0755|0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, archive)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// Only the jail follows these, and it sees nothing outside the tree
+			// worth reaching
+			if err := os.Symlink(header.Linkname, filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// moduleDownloadTimeout bounds `go mod download`, which runs outside the
+// sandbox with network access
+const moduleDownloadTimeout = 3 * time.Minute
+
+// downloadModules fetches the dependencies of the module at dir, outside the
+// sandbox, so the go command can then run offline
+func downloadModules(ctx context.Context, dir string) error {
+	env, _, err := goEnv(false)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, moduleDownloadTimeout)
+	defer cancel()
+	download := exec.CommandContext(ctx, "go", "mod", "download")
+	download.Dir, download.Env = dir, env
+	if output, err := download.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("go mod download timed out after %s", moduleDownloadTimeout)
+		}
+		return fmt.Errorf("go mod download failed: %v\n%s", err, truncatePayload(string(output)))
+	}
+	return nil
+}
+
+// goEnv returns a minimal environment for the go command, so tests don't see
+// the reviewer's credentials, and the host paths a sandboxed go command
+// needs to read. Modules are fetched before the sandbox starts; inside it
+// the proxy is off, the module cache is read-only and builds are cached in
+// the jail's /tmp.
+func goEnv(sandboxed bool) (env, readOnly []string, err error) {
+	output, err := exec.Command("go", "env", "-json", "GOROOT", "GOCACHE", "GOMODCACHE", "GOPATH", "GOPROXY", "GOPRIVATE", "GONOSUMDB").Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("go env failed: %v", err)
+	}
+	var vars map[string]string
+	if err := json.Unmarshal(output, &vars); err != nil {
+		return nil, nil, err
+	}
+	home := os.Getenv("HOME")
+	if sandboxed {
+		home = "/tmp"
+		vars["GOPROXY"], vars["GOCACHE"], vars["GOPATH"] = "off", "/tmp/go-build", "/tmp/go"
+		readOnly = []string{vars["GOROOT"], vars["GOMODCACHE"]}
+	}
+	env = []string{"PATH=" + os.Getenv("PATH"), "HOME=" + home, "GOTOOLCHAIN=local", "GOFLAGS="}
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+	slices.Sort(env)
+	return env, readOnly, nil
+}
+
+// runGoTests runs `go test -json` on dirs of the module checked out at
+// worktree, writing a coverage profile to coverProfile if it is set
+func runGoTests(ctx context.Context, worktree, module string, dirs []string, limits sandboxLimits, coverProfile string) *TestRunResult {
+	start := time.Now()
+	result := &TestRunResult{}
+	for _, dir := range dirs {
+		result.Packages = append(result.Packages, path.Join(module, dir))
+	}
+
+	if err := downloadModules(ctx, worktree); err != nil {
+		result.Err = err
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, limits.Timeout)
+	defer cancel()
+	// go test's own timeout goes first, so a hung test dumps its stack
+	args := []string{"test", "-json", "-count=1", fmt.Sprintf("-timeout=%s", limits.Timeout*9/10)}
+	if coverProfile != "" {
+		args = append(args, "-coverprofile="+coverProfile)
+	}
+	for _, dir := range dirs {
+		args = append(args, "./"+dir)
+	}
+	env, readOnly, err := goEnv(true)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	paths := sandboxPaths{ReadOnly: readOnly}
+	if coverProfile != "" {
+		paths.Writable = []string{filepath.Dir(coverProfile)}
+	}
+	cmd, err := sandboxCommand(ctx, worktree, limits, paths, "go", args...)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	runErr := cmd.Run()
+	result.Duration = time.Since(start)
+
+	packageDirs := make(map[string]string)
+	for i, dir := range dirs {
+		packageDirs[result.Packages[i]] = dir
+	}
+	parseGoTestOutput(result, stdout.Bytes(), stderr.String(), worktree, packageDirs)
+	if ctx.Err() != nil {
+		result.TimedOut = true
+	} else if runErr != nil && len(result.Failures) == 0 {
+		// go test exits non-zero when tests fail; anything else is a sandbox
+		// or toolchain problem
+		result.Err = fmt.Errorf("go test failed: %v\n%s", runErr, truncatePayload(stderr.String()))
+	}
+	return result
+}
+
+var (
+	testOutputLocation = regexp.MustCompile(`^\s+([\w.\-]+\.go):(\d+): (.*)`)
+	buildErrorLocation = regexp.MustCompile(`^(?:\./)?([^\s:]+\.go):(\d+)(?::\d+)?: (.*)`)
+	stackFrameLocation = regexp.MustCompile(`^\s+(/\S+\.go):(\d+)`)
+)
+
+// parseGoTestOutput fills result from `go test -json` output. Failures are
+// located by the first file:line message of a test, or the first stack frame
+// inside worktree for a panic.
+func parseGoTestOutput(result *TestRunResult, stdout []byte, stderr, worktree string, packageDirs map[string]string) {
+	outputs := make(map[string][]string)
+	var failed []TestFailure
+	failedPackages := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(stdout))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var event goTestEvent
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue
+		}
+		key := event.Package + " " + event.Test
+		switch event.Action {
+		case "output":
+			outputs[key] = append(outputs[key], strings.TrimRight(event.Output, "\n"))
+		case "build-output":
+			outputs[event.ImportPath+" "] = append(outputs[event.ImportPath+" "], strings.TrimRight(event.Output, "\n"))
+		case "pass", "skip":
+			if event.Test != "" && !strings.Contains(event.Test, "/") {
+				if event.Action == "pass" {
+					result.Passed++
+				} else {
+					result.Skipped++
+				}
+			}
+		case "fail":
+			if event.Test == "" {
+				failedPackages[event.Package] = true
+				continue
+			}
+			if !strings.Contains(event.Test, "/") {
+				result.Failed++
+			}
+			failed = append(failed, locateTestFailure(event.Package, event.Test, outputs[key], worktree, packageDirs))
+		}
+	}
+
+	// A failing subtest fails its parent too; report the subtest
+	for _, failure := range failed {
+		if !slices.ContainsFunc(failed, func(f TestFailure) bool {
+			return f.Package == failure.Package && strings.HasPrefix(f.Test, failure.Test+"/")
+		}) {
+			result.Failures = append(result.Failures, failure)
+		}
+	}
+	for pkg := range failedPackages {
+		if slices.ContainsFunc(result.Failures, func(f TestFailure) bool { return f.Package == pkg }) {
+			continue
+		}
+		lines := outputs[pkg+" "]
+		if len(lines) == 0 {
+			// Older go versions print build errors to stderr only
+			lines = strings.Split(stderr, "\n")
+		}
+		result.Failures = append(result.Failures, locateTestFailure(pkg, "", lines, worktree, packageDirs))
+	}
+	slices.SortStableFunc(result.Failures, func(a, b TestFailure) int {
+		return strings.Compare(a.Package+" "+a.Test, b.Package+" "+b.Test)
+	})
+}
+
+func locateTestFailure(pkg, test string, lines []string, worktree string, packageDirs map[string]string) TestFailure {
+	failure := TestFailure{Package: pkg, Test: test}
+	dir := packageDirs[pkg]
+	var message []string
+	for i, line := range lines {
+		if strings.HasPrefix(line, "panic: ") {
+			failure.Panic = true
+			message = []string{line}
+			failure.File, failure.Line = "", 0
+			for _, frame := range lines[i+1:] {
+				if m := stackFrameLocation.FindStringSubmatch(frame); m != nil && strings.HasPrefix(m[1], worktree+"/") {
+					failure.File = strings.TrimPrefix(m[1], worktree+"/")
+					fmt.Sscan(m[2], &failure.Line)
+					break
+				}
+			}
+			break
+		}
+		if failure.File != "" {
+			continue
+		}
+		if m := testOutputLocation.FindStringSubmatch(line); m != nil && test != "" {
+			failure.File = path.Join(dir, m[1])
+			fmt.Sscan(m[2], &failure.Line)
+			message = append(message, m[3])
+			// Indented continuation lines belong to the same message
+			for _, next := range lines[i+1:] {
+				if !strings.HasPrefix(next, "        ") || len(message) >= 5 {
+					break
+				}
+				message = append(message, strings.TrimSpace(next))
+			}
+		} else if m := buildErrorLocation.FindStringSubmatch(strings.TrimSpace(line)); m != nil && test == "" {
+			failure.Build = true
+			failure.File = filepath.ToSlash(strings.TrimPrefix(m[1], worktree+"/"))
+			fmt.Sscan(m[2], &failure.Line)
+			message = append(message, m[3])
+		}
+	}
+	if len(message) == 0 {
+		for _, line := range lines {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "=== ") && !strings.HasPrefix(line, "--- ") && line != "FAIL" {
+				message = append(message, line)
+			}
+			if len(message) >= 5 {
+				break
+			}
+		}
+	}
+	failure.Message = strings.Join(message, "\n")
+	return failure
+}
+
+// Comments turns the run's failures into findings. Failures in files the PR
+// changed are attached inline; others name the file and line instead. The
+// diff coverage report and uncovered blocks follow.
+func (r *TestRunResult) Comments(changedFiles []string) []CommentPayload {
+	if r == nil {
+		return nil
+	}
+	var comments []CommentPayload
+	if r.TimedOut {
+		comments = append(comments, CommentPayload{Content: Content{Raw: fmt.Sprintf(
+			"[MAJOR] ⏱️ **Tests timed out**\n\nThe tests of %s did not finish within the sandbox's time limit.",
+			strings.Join(r.Packages, ", "))}})
+	}
+	for i, failure := range r.Failures {
+		if i == maxTestFailureFindings {
+			comments = append(comments, CommentPayload{Content: Content{Raw: fmt.Sprintf(
+				"[BLOCKER] ❌ %d more test failures are not shown.", len(r.Failures)-i)}})
+			break
+		}
+		var title string
+		switch {
+		case failure.Build:
+			title = fmt.Sprintf("❌ **`%s` does not build**", failure.Package)
+		case failure.Panic && failure.Test != "":
+			title = fmt.Sprintf("💥 **`%s` panics**", failure.Test)
+		case failure.Panic:
+			title = fmt.Sprintf("💥 **The tests of `%s` panic**", failure.Package)
+		case failure.Test != "":
+			title = fmt.Sprintf("❌ **`%s` fails**", failure.Test)
+		default:
+			title = fmt.Sprintf("❌ **The tests of `%s` fail**", failure.Package)
+		}
+		text := "[BLOCKER] " + title + " at the PR head"
+		comment := CommentPayload{}
+		if failure.File != "" && slices.Contains(changedFiles, failure.File) {
+			comment.Inline = &Inline{Path: failure.File, To: failure.Line}
+		} else if failure.File != "" {
+			text += fmt.Sprintf(" (`%s:%d`)", failure.File, failure.Line)
+		}
+		if failure.Message != "" {
+			text += ":\n\n```\n" + failure.Message + "\n```"
+		}
+		comment.Content.Raw = text
+		comments = append(comments, comment)
+	}
+	return append(comments, r.Coverage.Comments()...)
+}
+
+// measureDiffCoverage intersects the coverage profile of module with the
+// lines added between destRef and sourceRef
+func measureDiffCoverage(ctx context.Context, repoPath, sourceRef, destRef, coverProfile, module string, minimum float64) (*DiffCoverage, error) {
+	profile, err := os.ReadFile(coverProfile)
+	if err != nil {
+		return nil, fmt.Errorf("no coverage profile: %v", err)
+	}
+	added, err := addedLines(ctx, repoPath, sourceRef, destRef)
+	if err != nil {
+		return nil, err
+	}
+	return computeDiffCoverage(parseCoverProfile(string(profile), module), added, minimum), nil
+}
+
+// formatTestRun summarises r for the TEST CASES chunk
+func formatTestRun(r *TestRunResult) string {
+	if r == nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n## Automated Test Run\n")
+	if r.Err != nil {
+		b.WriteString("# The affected tests could not be run: " + r.Err.Error() + "\n")
+		return b.String()
+	}
+	b.WriteString(fmt.Sprintf("Ran `go test` at the PR head on: %s\n", strings.Join(r.Packages, ", ")))
+	b.WriteString(fmt.Sprintf("- Passed: %d\n- Failed: %d\n- Skipped: %d\n", r.Passed, r.Failed, r.Skipped))
+	if r.TimedOut {
+		b.WriteString("- Timed out before finishing\n")
+	}
+	b.WriteString(r.Coverage.format())
+	for _, failure := range r.Failures {
+		name := failure.Test
+		if name == "" {
+			name = failure.Package
+		}
+		b.WriteString(fmt.Sprintf("\n### FAIL %s\n", name))
+		if failure.File != "" {
+			b.WriteString(fmt.Sprintf("At %s:%d\n", failure.File, failure.Line))
+		}
+		if failure.Message != "" {
+			b.WriteString("```\n" + failure.Message + "\n```\n")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the review pipeline's spans. It is a no-op until
+// setupTracing installs an exporting tracer provider.
+var tracer = otel.Tracer("exoreviewer")
+
+// setupTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT
+// (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is set, and as JSON lines to
+// EXOREVIEWER_TRACE_FILE when that is set. The returned function flushes and
+// stops the exporters.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	var opts []sdktrace.TracerProviderOption
+	var files []*os.File
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		// The exporter reads its endpoint, headers and TLS settings from the
+		// standard OTEL_EXPORTER_OTLP_* variables
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+		log.Println("Exporting traces over OTLP")
+	}
+
+	if path := os.Getenv("EXOREVIEWER_TRACE_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %v", err)
+		}
+		files = append(files, f)
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to create file exporter: %v", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+		log.Printf("Writing traces to %s", path)
+	}
+
+	// Incoming and outgoing requests carry W3C trace context either way
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if len(opts) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("exoreviewer")))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(append(opts, sdktrace.WithResource(res))...)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		for _, f := range files {
+			err = errors.Join(err, f.Close())
+		}
+		return err
+	}, nil
+}
+
+// prAttributes identifies pr on a span
+func prAttributes(pr *PullRequest) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("pr.provider", pr.Provider),
+		attribute.String("pr.repository", pr.Repository),
+		attribute.Int("pr.id", pr.ID),
+		attribute.String("pr.source_branch", pr.SourceBranch),
+		attribute.String("pr.dest_branch", pr.DestBranch),
+		attribute.String("pr.source_commit", pr.SourceCommit),
+	}
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceChunk runs a prompt chunk generator in its own span
+func traceChunk(ctx context.Context, name string, generate func() string) string {
+	_, span := tracer.Start(ctx, "chunk "+name)
+	defer span.End()
+	chunk := generate()
+	span.SetAttributes(attribute.Int("chunk.tokens", estimateTokens(chunk)))
+	return chunk
+}